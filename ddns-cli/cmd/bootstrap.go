@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) Johan Stenstam, johani@johani.org
+ */
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+var bootstrapCmd = &cobra.Command{
+	Use:   "bootstrap",
+	Short: "Upload the first SIG(0) key for a child zone to the parent, signed by the key itself",
+	Long: `Send a DDNS update that adds the child KEY to the parent, self-signed with the
+same key. The parent keeps the key as pending until it has verified (out of band)
+that the child zone publishes the same KEY at the apex. So publish the KEY in the
+child zone before (or directly after) running the bootstrap.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if lib.Zonename == "" {
+			log.Fatalf("Error: child zone name not specified.")
+		}
+		lib.Zonename = dns.Fqdn(lib.Zonename)
+
+		if pzone == "" {
+			log.Fatalf("Error: parent zone name not specified.")
+		}
+		pzone = dns.Fqdn(pzone)
+
+		if parpri == "" {
+			log.Fatalf("Error: parent primary nameserver not specified.")
+		}
+		keyrr, cs, err := LoadSigningKey(lib.Zonename)
+		if err == nil && keyrr == nil {
+			err = fmt.Errorf("no SIG(0) key for %s", lib.Zonename)
+		}
+		if err != nil {
+			log.Fatalf("Error: %v. Key bootstrap not possible.", err)
+		}
+		if dns.CanonicalName(keyrr.Header().Name) != dns.CanonicalName(lib.Zonename) {
+			log.Fatalf("Error: key owner %s is not the child zone %s", keyrr.Header().Name, lib.Zonename)
+		}
+		fmt.Printf("Bootstrapping key with keyid=%d for zone %s\n", keyrr.KeyTag(), lib.Zonename)
+
+		if childpri != "" {
+			published := false
+			keys, err := lib.AuthQuery(lib.Zonename, childpri, dns.TypeKEY)
+			if err != nil {
+				log.Fatalf("Error: looking up child %s KEY RRset in child primary %s: %v",
+					lib.Zonename, childpri, err)
+			}
+			for _, rr := range keys {
+				if k, ok := rr.(*dns.KEY); ok && k.KeyTag() == keyrr.KeyTag() {
+					published = true
+				}
+			}
+			if !published {
+				fmt.Printf("*** Note: key %d is not published in the child zone. The parent will not trust it until it is.\n",
+					keyrr.KeyTag())
+			}
+		}
+
+		dsynctarget, err := lib.LookupDSYNCTarget(lib.Zonename, pzone, parpri, dns.StringToType["ANY"], lib.SchemeUpdate)
+		if err != nil {
+			log.Fatalf("Error from LookupDDNSTarget(%s, %s): %v", pzone, parpri, err)
+		}
+
+		msg, err := CreateUpdate(pzone, lib.Zonename, []dns.RR{keyrr}, []dns.RR{}, nil)
+		if err != nil {
+			log.Fatalf("Error from CreateUpdate(%v): %v", dsynctarget, err)
+		}
+
+		msg, err = lib.SignMsgNG(msg, lib.Zonename, cs, keyrr)
+		if err != nil {
+			log.Fatalf("Error from SignMsgNG(%v): %v", dsynctarget, err)
+		}
+
+		err = SendUpdate(msg, pzone, dsynctarget)
+		if err != nil {
+			log.Fatalf("Error from SendUpdate(%v): %v", dsynctarget, err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(bootstrapCmd)
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) Johan Stenstam, johani@johani.org
+ */
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+// ComputeDSDiff compares the DS RRset that the child wants (from CDS, CDNSKEY or,
+// if neither is published, the KSKs in the DNSKEY RRset) with the DS RRset in the
+// parent. A CDS or CDNSKEY delete sentinel (RFC 8078) means that all DS records
+// should be removed. Returns the same values as ComputeRRDiff.
+func ComputeDSDiff(childpri, parpri, zone string) (bool, []dns.RR, []dns.RR, []dns.RR) {
+	fmt.Printf("*** ComputeDSDiff(%s)\n", zone)
+
+	parentds, err := lib.AuthQuery(zone, parpri, dns.TypeDS)
+	if err != nil {
+		log.Fatalf("Error: looking up child %s DS RRset in parent primary %s: %v", zone, parpri, err)
+	}
+	parentds = normaliseDS(parentds)
+
+	childds, source, err := ChildDS(childpri, zone)
+	if err != nil {
+		log.Fatalf("Error: computing DS for child %s: %v", zone, err)
+	}
+	if source == "" {
+		fmt.Printf("*** Note: child %s publishes no CDS, CDNSKEY or DNSKEY. Not touching the DS RRset.\n", zone)
+		return false, []dns.RR{}, []dns.RR{}, parentds
+	}
+
+	ttl := uint32(3600)
+	if len(parentds) > 0 {
+		ttl = parentds[0].Header().Ttl
+	}
+	for _, rr := range childds {
+		rr.Header().Ttl = ttl
+	}
+
+	fmt.Printf("%d DS RRs from parent, %d DS RRs from child %s\n", len(parentds), len(childds), source)
+	if lib.Global.Debug {
+		for _, rrp := range parentds {
+			fmt.Printf("Parent: %s\n", rrp.String())
+		}
+		for _, rrc := range childds {
+			fmt.Printf("Child:  %s\n", rrc.String())
+		}
+	}
+
+	differ, adds, removes := lib.RRsetDiffer(zone, childds, parentds, dns.TypeDS, log.Default())
+	if differ {
+		fmt.Printf("Parent and child DS RRsets differ. To get parent in sync:\n")
+		for _, rr := range removes {
+			fmt.Printf("Remove: %s\n", rr.String())
+		}
+		for _, rr := range adds {
+			fmt.Printf("Add:   %s\n", rr.String())
+		}
+	}
+	return differ, adds, removes, parentds
+}
+
+// ChildDS returns the DS RRset the child wants in the parent and where it came
+// from ("CDS", "CDNSKEY" or "DNSKEY"). The source is empty if the child publishes
+// none of them. A delete sentinel gives an empty DS RRset from the CDS or CDNSKEY.
+func ChildDS(childpri, zone string) ([]dns.RR, string, error) {
+	var newds []dns.RR
+
+	cds, err := lib.AuthQuery(zone, childpri, dns.TypeCDS)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(cds) > 0 {
+		for _, rr := range cds {
+			c, ok := rr.(*dns.CDS)
+			if !ok {
+				continue
+			}
+			if lib.IsCdsDelete(c) {
+				if len(cds) > 1 {
+					return nil, "", fmt.Errorf("CDS delete sentinel mixed with other CDS records")
+				}
+				fmt.Printf("Child %s publishes the CDS delete sentinel: all DS records should be removed\n", zone)
+				return newds, "CDS", nil
+			}
+			ds := c.DS
+			ds.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypeDS, Class: dns.ClassINET}
+			newds = append(newds, &ds)
+		}
+		return normaliseDS(newds), "CDS", nil
+	}
+
+	cdnskey, err := lib.AuthQuery(zone, childpri, dns.TypeCDNSKEY)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(cdnskey) > 0 {
+		for _, rr := range cdnskey {
+			c, ok := rr.(*dns.CDNSKEY)
+			if !ok {
+				continue
+			}
+			if lib.IsCdnskeyDelete(c) {
+				if len(cdnskey) > 1 {
+					return nil, "", fmt.Errorf("CDNSKEY delete sentinel mixed with other CDNSKEY records")
+				}
+				fmt.Printf("Child %s publishes the CDNSKEY delete sentinel: all DS records should be removed\n", zone)
+				return newds, "CDNSKEY", nil
+			}
+			key := c.DNSKEY
+			key.Hdr.Rrtype = dns.TypeDNSKEY
+			ds := key.ToDS(dns.SHA256)
+			if ds == nil {
+				return nil, "", fmt.Errorf("could not compute DS from CDNSKEY %s", rr.String())
+			}
+			ds.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypeDS, Class: dns.ClassINET}
+			newds = append(newds, ds)
+		}
+		return normaliseDS(newds), "CDNSKEY", nil
+	}
+
+	dnskeys, err := lib.AuthQuery(zone, childpri, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(dnskeys) == 0 {
+		return nil, "", nil
+	}
+	for _, rr := range dnskeys {
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok || key.Flags&dns.SEP == 0 {
+			continue
+		}
+		ds := key.ToDS(dns.SHA256)
+		if ds == nil {
+			return nil, "", fmt.Errorf("could not compute DS from DNSKEY %s", rr.String())
+		}
+		ds.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypeDS, Class: dns.ClassINET}
+		newds = append(newds, ds)
+	}
+	if len(newds) == 0 {
+		return nil, "", fmt.Errorf("DNSKEY RRset has no key with the SEP flag set")
+	}
+	return normaliseDS(newds), "DNSKEY", nil
+}
+
+// normaliseDS lower-cases the digests, as dns.IsDuplicate compares them as strings.
+// DNSKEY.ToDS() and unpacked DS records have lower-case digests, but a DS parsed
+// from presentation format keeps the case it was written in (String() prints
+// upper case).
+func normaliseDS(rrs []dns.RR) []dns.RR {
+	for _, rr := range rrs {
+		if ds, ok := rr.(*dns.DS); ok {
+			ds.Digest = strings.ToLower(ds.Digest)
+		}
+	}
+	return rrs
+}
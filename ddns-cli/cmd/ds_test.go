@@ -0,0 +1,235 @@
+/*
+ * Copyright (c) Johan Stenstam, johani@johani.org
+ */
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testNameserver is an authoritative nameserver for a set of canned RRsets. It
+// also accepts updates, which are recorded and applied to the RRsets.
+type testNameserver struct {
+	Addr    string
+	mu      sync.Mutex
+	rrs     []dns.RR
+	updates []*dns.Msg
+}
+
+func startTestNameserver(t *testing.T, rrs ...string) *testNameserver {
+	t.Helper()
+	ns := &testNameserver{rrs: mustRRs(t, rrs...)}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		Handler:           dns.HandlerFunc(ns.handle),
+		MsgAcceptFunc:     func(dh dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	ns.Addr = pc.LocalAddr().String()
+	return ns
+}
+
+func (ns *testNameserver) handle(w dns.ResponseWriter, r *dns.Msg) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	if r.Opcode == dns.OpcodeUpdate {
+		ns.updates = append(ns.updates, r.Copy())
+		for _, rr := range r.Ns {
+			ns.apply(rr)
+		}
+		w.WriteMsg(m)
+		return
+	}
+
+	q := r.Question[0]
+	for _, rr := range ns.rrs {
+		if strings.EqualFold(rr.Header().Name, q.Name) && rr.Header().Rrtype == q.Qtype {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	w.WriteMsg(m)
+}
+
+// apply applies one RR from the update section, see RFC 2136 section 3.4.2.
+func (ns *testNameserver) apply(rr dns.RR) {
+	h := rr.Header()
+	var keep []dns.RR
+	for _, orr := range ns.rrs {
+		oh := orr.Header()
+		same := strings.EqualFold(oh.Name, h.Name) && oh.Rrtype == h.Rrtype
+		switch h.Class {
+		case dns.ClassANY:
+			if same {
+				continue
+			}
+		case dns.ClassNONE:
+			cp := dns.Copy(rr)
+			cp.Header().Class = dns.ClassINET
+			if same && dns.IsDuplicate(orr, cp) {
+				continue
+			}
+		}
+		keep = append(keep, orr)
+	}
+	if h.Class == dns.ClassINET {
+		keep = append(keep, rr)
+	}
+	ns.rrs = keep
+}
+
+func (ns *testNameserver) RRs() []dns.RR {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.rrs
+}
+
+func (ns *testNameserver) Updates() []*dns.Msg {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.updates
+}
+
+// testPubkey returns a made up ECDSA P-256 public key.
+func testPubkey(seed byte) string {
+	buf := make([]byte, 64)
+	for i := range buf {
+		buf[i] = seed + byte(i)
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// digest returns the SHA-256 DS digest of the DNSKEY (or CDNSKEY) RR.
+func digest(t *testing.T, s string) string {
+	t.Helper()
+	var key *dns.DNSKEY
+	switch rr := mustRRs(t, s)[0].(type) {
+	case *dns.DNSKEY:
+		key = rr
+	case *dns.CDNSKEY:
+		key = &rr.DNSKEY
+		key.Hdr.Rrtype = dns.TypeDNSKEY
+	}
+	return key.ToDS(dns.SHA256).Digest
+}
+
+func TestChildDS(t *testing.T) {
+	zone := "child.parent.example."
+	ksk := fmt.Sprintf("%s 3600 IN DNSKEY 257 3 13 %s", zone, testPubkey(1))
+	zsk := fmt.Sprintf("%s 3600 IN DNSKEY 256 3 13 %s", zone, testPubkey(2))
+	cdnskey := fmt.Sprintf("%s 3600 IN CDNSKEY 257 3 13 %s", zone, testPubkey(3))
+	cds := fmt.Sprintf("%s 3600 IN CDS 4711 13 2 %s", zone, strings.ToUpper(digest(t, cdnskey)))
+	cdsdelete := zone + " 3600 IN CDS 0 0 0 00"
+	cdnskeydelete := zone + " 3600 IN CDNSKEY 0 3 0 AA=="
+
+	tests := []struct {
+		name    string
+		child   []string
+		source  string
+		digests []string
+		err     bool
+	}{
+		{"CDS first", []string{cds, cdnskey, ksk, zsk}, "CDS", []string{digest(t, cdnskey)}, false},
+		{"then CDNSKEY", []string{cdnskey, ksk, zsk}, "CDNSKEY", []string{digest(t, cdnskey)}, false},
+		{"then the KSKs in the DNSKEY RRset", []string{ksk, zsk}, "DNSKEY", []string{digest(t, ksk)}, false},
+		{"CDS delete sentinel", []string{cdsdelete, cdnskey, ksk}, "CDS", nil, false},
+		{"CDNSKEY delete sentinel", []string{cdnskeydelete, ksk}, "CDNSKEY", nil, false},
+		{"CDS delete sentinel mixed with a CDS", []string{cdsdelete, cds}, "", nil, true},
+		{"CDNSKEY delete sentinel mixed with a CDNSKEY", []string{cdnskeydelete, cdnskey}, "", nil, true},
+		{"no KSK in the DNSKEY RRset", []string{zsk}, "", nil, true},
+		{"nothing published", nil, "", nil, false},
+	}
+
+	for _, tt := range tests {
+		child := startTestNameserver(t, tt.child...)
+		ds, source, err := ChildDS(child.Addr, zone)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: ChildDS error %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+		if source != tt.source {
+			t.Errorf("%s: source %q, want %q", tt.name, source, tt.source)
+		}
+		if len(ds) != len(tt.digests) {
+			t.Errorf("%s: %d DS records, want %d", tt.name, len(ds), len(tt.digests))
+			continue
+		}
+		for i, rr := range ds {
+			d := rr.(*dns.DS)
+			if d.Digest != tt.digests[i] || d.Hdr.Name != zone || d.Hdr.Rrtype != dns.TypeDS {
+				t.Errorf("%s: DS %d is %s, want digest %s", tt.name, i, d.String(), tt.digests[i])
+			}
+		}
+	}
+}
+
+func TestComputeDSDiff(t *testing.T) {
+	zone := "child.parent.example."
+	ksk1 := fmt.Sprintf("%s 3600 IN DNSKEY 257 3 13 %s", zone, testPubkey(1))
+	ksk2 := fmt.Sprintf("%s 3600 IN DNSKEY 257 3 13 %s", zone, testPubkey(2))
+	ds1 := fmt.Sprintf("%s 7200 IN DS %d 13 2 %s", zone, mustRRs(t, ksk1)[0].(*dns.DNSKEY).KeyTag(),
+		strings.ToUpper(digest(t, ksk1)))
+
+	tests := []struct {
+		name          string
+		parent, child []string
+		differ        bool
+		adds, removes int
+	}{
+		// the digest is upper case in the parent, but lower case when computed
+		{"in sync", []string{ds1}, []string{ksk1}, false, 0, 0},
+		{"new key", []string{ds1}, []string{ksk2}, true, 1, 1},
+		{"additional key", []string{ds1}, []string{ksk1, ksk2}, true, 1, 0},
+		{"first DS", nil, []string{ksk1}, true, 1, 0},
+		{"delete sentinel", []string{ds1}, []string{zone + " 3600 IN CDS 0 0 0 00", ksk1}, true, 0, 1},
+		{"nothing published", []string{ds1}, nil, false, 0, 0},
+	}
+
+	for _, tt := range tests {
+		parent := startTestNameserver(t, tt.parent...)
+		child := startTestNameserver(t, tt.child...)
+
+		differ, adds, removes, parentds := ComputeDSDiff(child.Addr, parent.Addr, zone)
+		if differ != tt.differ || len(adds) != tt.adds || len(removes) != tt.removes {
+			t.Errorf("%s: differ %v, %d adds and %d removes, want %v, %d and %d", tt.name,
+				differ, len(adds), len(removes), tt.differ, tt.adds, tt.removes)
+		}
+		if len(parentds) != len(tt.parent) {
+			t.Errorf("%s: %d parent DS records observed, want %d", tt.name, len(parentds), len(tt.parent))
+		}
+		// added DS records get the TTL of the existing parent RRset
+		ttl := uint32(3600)
+		if len(tt.parent) > 0 {
+			ttl = 7200
+		}
+		for _, rr := range adds {
+			if rr.Header().Ttl != ttl {
+				t.Errorf("%s: added %s, want TTL %d", tt.name, rr.String(), ttl)
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) Johan Stenstam, johani@johani.org
+ */
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+var keyalg, keydir string
+var keybits int
+var publishin, activatein time.Duration
+
+var keygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Generate a SIG(0) key for the child zone and store it in the keystore",
+	Long: `Generate a new SIG(0) KEY for the child zone and store it in the keystore. With a
+directory keystore (or -K) the key is written to K<zone>+<alg>+<keyid>.key and .private
+files, in the same format as dnssec-keygen. The private key file is only readable by
+the owner. Supported algorithms are ED25519, ECDSAP256SHA256, ECDSAP384SHA384,
+RSASHA256 and RSASHA512.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if lib.Zonename == "" {
+			log.Fatalf("Error: child zone name not specified.")
+		}
+		lib.Zonename = dns.Fqdn(lib.Zonename)
+
+		alg, ok := dns.StringToAlgorithm[strings.ToUpper(keyalg)]
+		if !ok {
+			log.Fatalf("Error: unknown algorithm \"%s\"", keyalg)
+		}
+
+		keyrr, privkey, err := lib.GenerateKey(lib.Zonename, alg, keybits)
+		if err != nil {
+			log.Fatalf("Error from GenerateKey: %v", err)
+		}
+
+		now := time.Now()
+		timing := lib.KeyTiming{
+			Created:  now,
+			Publish:  now.Add(publishin),
+			Activate: now.Add(activatein),
+		}
+
+		var ks lib.KeyStore
+		if keydir != "" {
+			ks, err = lib.NewDirKeyStore(keydir)
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		} else {
+			ks, err = OpenKeyStore()
+			if err != nil {
+				log.Fatalf("Error opening keystore: %v", err)
+			}
+		}
+		if err := ks.Store(keyrr, privkey, timing); err != nil {
+			log.Fatalf("Error storing key in the keystore: %v", err)
+		}
+
+		if lib.Global.Verbose {
+			fmt.Printf("Generated key: %s\n", keyrr.String())
+		}
+		fmt.Printf("%s\n", lib.KeyBasename(keyrr))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(keygenCmd)
+	keygenCmd.Flags().StringVarP(&keyalg, "algorithm", "a", "ED25519", "Key algorithm")
+	keygenCmd.Flags().IntVarP(&keybits, "bits", "b", 2048, "Key size (only used for RSA)")
+	keygenCmd.Flags().StringVarP(&keydir, "keydir", "K", "", "Store the key files in this directory instead of the keystore")
+	keygenCmd.Flags().DurationVarP(&publishin, "publish-in", "", 0, "Publish the key this long after it is created")
+	keygenCmd.Flags().DurationVarP(&activatein, "activate-in", "", 0, "Activate the key this long after it is created")
+}
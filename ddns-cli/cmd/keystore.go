@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) Johan Stenstam, johani@johani.org
+ */
+package cmd
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+var keyid uint16
+
+// OpenKeyStore opens the configured keystore. The default is a directory
+// keystore in ddns.keydirectory.
+func OpenKeyStore() (lib.KeyStore, error) {
+	return lib.OpenKeyStore(keyStoreConfig())
+}
+
+func keyStoreConfig() (string, string) {
+	kstype := viper.GetString("keystore.type")
+	path := viper.GetString("keystore.path")
+	if path == "" && (kstype == "" || kstype == "directory" || kstype == "dir") {
+		path = viper.GetString("ddns.keydirectory")
+	}
+	return kstype, path
+}
+
+// keyStoreMissing is true if the keystore is a directory keystore and the
+// directory is not configured or does not exist.
+func keyStoreMissing() bool {
+	kstype, path := keyStoreConfig()
+	if kstype != "" && kstype != "directory" && kstype != "dir" {
+		return false
+	}
+	if path == "" {
+		return true
+	}
+	_, err := os.Stat(path)
+	return os.IsNotExist(err)
+}
+
+// LoadSigningKey returns the SIG(0) key to sign updates for the owner with. The
+// key is read from --keyfile if specified, otherwise it is looked up in the
+// keystore: the key with --keyid, or the only key pair for the owner. Unless
+// --keyfile or --keyid is given, a missing keystore or no key pair for the owner
+// in it is not an error, the key is then nil.
+func LoadSigningKey(owner string) (*dns.KEY, crypto.Signer, error) {
+	if keyfile != "" {
+		_, cs, rr, ktype, err := lib.ReadKey(keyfile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading key '%s': %v", keyfile, err)
+		}
+		if ktype != "KEY" {
+			return nil, nil, fmt.Errorf("key in %s must be a KEY RR", keyfile)
+		}
+		return rr.(*dns.KEY), cs, nil
+	}
+
+	if keyid == 0 && keyStoreMissing() {
+		return nil, nil, nil
+	}
+	ks, err := OpenKeyStore()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening keystore: %v", err)
+	}
+	if keyid == 0 {
+		keys, err := ks.List(dns.Fqdn(owner))
+		if err != nil {
+			return nil, nil, err
+		}
+		haskey := false
+		for _, ki := range keys {
+			haskey = haskey || ki.HasPrivate
+		}
+		if !haskey {
+			return nil, nil, nil
+		}
+	}
+	return lib.SigningKey(ks, owner, keyid)
+}
+
+// ImportKeyFile stores the key pair in --keyfile in the keystore, so that it
+// can be found by keyid later.
+func ImportKeyFile(ks lib.KeyStore) (*dns.KEY, error) {
+	privkey, _, rr, ktype, err := lib.ReadKey(keyfile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key '%s': %v", keyfile, err)
+	}
+	if ktype != "KEY" {
+		return nil, fmt.Errorf("key in %s must be a KEY RR", keyfile)
+	}
+	keyrr := rr.(*dns.KEY)
+	if err := ks.Store(keyrr, privkey, lib.KeyTiming{}); err != nil {
+		return nil, err
+	}
+	return keyrr, nil
+}
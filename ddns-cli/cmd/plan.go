@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) Johan Stenstam, johani@johani.org
+ */
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+var planfile string
+
+// UpdatePlan is a machine readable description of an unsigned DDNS update, so
+// that it can be reviewed before it is signed and sent with "ddns-cli apply".
+type UpdatePlan struct {
+	Created time.Time       `json:"created"`
+	Parent  string          `json:"parent"`
+	Child   string          `json:"child"`
+	Target  lib.DSYNCTarget `json:"target"`
+	Prereqs []PlanRR        `json:"prereqs"`
+	Updates []PlanRR        `json:"updates"`
+}
+
+// PlanRR is an RR from the prerequisite or update section. The class is kept as
+// in the message (IN, NONE or ANY) and the rdata is empty for operations on
+// complete RRsets or names.
+type PlanRR struct {
+	Owner  string `json:"owner"`
+	TTL    uint32 `json:"ttl"`
+	Class  string `json:"class"`
+	RRtype string `json:"rrtype"`
+	Rdata  string `json:"rdata,omitempty"`
+}
+
+var applyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Sign and send a DDNS update from a plan created with \"sync --plan-out\"",
+	Run: func(cmd *cobra.Command, args []string) {
+		if planfile == "" {
+			log.Fatalf("Error: plan file not specified.")
+		}
+		plan, err := ReadPlan(planfile)
+		if err != nil {
+			log.Fatalf("Error reading plan %s: %v", planfile, err)
+		}
+
+		msg, err := plan.Msg()
+		if err != nil {
+			log.Fatalf("Error from plan.Msg(%s): %v", planfile, err)
+		}
+		fmt.Printf("Plan %s created %s: update of parent %s for child %s, %d prerequisites and %d updates\n",
+			planfile, plan.Created.Format(time.RFC3339), plan.Parent, plan.Child,
+			len(msg.Answer), len(msg.Ns))
+
+		signer, err := NewUpdateSigner(plan.Child)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		msg, err = signer.Sign(msg, plan.Child)
+		if err != nil {
+			log.Fatalf("Error signing update for %s: %v", plan.Child, err)
+		}
+
+		err = SendUpdate(msg, plan.Parent, plan.Target)
+		if err != nil {
+			log.Fatalf("Error from SendUpdate(%v): %v", plan.Target, err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(applyCmd)
+	applyCmd.Flags().StringVarP(&planfile, "plan", "", "", "JSON file with the update plan")
+}
+
+func NewPlanRR(rr dns.RR) PlanRR {
+	h := rr.Header()
+	return PlanRR{
+		Owner:  h.Name,
+		TTL:    h.Ttl,
+		Class:  dns.ClassToString[h.Class],
+		RRtype: dns.TypeToString[h.Rrtype],
+		Rdata:  strings.TrimSpace(strings.TrimPrefix(rr.String(), h.String())),
+	}
+}
+
+// RR converts the plan RR back into an RR for the update message.
+func (prr PlanRR) RR() (dns.RR, error) {
+	class, ok := dns.StringToClass[prr.Class]
+	if !ok {
+		return nil, fmt.Errorf("unknown class \"%s\" for %s", prr.Class, prr.Owner)
+	}
+	rrtype, ok := dns.StringToType[prr.RRtype]
+	if !ok {
+		return nil, fmt.Errorf("unknown RR type \"%s\" for %s", prr.RRtype, prr.Owner)
+	}
+	owner := dns.Fqdn(prr.Owner)
+
+	if prr.Rdata == "" {
+		return &dns.ANY{Hdr: dns.RR_Header{Name: owner, Rrtype: rrtype, Class: class, Ttl: prr.TTL}}, nil
+	}
+
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", owner, prr.TTL, prr.RRtype, prr.Rdata))
+	if err != nil {
+		return nil, err
+	}
+	if rr == nil {
+		return nil, fmt.Errorf("no RR for %s %s", owner, prr.RRtype)
+	}
+	rr.Header().Class = class
+	return rr, nil
+}
+
+func NewUpdatePlan(msg dns.Msg, parent, child string, target lib.DSYNCTarget) UpdatePlan {
+	plan := UpdatePlan{
+		Created: time.Now().UTC(),
+		Parent:  parent,
+		Child:   child,
+		Target:  target,
+		Prereqs: []PlanRR{},
+		Updates: []PlanRR{},
+	}
+	for _, rr := range msg.Answer {
+		plan.Prereqs = append(plan.Prereqs, NewPlanRR(rr))
+	}
+	for _, rr := range msg.Ns {
+		plan.Updates = append(plan.Updates, NewPlanRR(rr))
+	}
+	return plan
+}
+
+// Msg returns the unsigned update message described by the plan.
+func (plan *UpdatePlan) Msg() (dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(plan.Parent))
+
+	for _, prr := range plan.Prereqs {
+		rr, err := prr.RR()
+		if err != nil {
+			return *m, fmt.Errorf("prerequisite: %v", err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	for _, prr := range plan.Updates {
+		rr, err := prr.RR()
+		if err != nil {
+			return *m, fmt.Errorf("update: %v", err)
+		}
+		m.Ns = append(m.Ns, rr)
+	}
+	if len(m.Ns) == 0 {
+		return *m, fmt.Errorf("plan contains no updates")
+	}
+	return *m, nil
+}
+
+func (plan *UpdatePlan) Write(filename string) error {
+	buf, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(buf, '\n'), 0644)
+}
+
+func ReadPlan(filename string) (*UpdatePlan, error) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var plan UpdatePlan
+	if err := json.Unmarshal(buf, &plan); err != nil {
+		return nil, err
+	}
+	if plan.Parent == "" || plan.Child == "" {
+		return nil, fmt.Errorf("plan does not specify both parent and child zone")
+	}
+	if len(plan.Target.Addresses) == 0 {
+		return nil, fmt.Errorf("plan does not specify any target addresses")
+	}
+	return &plan, nil
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) Johan Stenstam, johani@johani.org
+ */
+package cmd
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+func mustRRs(t *testing.T, rrs ...string) []dns.RR {
+	t.Helper()
+	var res []dns.RR
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatalf("dns.NewRR(%q): %v", s, err)
+		}
+		res = append(res, rr)
+	}
+	return res
+}
+
+func TestPlanRoundTrip(t *testing.T) {
+	child := "child.parent.example."
+	target := lib.DSYNCTarget{Name: "ddns.parent.example.", Addresses: []string{"192.0.2.53"}, Port: 53}
+
+	tests := []struct {
+		name          string
+		adds, removes []dns.RR
+		observed      []ObservedRRset
+	}{
+		{
+			name: "adds only",
+			adds: mustRRs(t, "child.parent.example. 3600 IN NS ns3.example.net."),
+		},
+		{
+			name:    "in-bailiwick NS removed with its glue",
+			adds:    mustRRs(t, "child.parent.example. 3600 IN NS ns3.example.net."),
+			removes: mustRRs(t, "child.parent.example. 3600 IN NS ns1.child.parent.example."),
+		},
+		{
+			name: "with prerequisites",
+			adds: mustRRs(t, "child.parent.example. 3600 IN DS 12345 13 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF"),
+			observed: []ObservedRRset{
+				{child, dns.TypeNS, mustRRs(t, "child.parent.example. 3600 IN NS ns1.example.net.")},
+				{child, dns.TypeDS, nil},
+				{"ns1.child.parent.example.", dns.TypeAAAA, mustRRs(t, "ns1.child.parent.example. 3600 IN AAAA 2001:db8::53")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		msg, err := CreateUpdate("parent.example.", child, tt.adds, tt.removes, tt.observed)
+		if err != nil {
+			t.Fatalf("%s: CreateUpdate: %v", tt.name, err)
+		}
+
+		planfile := filepath.Join(t.TempDir(), "plan.json")
+		plan := NewUpdatePlan(msg, "parent.example.", child, target)
+		if err := plan.Write(planfile); err != nil {
+			t.Fatalf("%s: Write: %v", tt.name, err)
+		}
+		read, err := ReadPlan(planfile)
+		if err != nil {
+			t.Fatalf("%s: ReadPlan: %v", tt.name, err)
+		}
+		again, err := read.Msg()
+		if err != nil {
+			t.Fatalf("%s: Msg: %v", tt.name, err)
+		}
+
+		if again.Question[0].Name != "parent.example." || again.Opcode != dns.OpcodeUpdate {
+			t.Errorf("%s: plan gives an update for %s, opcode %s", tt.name, again.Question[0].Name,
+				dns.OpcodeToString[again.Opcode])
+		}
+		for _, section := range []struct {
+			name      string
+			got, want []dns.RR
+		}{
+			{"prerequisite", again.Answer, msg.Answer},
+			{"update", again.Ns, msg.Ns},
+		} {
+			if len(section.got) != len(section.want) {
+				t.Errorf("%s: %d RRs in the %s section, want %d", tt.name, len(section.got), section.name, len(section.want))
+				continue
+			}
+			for i := range section.want {
+				if section.got[i].String() != section.want[i].String() {
+					t.Errorf("%s: %s %d is %q, want %q", tt.name, section.name, i,
+						section.got[i].String(), section.want[i].String())
+				}
+			}
+		}
+		if read.Target.Name != target.Name || read.Target.Port != target.Port {
+			t.Errorf("%s: target is %v, want %v", tt.name, read.Target, target)
+		}
+	}
+}
+
+func TestReadPlanErrors(t *testing.T) {
+	plan := UpdatePlan{Parent: "parent.example.", Child: "child.parent.example."}
+	planfile := filepath.Join(t.TempDir(), "plan.json")
+	if err := plan.Write(planfile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadPlan(planfile); err == nil {
+		t.Errorf("ReadPlan of a plan without target addresses did not fail")
+	}
+
+	plan.Target = lib.DSYNCTarget{Name: "ddns.parent.example.", Addresses: []string{"192.0.2.53"}, Port: 53}
+	if _, err := plan.Msg(); err == nil {
+		t.Errorf("Msg of a plan without updates did not fail")
+	}
+	plan.Updates = []PlanRR{{Owner: "child.parent.example.", Class: "IN", RRtype: "BOGUS", Rdata: "x"}}
+	if _, err := plan.Msg(); err == nil {
+		t.Errorf("Msg of a plan with an unknown RR type did not fail")
+	}
+}
@@ -4,16 +4,15 @@
 package cmd
 
 import (
-        "crypto"
-	"crypto/rsa"
-	"crypto/ed25519"
-	"crypto/ecdsa"
-	
+	"crypto"
+	"encoding/json"
 	"fmt"
 	"log"
-	// "os"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/spf13/cobra"
@@ -22,76 +21,103 @@ import (
 	lib "github.com/johanix/gen-notify-test/lib"
 )
 
+// A key rollover is done in stages, and the state is saved after each stage so
+// that an interrupted roll can be resumed with "roll --resume":
+//
+//	generated  the new key has been generated and stored in the keystore
+//	published  the new key has been added in the parent, signed by the old key
+//	verified   the parent primary serves the new key
+//	retired    the old key has been removed in the parent, signed by the new key
+//
+// After the old key is retired the roll state is removed.
+const (
+	RollGenerated = "generated"
+	RollPublished = "published"
+	RollVerified  = "verified"
+	RollRetired   = "retired"
+)
+
+// Both keys are kept in the keystore, the roll state only refers to them by keyid.
+type RollState struct {
+	Zone     string    `json:"zone"`
+	Parent   string    `json:"parent"`
+	Stage    string    `json:"stage"`
+	OldKeyid uint16    `json:"old-keyid"`
+	NewKeyid uint16    `json:"new-keyid"`
+	Started  time.Time `json:"started"`
+	Updated  time.Time `json:"updated"`
+}
+
+var resume bool
+var rollwait int
+
 var rollCmd = &cobra.Command{
 	Use:   "roll",
-	Short: "Send a DDNS update to roll the SIG(0) key used to sign updates",
+	Short: "Roll the SIG(0) key used to sign updates, in two phases",
+	Long: `Roll the SIG(0) key for the child zone: generate a new key, add it in the parent
+with an update signed by the old key, verify that the parent serves the new key and
+then remove the old key with an update signed by the new key. The old key is taken
+from --keyfile (it is then imported into the keystore) or from the keystore. The new
+key is stored in the keystore and the old key is retired there once the roll is
+complete. An interrupted roll can be continued with --resume.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if lib.Zonename == "" {
 			log.Fatalf("Error: child zone name not specified.")
 		}
 		lib.Zonename = dns.Fqdn(lib.Zonename)
 
-		if pzone == "" {
-			log.Fatalf("Error: parent zone name not specified.")
-		}
-		pzone = dns.Fqdn(pzone)
-
-		if childpri == "" {
-			log.Fatalf("Error: child primary nameserver not specified.")
-		}
 		if parpri == "" {
 			log.Fatalf("Error: parent primary nameserver not specified.")
 		}
 
-		keyrr, cs := LoadSigningKey(keyfile)
-		if keyrr != nil {
-			fmt.Printf("keyid=%d\n", keyrr.KeyTag())
-		} else {
-			fmt.Printf("No signing key specified.\n")
-		}
-
-		newkey, newcs, newpriv, err := GenerateSigningKey(lib.Zonename, keyrr.Algorithm)
+		ks, err := OpenKeyStore()
 		if err != nil {
-			log.Fatalf("Error from GenerateSigningKey: %v", err)
+			log.Fatalf("Error opening keystore: %v", err)
 		}
-		_ = newcs	// XXX: should store the cs and new private key somewhere.
-		_ = newpriv 
-		fmt.Printf("new key: %s\n", newkey.String())
+		statefile := RollStateFile(lib.Zonename)
+		var rs *RollState
 
-		const update_scheme = 2
-		dsynctarget, err := lib.LookupDSYNCTarget(pzone, parpri, dns.StringToType["ANY"], update_scheme)
-		if err != nil {
-			log.Fatalf("Error from LookupDDNSTarget(%s, %s): %v", pzone, parpri, err)
-		}
-
-		adds := []dns.RR{newkey}
-		removes := []dns.RR{keyrr}
-
-		msg, err := CreateUpdate(pzone, lib.Zonename, adds, removes)
-		if err != nil {
-			log.Fatalf("Error from CreateUpdate(%v): %v", dsynctarget, err)
-		}
-
-		if keyfile != "" {
-			fmt.Printf("Signing update.\n")
-			msg, err = lib.SignMsgNG(msg, lib.Zonename, cs, keyrr)
+		if resume {
+			rs, err = LoadRollState(statefile)
 			if err != nil {
-				log.Fatalf("Error from SignMsgNG(%v): %v", dsynctarget, err)
+				log.Fatalf("Error: no roll to resume for %s: %v", lib.Zonename, err)
 			}
+			fmt.Printf("Resuming roll for %s from stage \"%s\" (old key %d, new key %d)\n",
+				rs.Zone, rs.Stage, rs.OldKeyid, rs.NewKeyid)
 		} else {
-			log.Fatalf("Error: Keyfile not specified, key rollover not possible.\n")
+			if _, err := os.Stat(statefile); err == nil {
+				log.Fatalf("Error: a roll for %s is already in progress (%s). Use --resume.",
+					lib.Zonename, statefile)
+			}
+			if pzone == "" {
+				log.Fatalf("Error: parent zone name not specified.")
+			}
+			rs = StartRoll(ks, dns.Fqdn(pzone), statefile)
 		}
 
-		err = SendUpdate(msg, pzone, dsynctarget)
+		dsynctarget, err := lib.LookupDSYNCTarget(rs.Zone, rs.Parent, parpri, dns.StringToType["ANY"], lib.SchemeUpdate)
 		if err != nil {
-			log.Fatalf("Error from SendUpdate(%v): %v", dsynctarget, err)
+			log.Fatalf("Error from LookupDDNSTarget(%s, %s): %v", rs.Parent, parpri, err)
 		}
 
+		for {
+			done, err := rs.Step(ks, dsynctarget, statefile)
+			if err != nil {
+				log.Fatalf("Error: %v. Resume with \"roll --resume\" later.", err)
+			}
+			if done {
+				fmt.Printf("Key roll for %s complete. Future updates are signed with key %d.\n",
+					rs.Zone, rs.NewKeyid)
+				return
+			}
+		}
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(rollCmd)
+	rollCmd.Flags().BoolVarP(&resume, "resume", "", false, "Resume an interrupted key roll")
+	rollCmd.Flags().IntVarP(&rollwait, "wait", "w", 0, "Seconds to wait for the parent to serve the new key")
 
 	rootCmd.PersistentFlags().StringVarP(&lib.Zonename, "zone", "z", "", "Child zone to sync via DDNS")
 	rootCmd.PersistentFlags().StringVarP(&pzone, "pzone", "Z", "", "Parent zone to sync via DDNS")
@@ -100,61 +126,231 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&lib.Global.IMR, "imr", "i", "", "IMR to send the query to")
 }
 
-func GenerateSigningKey(owner string, alg uint8) (*dns.KEY, crypto.Signer, crypto.PrivateKey, error) {
-	var keyrr *dns.KEY
-	var cs crypto.Signer
-	var privkey crypto.PrivateKey
+// StartRoll generates the new key and saves the initial roll state.
+func StartRoll(ks lib.KeyStore, parent, statefile string) *RollState {
+	var oldkey *dns.KEY
 	var err error
+	if keyfile != "" {
+		oldkey, err = ImportKeyFile(ks)
+	} else {
+		oldkey, _, err = lib.SigningKey(ks, lib.Zonename, keyid)
+	}
+	if err != nil {
+		log.Fatalf("Error: no key to roll: %v", err)
+	}
+	fmt.Printf("Rolling key %d for %s\n", oldkey.KeyTag(), lib.Zonename)
 
-	mode := viper.GetString("roll.keygen.mode")
+	newkey, err := GenerateSigningKey(ks, lib.Zonename, oldkey.Algorithm)
+	if err != nil {
+		log.Fatalf("Error from GenerateSigningKey: %v", err)
+	}
+	fmt.Printf("New key: %s\n", newkey.String())
+
+	rs := RollState{
+		Zone:     lib.Zonename,
+		Parent:   parent,
+		OldKeyid: oldkey.KeyTag(),
+		NewKeyid: newkey.KeyTag(),
+		Started:  time.Now().UTC(),
+	}
+	rs.SetStage(RollGenerated, statefile)
+	return &rs
+}
 
-	var bits int
-	switch alg {
-	case dns.ECDSAP256SHA256, dns.ED25519:
-	     bits = 256
-	case dns.ECDSAP384SHA384:
-	     bits = 384
-	case dns.RSASHA256, dns.RSASHA512:
-	     bits = 2048
+// WaitForParentKey returns nil once the parent primary serves the new key,
+// checking every five seconds until the wait time has passed. The KEY RRset is
+// below the delegation in the parent, so it is looked for in the authority and
+// additional sections of a referral as well as in the answer.
+func WaitForParentKey(rs *RollState, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for {
+		keys, _, err := lib.AuthQueryNG(rs.Zone, parpri, dns.TypeKEY)
+		if err != nil {
+			log.Printf("Error looking up %s KEY in parent primary %s: %v", rs.Zone, parpri, err)
+		}
+		for _, rr := range keys {
+			if key, ok := rr.(*dns.KEY); ok && key.KeyTag() == rs.NewKeyid {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("parent primary %s does not serve key %d for %s", parpri, rs.NewKeyid, rs.Zone)
+		}
+		time.Sleep(5 * time.Second)
 	}
+}
 
-	switch mode {
-	case "internal":
-	        nkey := new(dns.KEY)
-		nkey.Hdr.Name = owner
-		nkey.Hdr.Rrtype = dns.TypeKEY
-		nkey.Hdr.Class = dns.ClassINET
-		// nkey.Algorithm  = dns.StringToAlgorithm["ED25519"]
-		nkey.Algorithm  = alg
-		privkey, err = nkey.Generate(bits)
+// Step runs the current stage of the roll and saves the state for the next one.
+// Returns true when the roll is complete and the state has been removed.
+func (rs *RollState) Step(ks lib.KeyStore, target lib.DSYNCTarget, statefile string) (bool, error) {
+	switch rs.Stage {
+	case RollGenerated:
+		oldkey, oldcs, err := rs.LoadKey(ks, rs.OldKeyid)
+		if err != nil {
+			return false, err
+		}
+		newkey, _, err := rs.LoadKey(ks, rs.NewKeyid)
+		if err != nil {
+			return false, err
+		}
+		fmt.Printf("Publishing new key %d in the parent, signed by old key %d\n",
+			rs.NewKeyid, rs.OldKeyid)
+
+		msg, err := CreateUpdate(rs.Parent, rs.Zone, []dns.RR{newkey}, []dns.RR{}, nil)
+		if err != nil {
+			return false, err
+		}
+		msg, err = lib.SignMsgNG(msg, rs.Zone, oldcs, oldkey)
 		if err != nil {
-		   log.Fatalf("Error from nkey.Generate: %v", err)
+			return false, err
 		}
+		if err := SendUpdate(msg, rs.Parent, target); err != nil {
+			return false, fmt.Errorf("error publishing new key: %v", err)
+		}
+		rs.SetStage(RollPublished, statefile)
 
-		kbasename := fmt.Sprintf("K%s+%03d+%03d", owner, nkey.Algorithm, nkey.KeyTag())
-		log.Printf("Key basename: %s", kbasename)
+	case RollPublished:
+		fmt.Printf("Verifying that parent primary %s serves new key %d\n", parpri, rs.NewKeyid)
+		if err := WaitForParentKey(rs, time.Duration(rollwait)*time.Second); err != nil {
+			return false, fmt.Errorf("parent does not (yet) serve new key %d: %v", rs.NewKeyid, err)
+		}
+		rs.SetStage(RollVerified, statefile)
 
-		log.Printf("Generated key: %s", nkey.String())
-		log.Printf("Generated signer: %v",privkey)
+	case RollVerified:
+		oldkey, _, err := rs.LoadKey(ks, rs.OldKeyid)
+		if err != nil {
+			return false, err
+		}
+		newkey, newcs, err := rs.LoadKey(ks, rs.NewKeyid)
+		if err != nil {
+			return false, err
+		}
+		fmt.Printf("Retiring old key %d in the parent, signed by new key %d\n",
+			rs.OldKeyid, rs.NewKeyid)
+
+		msg, err := CreateUpdate(rs.Parent, rs.Zone, []dns.RR{}, []dns.RR{oldkey}, nil)
+		if err != nil {
+			return false, err
+		}
+		msg, err = lib.SignMsgNG(msg, rs.Zone, newcs, newkey)
+		if err != nil {
+			return false, err
+		}
+		if err := SendUpdate(msg, rs.Parent, target); err != nil {
+			return false, fmt.Errorf("error retiring old key: %v", err)
+		}
+		rs.SetStage(RollRetired, statefile)
+
+	case RollRetired:
+		if err := ks.Retire(rs.Zone, rs.OldKeyid); err != nil {
+			log.Printf("Error retiring old key %d in the keystore: %v", rs.OldKeyid, err)
+		}
+		if err := os.Remove(statefile); err != nil {
+			return false, fmt.Errorf("error removing roll state %s: %v", statefile, err)
+		}
+		return true, nil
+
+	default:
+		return false, fmt.Errorf("unknown roll stage \"%s\" in %s", rs.Stage, statefile)
+	}
+	return false, nil
+}
+
+// LoadKey loads one of the keys in the roll from the keystore.
+func (rs *RollState) LoadKey(ks lib.KeyStore, keyid uint16) (*dns.KEY, crypto.Signer, error) {
+	keyrr, cs, err := ks.Load(rs.Zone, keyid)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading key %d for %s from the keystore: %v", keyid, rs.Zone, err)
+	}
+	return keyrr, cs, nil
+}
+
+func RollStateFile(zone string) string {
+	dir := viper.GetString("roll.statedir")
+	if dir == "" {
+		dir = viper.GetString("ddns.keydirectory")
+	}
+	return filepath.Join(dir, zone+"roll.json")
+}
+
+func LoadRollState(statefile string) (*RollState, error) {
+	buf, err := os.ReadFile(statefile)
+	if err != nil {
+		return nil, err
+	}
+	var rs RollState
+	if err := json.Unmarshal(buf, &rs); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", statefile, err)
+	}
+	if rs.Zone != lib.Zonename {
+		return nil, fmt.Errorf("roll state in %s is for zone %s", statefile, rs.Zone)
+	}
+	return &rs, nil
+}
 
-		nkey.Hdr.Rrtype = dns.TypeKEY
-		keyrr = nkey
+// SetStage moves the roll to the next stage and saves the state. The state is
+// written to a temporary file that is renamed, so it is never half-written.
+func (rs *RollState) SetStage(stage, statefile string) {
+	rs.Stage = stage
+	rs.Updated = time.Now().UTC()
+
+	buf, err := json.MarshalIndent(rs, "", "  ")
+	if err != nil {
+		log.Fatalf("Error encoding roll state: %v", err)
+	}
+	tmpfile := statefile + ".tmp"
+	if err := os.WriteFile(tmpfile, append(buf, '\n'), 0600); err != nil {
+		log.Fatalf("Error writing roll state %s: %v", tmpfile, err)
+	}
+	if err := os.Rename(tmpfile, statefile); err != nil {
+		log.Fatalf("Error saving roll state %s: %v", statefile, err)
+	}
+	fmt.Printf("Roll for %s: stage \"%s\" (state saved in %s)\n", rs.Zone, stage, statefile)
+}
+
+// GenerateSigningKey generates a new KEY for the owner, either internally or
+// with an external program like dnssec-keygen, and stores the key pair in the
+// keystore.
+func GenerateSigningKey(ks lib.KeyStore, owner string, alg uint8) (*dns.KEY, error) {
+	mode := viper.GetString("roll.keygen.mode")
+	now := time.Now()
+	timing := lib.KeyTiming{Created: now, Publish: now, Activate: now}
+
+	switch mode {
+	case "internal":
+		nkey, privkey, err := lib.GenerateKey(owner, alg, 0)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Generated key: %s", nkey.String())
+		return nkey, ks.Store(nkey, privkey, timing)
 
 	case "external":
 		keygenprog := viper.GetString("roll.keygen.generator")
 		if keygenprog == "" {
-			log.Fatalf("Error: key generator program not specified.")
+			return nil, fmt.Errorf("key generator program not specified")
+		}
+
+		// the generator writes the key files in a scratch directory, from
+		// where the key is imported into the keystore
+		keydir, err := os.MkdirTemp("", "ddns-cli-keygen")
+		if err != nil {
+			return nil, err
 		}
+		defer os.RemoveAll(keydir)
 
 		algstr := dns.AlgorithmToString[alg]
 
-		cmdline := fmt.Sprintf("%s -a %s -T KEY -n ZONE %s", keygenprog, algstr, owner)
+		cmdline := fmt.Sprintf("%s -K %s -a %s -T KEY -n ZONE %s", keygenprog, keydir, algstr, owner)
 		fmt.Printf("cmd: %s\n", cmdline)
 		cmdsl := strings.Fields(cmdline)
 		command := exec.Command(cmdsl[0], cmdsl[1:]...)
 		out, err := command.CombinedOutput()
 		if err != nil {
-			log.Printf("Error from exec: %v: %v\n", cmdsl, err)
+			return nil, fmt.Errorf("error from exec: %v: %v", cmdsl, err)
 		}
 
 		var keyname string
@@ -164,31 +360,24 @@ func GenerateSigningKey(owner string, alg uint8) (*dns.KEY, crypto.Signer, crypt
 				elems := strings.Fields(l)
 				if strings.HasPrefix(elems[0], "K"+owner) {
 					keyname = elems[0]
-					fmt.Printf("New key is in file %s\n", keyname)
+					fmt.Printf("Generated key %s\n", keyname)
 				}
 			}
 		}
-
-		keyrr, _ = LoadSigningKey(keyname + ".key")
+		if keyname == "" {
+			return nil, fmt.Errorf("no key file name in output from %s", keygenprog)
+		}
+		privkey, _, rr, _, err := lib.ReadKey(filepath.Join(keydir, keyname+".key"))
 		if err != nil {
-			return keyrr, cs, privkey, err
+			return nil, err
+		}
+		nkey, ok := rr.(*dns.KEY)
+		if !ok {
+			return nil, fmt.Errorf("%s did not generate a KEY", keygenprog)
 		}
+		return nkey, ks.Store(nkey, privkey, timing)
 
 	default:
-		log.Fatalf("Error: unknown keygen mode: \"%s\".", mode)
+		return nil, fmt.Errorf("unknown keygen mode: \"%s\"", mode)
 	}
-
-        switch alg {
-        case dns.RSASHA256:
-                cs = privkey.(*rsa.PrivateKey)
-        case dns.ED25519:
-                cs = privkey.(*ed25519.PrivateKey)
-	case dns.ECDSAP256SHA256, dns.ECDSAP384SHA384:
-                cs = privkey.(*ecdsa.PrivateKey)
-        default:
-                log.Fatalf("Error: no support for algorithm %s yet", dns.AlgorithmToString[alg])
-        }
-
-
-	return keyrr, cs, privkey, nil
 }
@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) Johan Stenstam, johani@johani.org
+ */
+package cmd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+func TestRollResume(t *testing.T) {
+	zone := "child.parent.example."
+	lib.Zonename = zone
+	rollwait = 0
+	t.Cleanup(func() { lib.Zonename, parpri = "", "" })
+
+	tests := []struct {
+		name    string
+		stage   string
+		parent  string // keys in the parent: "old", "new" or "both"
+		stages  []string
+		signers []string // key that signed each update sent
+		err     bool
+	}{
+		{"from the start", RollGenerated, "old",
+			[]string{RollPublished, RollVerified, RollRetired, ""}, []string{"old", "new"}, false},
+		{"after the new key was published", RollPublished, "both",
+			[]string{RollVerified, RollRetired, ""}, []string{"new"}, false},
+		{"before the parent serves the new key", RollPublished, "old",
+			[]string{}, nil, true},
+		{"after the new key was verified", RollVerified, "both",
+			[]string{RollRetired, ""}, []string{"new"}, false},
+		{"after the old key was removed in the parent", RollRetired, "new",
+			[]string{""}, nil, false},
+		{"unknown stage", "bogus", "both",
+			[]string{}, nil, true},
+	}
+
+	for _, tt := range tests {
+		ks, err := lib.NewDirKeyStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := map[string]*dns.KEY{}
+		for _, k := range []string{"old", "new"} {
+			key, priv, err := lib.GenerateKey(zone, dns.ED25519, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ks.Store(key, priv, lib.KeyTiming{Created: time.Now()}); err != nil {
+				t.Fatal(err)
+			}
+			keys[k] = key
+		}
+		keyname := map[uint16]string{keys["old"].KeyTag(): "old", keys["new"].KeyTag(): "new"}
+
+		var parentkeys []string
+		for k, key := range keys {
+			if tt.parent == k || tt.parent == "both" {
+				parentkeys = append(parentkeys, key.String())
+			}
+		}
+		parent := startTestNameserver(t, parentkeys...)
+		parpri = parent.Addr
+		host, port, _ := net.SplitHostPort(parent.Addr)
+		p, _ := strconv.Atoi(port)
+		target := lib.DSYNCTarget{Name: "ddns.parent.example.", Addresses: []string{host}, Port: uint16(p)}
+
+		// the roll is resumed from the saved state
+		statefile := filepath.Join(t.TempDir(), zone+"roll.json")
+		start := RollState{Zone: zone, Parent: "parent.example.", OldKeyid: keys["old"].KeyTag(),
+			NewKeyid: keys["new"].KeyTag(), Started: time.Now().UTC()}
+		start.SetStage(tt.stage, statefile)
+		rs, err := LoadRollState(statefile)
+		if err != nil {
+			t.Fatalf("%s: LoadRollState: %v", tt.name, err)
+		}
+
+		stages := []string{}
+		for i := 0; i < 10; i++ {
+			var done bool
+			done, err = rs.Step(ks, target, statefile)
+			if err != nil {
+				break
+			}
+			if done {
+				stages = append(stages, "")
+				break
+			}
+			stages = append(stages, rs.Stage)
+		}
+
+		if (err != nil) != tt.err {
+			t.Errorf("%s: Step error %v, want error %v", tt.name, err, tt.err)
+		}
+		if len(stages) != len(tt.stages) {
+			t.Errorf("%s: went through stages %q, want %q", tt.name, stages, tt.stages)
+		} else {
+			for i := range stages {
+				if stages[i] != tt.stages[i] {
+					t.Errorf("%s: went through stages %q, want %q", tt.name, stages, tt.stages)
+					break
+				}
+			}
+		}
+
+		updates := parent.Updates()
+		if len(updates) != len(tt.signers) {
+			t.Errorf("%s: %d updates sent, want %d", tt.name, len(updates), len(tt.signers))
+			continue
+		}
+		for i, m := range updates {
+			sig, ok := m.Extra[len(m.Extra)-1].(*dns.SIG)
+			if !ok || keyname[sig.KeyTag] != tt.signers[i] {
+				t.Errorf("%s: update %d not signed by the %s key", tt.name, i, tt.signers[i])
+			}
+		}
+
+		if tt.err {
+			// an interrupted roll can be resumed from the same stage
+			if again, err := LoadRollState(statefile); err != nil || again.Stage != tt.stage {
+				t.Errorf("%s: saved roll state %v, %v, want stage %q", tt.name, again, err, tt.stage)
+			}
+			continue
+		}
+
+		if _, err := os.Stat(statefile); !os.IsNotExist(err) {
+			t.Errorf("%s: roll state not removed after the roll: %v", tt.name, err)
+		}
+		if _, _, err := ks.Load(zone, keys["old"].KeyTag()); err == nil {
+			t.Errorf("%s: old key not retired in the keystore", tt.name)
+		}
+		if got := parent.RRs(); len(got) != 1 || !dns.IsDuplicate(got[0], keys["new"]) {
+			t.Errorf("%s: parent has keys %v after the roll, want only the new key", tt.name, got)
+		}
+	}
+}
+
+func TestLoadRollState(t *testing.T) {
+	lib.Zonename = "child.parent.example."
+	t.Cleanup(func() { lib.Zonename = "" })
+	statefile := filepath.Join(t.TempDir(), "roll.json")
+
+	if _, err := LoadRollState(statefile); err == nil {
+		t.Errorf("LoadRollState without a saved state did not fail")
+	}
+
+	rs := RollState{Zone: "other.parent.example.", Parent: "parent.example.", OldKeyid: 1, NewKeyid: 2}
+	rs.SetStage(RollPublished, statefile)
+	if _, err := LoadRollState(statefile); err == nil {
+		t.Errorf("LoadRollState of the roll for another zone did not fail")
+	}
+
+	if err := os.WriteFile(statefile, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRollState(statefile); err == nil {
+		t.Errorf("LoadRollState of a malformed state did not fail")
+	}
+}
@@ -38,6 +38,7 @@ func init() {
 	rootCmd.PersistentFlags().BoolVarP(&lib.Global.Verbose, "verbose", "v", false, "verbose mode")
 	rootCmd.PersistentFlags().BoolVarP(&lib.Global.Debug, "debug", "d", false, "debug mode")
 	rootCmd.PersistentFlags().StringVarP(&keyfile, "keyfile", "k", "", "name of file with private SIG(0) key")
+	rootCmd.PersistentFlags().Uint16VarP(&keyid, "keyid", "", 0, "keyid of the SIG(0) key in the keystore")
 }
 
 
@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) Johan Stenstam, johani@johani.org
+ */
+package cmd
+
+import (
+	"crypto"
+	"fmt"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+// UpdateSigner signs updates to the parent, either with a SIG(0) key or with a
+// TSIG key, depending on ddns.authentication ("sig0", the default, or "tsig").
+// If neither key is available the updates are sent unsigned.
+type UpdateSigner struct {
+	Sig0Key    *dns.KEY
+	Sig0Signer crypto.Signer
+	TsigKey    *lib.TsigKey
+}
+
+// NewUpdateSigner returns the signer for updates for the owner. If no key is
+// configured the signer leaves updates unsigned. It is an error if a configured
+// key can not be loaded.
+func NewUpdateSigner(owner string) (*UpdateSigner, error) {
+	var us UpdateSigner
+	var err error
+
+	switch auth := viper.GetString("ddns.authentication"); auth {
+	case "sig0", "":
+		us.Sig0Key, us.Sig0Signer, err = LoadSigningKey(owner)
+		if err != nil {
+			return nil, fmt.Errorf("error loading SIG(0) key: %v", err)
+		}
+		if us.Sig0Key == nil {
+			fmt.Printf("*** Note: no SIG(0) key for %s, updates are sent unsigned.\n", owner)
+		}
+	case "tsig":
+		us.TsigKey, err = LoadTsigKey()
+		if err != nil {
+			return nil, fmt.Errorf("error loading TSIG key: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown ddns.authentication: \"%s\"", auth)
+	}
+	return &us, nil
+}
+
+func (us *UpdateSigner) Sign(msg dns.Msg, owner string) (dns.Msg, error) {
+	switch {
+	case us.Sig0Key != nil:
+		fmt.Printf("Signing update with SIG(0) key %d.\n", us.Sig0Key.KeyTag())
+		return lib.SignMsgNG(msg, owner, us.Sig0Signer, us.Sig0Key)
+	case us.TsigKey != nil:
+		fmt.Printf("Signing update with TSIG key %s.\n", us.TsigKey.Name)
+		us.TsigKey.Sign(&msg)
+		return msg, nil
+	}
+	fmt.Printf("No key, not signing message.\n")
+	return msg, nil
+}
+
+// LoadTsigKey returns the TSIG key in ddns.tsig. The parent uses the key name as
+// the signer of the update, so the name is normally that of the child zone.
+func LoadTsigKey() (*lib.TsigKey, error) {
+	return lib.NewTsigKey(viper.GetString("ddns.tsig.name"),
+		viper.GetString("ddns.tsig.algorithm"), viper.GetString("ddns.tsig.secret"))
+}
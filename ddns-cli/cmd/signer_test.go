@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) Johan Stenstam, johani@johani.org
+ */
+package cmd
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+func TestNewUpdateSigner(t *testing.T) {
+	zone := "child.parent.example."
+	t.Cleanup(func() { viper.Reset(); keyfile, keyid = "", 0 })
+
+	keydir := t.TempDir()
+	ks, err := lib.NewDirKeyStore(keydir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, priv, err := lib.GenerateKey(zone, dns.ED25519, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Store(key, priv, lib.KeyTiming{Created: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		settings map[string]string
+		keyfile  string
+		keyid    uint16
+		owner    string
+		signed   bool
+		err      bool
+	}{
+		{"no key directory", nil, "", 0, zone, false, false},
+		{"key directory does not exist", map[string]string{"ddns.keydirectory": filepath.Join(keydir, "missing")},
+			"", 0, zone, false, false},
+		{"no key for the zone", map[string]string{"ddns.keydirectory": keydir}, "", 0, "other.parent.example.", false, false},
+		{"key in the keystore", map[string]string{"ddns.keydirectory": keydir}, "", 0, zone, true, false},
+		{"keyid in the keystore", map[string]string{"ddns.keydirectory": keydir}, "", key.KeyTag(), zone, true, false},
+		{"unreadable keyfile", nil, filepath.Join(keydir, "missing.key"), 0, zone, false, true},
+		{"keyid without a keystore", nil, "", key.KeyTag(), zone, false, true},
+		{"keyid not in the keystore", map[string]string{"ddns.keydirectory": keydir}, "", key.KeyTag() + 1, zone, false, true},
+		{"invalid TSIG key", map[string]string{"ddns.authentication": "tsig", "ddns.tsig.name": zone,
+			"ddns.tsig.algorithm": "hmac-sha256", "ddns.tsig.secret": "not base64"}, "", 0, zone, false, true},
+		{"unknown authentication", map[string]string{"ddns.authentication": "bogus"}, "", 0, zone, false, true},
+	}
+
+	for _, tt := range tests {
+		viper.Reset()
+		for k, v := range tt.settings {
+			viper.Set(k, v)
+		}
+		keyfile, keyid = tt.keyfile, tt.keyid
+
+		us, err := NewUpdateSigner(tt.owner)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: NewUpdateSigner error %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+		if signed := us.Sig0Key != nil || us.TsigKey != nil; signed != tt.signed {
+			t.Errorf("%s: signed %v, want %v", tt.name, signed, tt.signed)
+		}
+	}
+}
@@ -4,12 +4,10 @@
 package cmd
 
 import (
-	"crypto"
 	"fmt"
 	"log"
 	"net"
 	"os"
-	"strings"
 
 	"github.com/miekg/dns"
 	"github.com/spf13/cobra"
@@ -21,6 +19,16 @@ import (
 var zonename string
 var imr = "8.8.8.8:53"
 var pzone, childpri, parpri string
+var prereqs, dryrun bool
+var planout string
+
+// ObservedRRset is an RRset (possibly empty) as seen in the parent primary
+// when computing the diff. Used to create update prerequisites.
+type ObservedRRset struct {
+	Owner  string
+	RRtype uint16
+	RRs    []dns.RR
+}
 
 var syncCmd = &cobra.Command{
 	Use:   "sync",
@@ -43,18 +51,56 @@ var syncCmd = &cobra.Command{
 			log.Fatalf("Error: parent primary nameserver not specified.")
 		}
 
-		keyrr, cs := LoadSigningKey(keyfile)
+		signer, err := NewUpdateSigner(lib.Zonename)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		keyrr := signer.Sig0Key
 
 		var differ bool
 		var adds, removes []dns.RR
+		var observed []ObservedRRset
 
 		if viper.GetBool("ddns.update-ns") {
-			differ, adds, removes = ComputeRRDiff(childpri, parpri,
+			var parentns []dns.RR
+			differ, adds, removes, parentns = ComputeRRDiff(childpri, parpri,
 				lib.Zonename, dns.TypeNS)
+			observed = append(observed, ObservedRRset{lib.Zonename, dns.TypeNS, parentns})
 		} else {
 			fmt.Printf("*** Note: configured NOT to update NS RRset.\n")
 		}
 
+		if viper.GetBool("ddns.update-ds") {
+			dsdiff, ds_adds, ds_removes, parentds := ComputeDSDiff(childpri, parpri, lib.Zonename)
+			observed = append(observed, ObservedRRset{lib.Zonename, dns.TypeDS, parentds})
+			if dsdiff {
+				differ = true
+				removes = append(removes, ds_removes...)
+				adds = append(adds, ds_adds...)
+			}
+		} else {
+			fmt.Printf("*** Note: configured NOT to update DS RRset.\n")
+		}
+
+		// The KEY RRset at the delegation point in the parent is the set of SIG(0)
+		// keys the parent trusts for the child. It is below the zone cut, so the
+		// parent primary answers a query for it with a referral and it can not be
+		// observed. Instead the parent KEY RRset is replaced with the complete child
+		// KEY RRset, without any prerequisite on what the parent has.
+		var childkeys []dns.RR
+		if viper.GetBool("ddns.update-key") {
+			childkeys, err = lib.AuthQuery(lib.Zonename, childpri, dns.TypeKEY)
+			if err != nil {
+				log.Fatalf("Error: looking up child %s KEY RRset in child primary %s: %v",
+					lib.Zonename, childpri, err)
+			}
+			fmt.Printf("Replacing the parent KEY RRset with the %d KEY RRs from the child\n", len(childkeys))
+			CheckKeySync(keyrr, childkeys)
+			differ = true
+		} else {
+			fmt.Printf("*** Note: configured NOT to update KEY RRset.\n")
+		}
+
 		child_ns_inb, parent_ns_inb := ComputeBailiwickNS(childpri, parpri, lib.Zonename)
 		for _, ns := range child_ns_inb {
 			fmt.Printf("Child in-bailiwick NS: %s\n", ns)
@@ -66,8 +112,9 @@ var syncCmd = &cobra.Command{
 		for _, ns := range child_ns_inb {
 			if viper.GetBool("ddns.update-a") {
 				fmt.Printf("Comparing A glue for child NS %s:\n", ns)
-				gluediff, a_glue_adds, a_glue_removes := ComputeRRDiff(childpri,
+				gluediff, a_glue_adds, a_glue_removes, parent_a := ComputeRRDiff(childpri,
 					parpri, ns, dns.TypeA)
+				observed = append(observed, ObservedRRset{ns, dns.TypeA, parent_a})
 				if gluediff {
 					differ = true
 					for _, rr := range a_glue_removes {
@@ -83,8 +130,9 @@ var syncCmd = &cobra.Command{
 
 			if viper.GetBool("ddns.update-aaaa") {
 				fmt.Printf("Comparing AAAA glue for child NS %s:\n", ns)
-				gluediff, aaaa_glue_adds, aaaa_glue_removes := ComputeRRDiff(childpri,
+				gluediff, aaaa_glue_adds, aaaa_glue_removes, parent_aaaa := ComputeRRDiff(childpri,
 					parpri, ns, dns.TypeAAAA)
+				observed = append(observed, ObservedRRset{ns, dns.TypeAAAA, parent_aaaa})
 				if gluediff {
 					differ = true
 					for _, rr := range aaaa_glue_removes {
@@ -104,25 +152,43 @@ var syncCmd = &cobra.Command{
 			os.Exit(0)
 		}
 
-		const update_scheme = 2
-		dsynctarget, err := lib.LookupDSYNCTarget(pzone, parpri, dns.StringToType["ANY"], update_scheme)
+		dsynctarget, err := lib.LookupDSYNCTarget(lib.Zonename, pzone, parpri, dns.StringToType["ANY"], lib.SchemeUpdate)
 		if err != nil {
 			log.Fatalf("Error from LookupDDNSTarget(%s, %s): %v", pzone, parpri, err)
 		}
 
-		msg, err := CreateUpdate(pzone, lib.Zonename, adds, removes)
+		if !prereqs {
+			observed = nil
+		}
+		msg, err := CreateUpdate(pzone, lib.Zonename, adds, removes, observed)
 		if err != nil {
 			log.Fatalf("Error from SendUpdate(%v): %v", dsynctarget, err)
 		}
+		if viper.GetBool("ddns.update-key") {
+			ReplaceKeys(&msg, lib.Zonename, childkeys)
+		}
 
-		if keyfile != "" {
-			fmt.Printf("Signing update.\n")
-			msg, err = lib.SignMsgNG(msg, lib.Zonename, cs, keyrr)
-			if err != nil {
-				log.Fatalf("Error from SendUpdate(%v): %v", dsynctarget, err)
+		if planout != "" {
+			plan := NewUpdatePlan(msg, pzone, lib.Zonename, dsynctarget)
+			if err := plan.Write(planout); err != nil {
+				log.Fatalf("Error writing plan to %s: %v", planout, err)
 			}
-		} else {
-			fmt.Printf("Keyfile not specified, not signing message.\n")
+			fmt.Printf("Update plan written to %s. Send it with \"ddns-cli apply --plan %s\".\n",
+				planout, planout)
+		}
+
+		msg, err = signer.Sign(msg, lib.Zonename)
+		if err != nil {
+			log.Fatalf("Error signing update: %v", err)
+		}
+
+		if dryrun {
+			fmt.Printf("Dry run. This UPDATE would be sent to %s (%v port %d):\n%s\n",
+				dsynctarget.Name, dsynctarget.Addresses, dsynctarget.Port, msg.String())
+			os.Exit(0)
+		}
+		if planout != "" {
+			os.Exit(0)
 		}
 
 		err = SendUpdate(msg, pzone, dsynctarget)
@@ -134,6 +200,9 @@ var syncCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(syncCmd)
+	syncCmd.Flags().BoolVarP(&prereqs, "prereqs", "", false, "Require that the parent data is unchanged when the update arrives")
+	syncCmd.Flags().BoolVarP(&dryrun, "dry-run", "", false, "Print the UPDATE that would be sent, but do not send it")
+	syncCmd.Flags().StringVarP(&planout, "plan-out", "", "", "Write the update as a JSON plan for \"ddns-cli apply\" instead of sending it")
 
 //	rootCmd.PersistentFlags().StringVarP(&lib.Zonename, "zone", "z", "", "Child zone to sync via DDNS")
 //	syncCmd.PersistentFlags().StringVarP(&pzone, "pzone", "Z", "", "Parent zone to sync via DDNS")
@@ -142,34 +211,53 @@ func init() {
 //	syncCmd.PersistentFlags().StringVarP(&lib.Global.IMR, "imr", "i", "", "IMR to send the query to")
 }
 
-func LoadSigningKey(keyfile string) (*dns.KEY, crypto.Signer) {
-        var keyrr *dns.KEY
-	var cs crypto.Signer
-	var rr dns.RR
-
-	if keyfile != "" {
-		var ktype string
-		var err error
-		_, cs, rr, ktype, err = lib.ReadKey(keyfile)
-		if err != nil {
-			log.Fatalf("Error reading key '%s': %v", keyfile, err)
-		}
-
-		if ktype != "KEY" {
-			log.Fatalf("Key must be a KEY RR")
+// CheckKeySync warns about a child KEY RRset that will leave the parent without a
+// usable key for the child. The child KEY RRset is the source of truth for which
+// SIG(0) keys the parent trusts, so these are not errors.
+func CheckKeySync(keyrr *dns.KEY, childkeys []dns.RR) {
+	if len(childkeys) == 0 {
+		fmt.Printf("*** Warning: the child publishes no KEY. The parent will not trust any key for the child after this update.\n")
+		return
+	}
+	if keyrr == nil {
+		return
+	}
+	for _, rr := range childkeys {
+		if dns.IsDuplicate(rr, keyrr) {
+			return
 		}
-
-		keyrr = rr.(*dns.KEY)
 	}
-	return keyrr, cs
+	fmt.Printf("*** Warning: the child does not publish the key the update is signed with (keyid %d). Future updates must be signed with another key.\n",
+		keyrr.KeyTag())
 }
 
+// ReplaceKeys adds the removal of the child KEY RRset in the parent, followed by
+// the insertion of the child KEY RRs, to the update.
+func ReplaceKeys(msg *dns.Msg, child string, childkeys []dns.RR) {
+	msg.RemoveRRset([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: child, Rrtype: dns.TypeKEY}}})
+	msg.Insert(childkeys)
+}
+
+// SendUpdate sends the update to the addresses of the target, until one of them
+// responds NOERROR. Returns an error if none of them did.
 func SendUpdate(msg dns.Msg, zonename string, target lib.DSYNCTarget) error {
 	if zonename == "." {
 		fmt.Printf("Error: zone name not specified. Terminating.\n")
 		os.Exit(1)
 	}
 
+	// a TSIG signed update gets its MAC when it is sent, by a client that
+	// knows the secret
+	c := new(dns.Client)
+	if msg.IsTsig() != nil {
+		tsigkey, err := LoadTsigKey()
+		if err != nil {
+			return err
+		}
+		c.TsigSecret = tsigkey.Secrets()
+	}
+
+	rcode := -1
 	for _, dst := range target.Addresses {
 		if lib.Global.Verbose {
 			fmt.Printf("Sending DDNS update for parent zone %s to %s on address %s:%d\n", zonename, target.Name, dst, target.Port)
@@ -180,11 +268,12 @@ func SendUpdate(msg dns.Msg, zonename string, target lib.DSYNCTarget) error {
 		}
 
 		dst = net.JoinHostPort(dst, fmt.Sprintf("%d", target.Port))
-		res, err := dns.Exchange(&msg, dst)
+		res, _, err := c.Exchange(&msg, dst)
 		if err != nil {
-			log.Fatalf("Error from dns.Exchange(%s, UPDATE): %v", dst, err)
+			log.Fatalf("Error from Exchange(%s, UPDATE): %v", dst, err)
 		}
 
+		rcode = res.Rcode
 		if res.Rcode != dns.RcodeSuccess {
 			if lib.Global.Verbose {
 				fmt.Printf("... and got rcode %s back (bad)\n", dns.RcodeToString[res.Rcode])
@@ -194,13 +283,19 @@ func SendUpdate(msg dns.Msg, zonename string, target lib.DSYNCTarget) error {
 			if lib.Global.Verbose {
 				fmt.Printf("... and got rcode NOERROR back (good)\n")
 			}
-			break
+			return nil
 		}
 	}
-	return nil
+	if rcode == -1 {
+		return fmt.Errorf("no addresses for DDNS target %s", target.Name)
+	}
+	return fmt.Errorf("update not accepted by %s, last rcode: %s", target.Name, dns.RcodeToString[rcode])
 }
 
-func CreateUpdate(parent, child string, adds, removes []dns.RR) (dns.Msg, error) {
+// CreateUpdate creates the update message for the parent zone. If observed is
+// non-nil, prerequisites are added that require the parent RRsets to still be
+// exactly what was observed, so that concurrent updates can not clobber each other.
+func CreateUpdate(parent, child string, adds, removes []dns.RR, observed []ObservedRRset) (dns.Msg, error) {
 	if parent == "." {
 		log.Fatalf("Error: parent zone name not specified. Terminating.\n")
 	}
@@ -211,12 +306,26 @@ func CreateUpdate(parent, child string, adds, removes []dns.RR) (dns.Msg, error)
 	m := new(dns.Msg)
 	m.SetUpdate(parent)
 
+	for _, o := range observed {
+		if len(o.RRs) == 0 {
+			// RRset does not exist
+			m.RRsetNotUsed([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: o.Owner, Rrtype: o.RRtype}}})
+			continue
+		}
+		// RRset exists (value dependent). Used() modifies the RRs, so use copies.
+		var rrs []dns.RR
+		for _, rr := range o.RRs {
+			rrs = append(rrs, dns.Copy(rr))
+		}
+		m.Used(rrs)
+	}
+
 	m.Remove(removes)
 	m.Insert(adds)
 
 	for _, nsr := range removes {
 		if ns, ok := nsr.(*dns.NS); ok { // if removing an NS, then also remove any glue
-			if strings.HasSuffix(ns.Ns, child) {
+			if lib.InBailiwick(child, ns.Ns) {
 				rrA := new(dns.A)
 				rrA.Hdr = dns.RR_Header{Name: ns.Ns, Rrtype: dns.TypeA, Class: dns.ClassANY, Ttl: 3600}
 				rrAAAA := new(dns.AAAA)
@@ -232,7 +341,9 @@ func CreateUpdate(parent, child string, adds, removes []dns.RR) (dns.Msg, error)
 	return *m, nil
 }
 
-func ComputeRRDiff(childpri, parpri, owner string, rrtype uint16) (bool, []dns.RR, []dns.RR) {
+// ComputeRRDiff returns whether the child and parent RRsets differ, the RRs to add
+// and remove to get the parent in sync, and the parent RRset as observed.
+func ComputeRRDiff(childpri, parpri, owner string, rrtype uint16) (bool, []dns.RR, []dns.RR, []dns.RR) {
 	fmt.Printf("*** ComputeRRDiff(%s, %s)\n", owner, dns.TypeToString[rrtype])
 	rrname := dns.TypeToString[rrtype]
 	rrs_parent, err := lib.AuthQuery(owner, parpri, rrtype)
@@ -269,7 +380,7 @@ func ComputeRRDiff(childpri, parpri, owner string, rrtype uint16) (bool, []dns.R
 			fmt.Printf("Add:   %s\n", rr.String())
 		}
 	}
-	return differ, adds, removes
+	return differ, adds, removes, rrs_parent
 }
 
 func ComputeBailiwickNS(childpri, parpri, owner string) ([]string, []string) {
@@ -302,14 +413,14 @@ func ComputeBailiwickNS(childpri, parpri, owner string) ([]string, []string) {
 
 	for _, rr := range ns_parent {
 		if ns, ok := rr.(*dns.NS); ok {
-			if strings.HasSuffix(ns.Ns, owner) {
+			if lib.InBailiwick(owner, ns.Ns) {
 				parent_ns_inb = append(parent_ns_inb, ns.Ns)
 			}
 		}
 	}
 	for _, rr := range ns_child {
 		if ns, ok := rr.(*dns.NS); ok {
-			if strings.HasSuffix(ns.Ns, owner) {
+			if lib.InBailiwick(owner, ns.Ns) {
 				child_ns_inb = append(child_ns_inb, ns.Ns)
 			}
 		}
@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) Johan Stenstam, johani@johani.org
+ */
+package cmd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestReplaceKeys(t *testing.T) {
+	child := "child.parent.example."
+	key := func(seed byte) string {
+		return fmt.Sprintf("%s 3600 IN KEY 512 3 13 %s", child, testPubkey(seed))
+	}
+
+	tests := []struct {
+		name              string
+		parent, childkeys []string
+	}{
+		{"first key", nil, []string{key(1)}},
+		{"key added", []string{key(1)}, []string{key(1), key(2)}},
+		{"key rolled", []string{key(1)}, []string{key(2)}},
+		{"all keys removed", []string{key(1), key(2)}, nil},
+	}
+
+	for _, tt := range tests {
+		msg, err := CreateUpdate("parent.example.", child, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("%s: CreateUpdate: %v", tt.name, err)
+		}
+		ReplaceKeys(&msg, child, mustRRs(t, tt.childkeys...))
+
+		// no prerequisite on the parent KEY RRset, which can not be observed
+		if len(msg.Answer) != 0 {
+			t.Errorf("%s: update has %d prerequisites", tt.name, len(msg.Answer))
+		}
+		if len(msg.Ns) != 1+len(tt.childkeys) {
+			t.Fatalf("%s: %d RRs in the update section, want %d", tt.name, len(msg.Ns), 1+len(tt.childkeys))
+		}
+		if h := msg.Ns[0].Header(); h.Class != dns.ClassANY || h.Rrtype != dns.TypeKEY || h.Name != child {
+			t.Errorf("%s: update does not start with the removal of the KEY RRset: %s", tt.name, msg.Ns[0].String())
+		}
+
+		// whatever the parent had, it ends up with the child KEY RRset
+		parent := startTestNameserver(t, tt.parent...)
+		if _, _, err := new(dns.Client).Exchange(&msg, parent.Addr); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := parent.RRs()
+		if len(got) != len(tt.childkeys) {
+			t.Errorf("%s: parent has %d keys after the update, want %d", tt.name, len(got), len(tt.childkeys))
+			continue
+		}
+		for i, rr := range mustRRs(t, tt.childkeys...) {
+			if !dns.IsDuplicate(got[i], rr) {
+				t.Errorf("%s: parent key %d is %s, want %s", tt.name, i, got[i].String(), rr.String())
+			}
+		}
+	}
+}
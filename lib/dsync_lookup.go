@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) Johan Stenstam, johani@johani.org
+ */
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ParentZone locates the zone that z is delegated from by asking the IMR for
+// the SOA of the name one label up. The owner of the SOA in the answer, or in
+// the authority section of a negative response, is the parent zone.
+func ParentZone(z, imr string) (string, error) {
+	z = dns.Fqdn(z)
+	if z == "." {
+		return "", fmt.Errorf("the root zone has no parent")
+	}
+	labels := dns.SplitDomainName(z)
+	upone := dns.Fqdn(strings.Join(labels[1:], "."))
+
+	m := new(dns.Msg)
+	m.SetQuestion(upone, dns.TypeSOA)
+	m.SetEdns0(4096, true)
+	m.CheckingDisabled = true
+
+	if Global.Debug {
+		fmt.Printf("Looking up the parent of %s via %s SOA at %s\n", z, upone, imr)
+	}
+
+	r, err := dns.Exchange(m, imr)
+	if err != nil {
+		return "", fmt.Errorf("error from dns.Exchange(%s, SOA): %v", upone, err)
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return "", fmt.Errorf("query for %s SOA received rcode: %s", upone, dns.RcodeToString[r.Rcode])
+	}
+
+	for _, section := range [][]dns.RR{r.Answer, r.Ns} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeSOA && dns.IsSubDomain(rr.Header().Name, z) {
+				return dns.CanonicalName(rr.Header().Name), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no SOA for %s or any of its ancestors in the response", upone)
+}
+
+// DSYNCLookupNames returns the names to look for the DSYNC RRset of the child
+// at, in order: the child specific name, where the child's labels below the
+// parent are prepended to "_dsync.<parent>", and the parent default at
+// "_dsync.<parent>". A parent wildcard ("*._dsync.<parent>") is matched by
+// the first query.
+func DSYNCLookupNames(child, parent string) ([]string, error) {
+	child, parent = dns.CanonicalName(child), dns.CanonicalName(parent)
+	if child == parent || !dns.IsSubDomain(parent, child) {
+		return nil, fmt.Errorf("%s is not below the parent zone %s", child, parent)
+	}
+	dsync := "_dsync." + parent
+	if parent == "." {
+		dsync = "_dsync."
+	}
+	labels := dns.SplitDomainName(child)
+	prefix := strings.Join(labels[:len(labels)-dns.CountLabel(parent)], ".")
+	return []string{prefix + "." + dsync, dsync}, nil
+}
+
+// LookupDSYNC looks up the DSYNC RRset that applies to the child in the parent
+// zone. The first name in DSYNCLookupNames() that has a DSYNC RRset wins. If
+// there is none, the legacy RRset at the parent apex is used. If child is
+// empty only the parent apex is looked at. The owner name where the RRset was
+// found is returned together with the RRset.
+func LookupDSYNC(child, parent, server string) (string, []*dns.PrivateRR, error) {
+	parent = dns.Fqdn(parent)
+	if child != "" {
+		names, err := DSYNCLookupNames(child, parent)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, name := range names {
+			prrs, err := dsyncQuery(name, server, TypeDSYNC)
+			if err != nil {
+				return "", nil, err
+			}
+			if len(prrs) > 0 {
+				return name, prrs, nil
+			}
+			if Global.Debug {
+				fmt.Printf("No DSYNC RRset at %s\n", name)
+			}
+		}
+	}
+
+	prrs, err := NotifyQuery(parent, server)
+	return parent, prrs, err
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) Johan Stenstam, johani@johani.org
+ */
+
+package lib
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDSYNCLookupNames(t *testing.T) {
+	names, err := DSYNCLookupNames("a.b.Parent.Example", "parent.example.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "a.b._dsync.parent.example." || names[1] != "_dsync.parent.example." {
+		t.Errorf("got %v", names)
+	}
+
+	for _, child := range []string{"parent.example.", "child.other.example."} {
+		if _, err := DSYNCLookupNames(child, "parent.example."); err == nil {
+			t.Errorf("DSYNCLookupNames(%s, parent.example.) did not fail", child)
+		}
+	}
+}
+
+func TestLookupDSYNC(t *testing.T) {
+	soa := "parent.example. 3600 IN SOA ns.parent.example. hostmaster.parent.example. 1 3600 600 86400 300"
+	server := startDSYNCServer(t, []string{
+		soa,
+		"parent.example. 3600 IN NOTIFY CDS 1 5302 legacy.parent.example.",
+		"_dsync.parent.example. 3600 IN DSYNC CDS NOTIFY 5302 default.parent.example.",
+		"child._dsync.parent.example. 3600 IN DSYNC CDS NOTIFY 5302 child.notify.parent.example.",
+		"*.wild._dsync.parent.example. 3600 IN DSYNC CDS NOTIFY 5302 wild.notify.parent.example.",
+	})
+	legacy := startDSYNCServer(t, []string{
+		soa,
+		"parent.example. 3600 IN NOTIFY CDS 1 5302 legacy.parent.example.",
+	})
+
+	for _, tc := range []struct {
+		child, server, owner, target string
+	}{
+		{"child.parent.example.", server, "child._dsync.parent.example.", "child.notify.parent.example."},
+		{"a.wild.parent.example.", server, "a.wild._dsync.parent.example.", "wild.notify.parent.example."},
+		{"other.parent.example.", server, "_dsync.parent.example.", "default.parent.example."},
+		{"child.parent.example.", legacy, "parent.example.", "legacy.parent.example."},
+		{"", server, "parent.example.", "legacy.parent.example."},
+	} {
+		owner, prrs, err := LookupDSYNC(tc.child, "parent.example.", tc.server)
+		if err != nil {
+			t.Fatalf("LookupDSYNC(%q): %v", tc.child, err)
+		}
+		if owner != tc.owner {
+			t.Errorf("LookupDSYNC(%q): found at %s, want %s", tc.child, owner, tc.owner)
+		}
+		if len(prrs) != 1 {
+			t.Fatalf("LookupDSYNC(%q): got %d RRs, want 1", tc.child, len(prrs))
+		}
+		if d, _ := DSYNCData(prrs[0]); d.Target != tc.target {
+			t.Errorf("LookupDSYNC(%q): got target %s, want %s", tc.child, d.Target, tc.target)
+		}
+	}
+
+	for _, tc := range []struct{ zone, parent string }{
+		{"child.parent.example.", "parent.example."},
+		{"a.b.parent.example.", "parent.example."},
+		{"parent.example.", ""},
+	} {
+		parent, err := ParentZone(tc.zone, server)
+		if tc.parent == "" {
+			if err == nil {
+				t.Errorf("ParentZone(%s) = %s, want an error", tc.zone, parent)
+			}
+			continue
+		}
+		if err != nil || parent != tc.parent {
+			t.Errorf("ParentZone(%s) = %q, %v, want %s", tc.zone, parent, err, tc.parent)
+		}
+	}
+
+	if _, err := LookupDSYNCTarget("child.parent.example.", "parent.example.", server, dns.TypeCSYNC, SchemeNotify); err == nil {
+		t.Errorf("LookupDSYNCTarget found a CSYNC target in a CDS only RRset")
+	}
+}
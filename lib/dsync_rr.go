@@ -0,0 +1,202 @@
+/*
+ * Copyright (c) Johan Stenstam, johani@johani.org
+ */
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DSYNC is the standardised successor of the private NOTIFY RR. The rdata is the
+// same, but the scheme is presented as a mnemonic:
+//
+//	parent.example. IN DSYNC CDS NOTIFY 5302 notifications.parent.example.
+const TypeDSYNC = 66
+
+const (
+	SchemeNotify = 1
+	SchemeUpdate = 2
+)
+
+var SchemeToString = map[uint8]string{
+	SchemeNotify: "NOTIFY",
+	SchemeUpdate: "UPDATE",
+}
+
+var StringToScheme = map[string]uint8{
+	"NOTIFY": SchemeNotify,
+	"UPDATE": SchemeUpdate,
+}
+
+type DSYNC struct {
+	Type   uint16
+	Scheme uint8
+	Port   uint16
+	Target string
+}
+
+func NewDSYNC() dns.PrivateRdata { return new(DSYNC) }
+
+// SchemeString returns the mnemonic for the scheme, or the number if there is none.
+func SchemeString(scheme uint8) string {
+	if s, ok := SchemeToString[scheme]; ok {
+		return s
+	}
+	return strconv.Itoa(int(scheme))
+}
+
+func (rd DSYNC) String() string {
+	return fmt.Sprintf("%s\t%s %d %s", dns.Type(rd.Type).String(), SchemeString(rd.Scheme), rd.Port, rd.Target)
+}
+
+func (rd *DSYNC) Parse(txt []string) error {
+	if len(txt) != 4 {
+		return errors.New("DSYNC requires a type, a scheme, a port and a target")
+	}
+
+	t, ok := parseType(txt[0])
+	if !ok {
+		return fmt.Errorf("invalid type in DSYNC: %s", txt[0])
+	}
+
+	scheme, err := parseScheme(txt[1])
+	if err != nil {
+		return fmt.Errorf("invalid DSYNC scheme: %s", txt[1])
+	}
+
+	port, err := strconv.ParseUint(txt[2], 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid DSYNC port: %s", txt[2])
+	}
+
+	target, ok := presentationName(txt[3])
+	if !ok {
+		return fmt.Errorf("invalid DSYNC target: %s", txt[3])
+	}
+
+	rd.Type = t
+	rd.Scheme = scheme
+	rd.Port = uint16(port)
+	rd.Target = target
+	return nil
+}
+
+func (rd *DSYNC) Pack(buf []byte) (int, error) {
+	off, err := packUint16(rd.Type, buf, 0)
+	if err != nil {
+		return off, err
+	}
+	off, err = packUint8(rd.Scheme, buf, off)
+	if err != nil {
+		return off, err
+	}
+	off, err = packUint16(rd.Port, buf, off)
+	if err != nil {
+		return off, err
+	}
+	return dns.PackDomainName(rd.Target, buf, off, nil, false)
+}
+
+// Unpack requires all the fields to be present and no trailing data.
+func (rd *DSYNC) Unpack(buf []byte) (int, error) {
+	var err error
+	off := 0
+
+	rd.Type, off, err = unpackUint16(buf, off)
+	if err != nil {
+		return off, err
+	}
+	rd.Scheme, off, err = unpackUint8(buf, off)
+	if err != nil {
+		return off, err
+	}
+	rd.Port, off, err = unpackUint16(buf, off)
+	if err != nil {
+		return off, err
+	}
+	rd.Target, off, err = dns.UnpackDomainName(buf, off)
+	if err != nil {
+		return off, err
+	}
+	if off != len(buf) {
+		return off, errors.New("trailing data after DSYNC target")
+	}
+	return off, nil
+}
+
+func (rd *DSYNC) Copy(dest dns.PrivateRdata) error {
+	d, ok := dest.(*DSYNC)
+	if !ok {
+		return dns.ErrRdata
+	}
+	*d = *rd
+	return nil
+}
+
+func (rd *DSYNC) Len() int {
+	return 2 + 1 + 2 + domainNameLen(rd.Target)
+}
+
+// parseType accepts the type mnemonics as presented by dns.Type.String(), in
+// any case, as well as the generic TYPEnnn form.
+func parseType(s string) (uint16, bool) {
+	if t, ok := dns.StringToType[s]; ok {
+		return t, true
+	}
+	up := strings.ToUpper(s)
+	if t, ok := dns.StringToType[up]; ok {
+		return t, true
+	}
+	if !strings.HasPrefix(up, "TYPE") {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(up[4:], 10, 16)
+	if err != nil {
+		return 0, false
+	}
+	return uint16(n), true
+}
+
+// presentationName returns the name in the form that unpacking it from wire
+// format gives, so that characters that need escaping always are escaped.
+func presentationName(s string) (string, bool) {
+	name := dns.Fqdn(s)
+	if _, ok := dns.IsDomainName(name); !ok {
+		return "", false
+	}
+	buf := make([]byte, 256)
+	off, err := dns.PackDomainName(name, buf, 0, nil, false)
+	if err != nil {
+		return "", false
+	}
+	name, _, err = dns.UnpackDomainName(buf[:off], 0)
+	return name, err == nil
+}
+
+// domainNameLen returns the length of the name in (uncompressed) wire format.
+func domainNameLen(name string) int {
+	buf := make([]byte, 256)
+	off, err := dns.PackDomainName(dns.Fqdn(name), buf, 0, nil, false)
+	if err != nil {
+		return len(name) + 1
+	}
+	return off
+}
+
+// DSYNCData returns the rdata of a DSYNC RR, or of a legacy NOTIFY RR in the
+// form of a DSYNC.
+func DSYNCData(prr *dns.PrivateRR) (*DSYNC, bool) {
+	switch rd := prr.Data.(type) {
+	case *DSYNC:
+		return rd, true
+	case *NOTIFY:
+		return &DSYNC{Type: rd.Type, Scheme: rd.Scheme, Port: rd.Port, Target: rd.Dest}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) Johan Stenstam, johani@johani.org
+ */
+
+package lib
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	RegisterNotifyRR()
+}
+
+func TestDSYNCPresentation(t *testing.T) {
+	tests := []struct {
+		in, out string
+		dtype   uint16
+		scheme  uint8
+	}{
+		{"parent.example. 3600 IN DSYNC CDS NOTIFY 5302 notifications.parent.example.",
+			"CDS\tNOTIFY 5302 notifications.parent.example.", dns.TypeCDS, SchemeNotify},
+		{"parent.example. 3600 IN DSYNC ANY update 53 ddns.parent.example",
+			"ANY\tUPDATE 53 ddns.parent.example.", dns.TypeANY, SchemeUpdate},
+		{"parent.example. 3600 IN DSYNC TYPE65000 17 53 x.parent.example.",
+			"TYPE65000\t17 53 x.parent.example.", 65000, 17},
+	}
+
+	for _, tc := range tests {
+		rr, err := dns.NewRR(tc.in)
+		if err != nil {
+			t.Fatalf("NewRR(%q): %v", tc.in, err)
+		}
+		prr, ok := rr.(*dns.PrivateRR)
+		if !ok || prr.Header().Rrtype != TypeDSYNC {
+			t.Fatalf("NewRR(%q) is not a DSYNC: %T", tc.in, rr)
+		}
+		d := prr.Data.(*DSYNC)
+		if d.Type != tc.dtype || d.Scheme != tc.scheme {
+			t.Errorf("%q: got type %d scheme %d", tc.in, d.Type, d.Scheme)
+		}
+		if d.String() != tc.out {
+			t.Errorf("%q: presented as %q, want %q", tc.in, d.String(), tc.out)
+		}
+	}
+
+	for _, bad := range []string{
+		"parent.example. IN DSYNC CDS NOTIFY 5302",
+		"parent.example. IN DSYNC BOGUS NOTIFY 5302 x.parent.example.",
+		"parent.example. IN DSYNC CDS BOGUS 5302 x.parent.example.",
+		"parent.example. IN DSYNC CDS NOTIFY 70000 x.parent.example.",
+	} {
+		if _, err := dns.NewRR(bad); err == nil {
+			t.Errorf("NewRR(%q) did not fail", bad)
+		}
+	}
+}
+
+// startDSYNCServer answers queries with the RRs in the zone that match the
+// qname and qtype, or a "*." wildcard when no name in the zone matches. Names
+// that are not in the zone get NXDOMAIN, and negative answers carry the SOA.
+func startDSYNCServer(t *testing.T, zone []string) string {
+	t.Helper()
+	var rrs []dns.RR
+	for _, s := range zone {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			q := r.Question[0]
+			exists, wildcard := false, ""
+			for _, rr := range rrs {
+				owner := rr.Header().Name
+				if SameName(owner, q.Name) {
+					exists = true
+				} else if strings.HasPrefix(owner, "*.") && dns.IsSubDomain(owner[2:], q.Name) {
+					wildcard = owner
+				}
+			}
+			for _, rr := range rrs {
+				if rr.Header().Rrtype != q.Qtype {
+					continue
+				}
+				if SameName(rr.Header().Name, q.Name) {
+					m.Answer = append(m.Answer, rr)
+				} else if !exists && rr.Header().Name == wildcard {
+					synth := dns.Copy(rr)
+					synth.Header().Name = q.Name
+					m.Answer = append(m.Answer, synth)
+				}
+			}
+			if len(m.Answer) == 0 {
+				if !exists && wildcard == "" {
+					m.Rcode = dns.RcodeNameError
+				}
+				for _, rr := range rrs {
+					if rr.Header().Rrtype == dns.TypeSOA && dns.IsSubDomain(rr.Header().Name, q.Name) {
+						m.Ns = append(m.Ns, rr)
+					}
+				}
+			}
+			w.WriteMsg(m)
+		}),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestNotifyQueryFallback(t *testing.T) {
+	legacy := startDSYNCServer(t, []string{
+		"parent.example. 3600 IN NOTIFY CDS 1 5302 legacy.parent.example.",
+	})
+	both := startDSYNCServer(t, []string{
+		"parent.example. 3600 IN NOTIFY CDS 1 5302 legacy.parent.example.",
+		"parent.example. 3600 IN DSYNC CDS NOTIFY 5302 dsync.parent.example.",
+		"parent.example. 3600 IN DSYNC ANY UPDATE 53 dsync.parent.example.",
+	})
+
+	for _, tc := range []struct {
+		server string
+		rrtype uint16
+		target string
+		count  int
+	}{
+		{legacy, TypeNOTIFY, "legacy.parent.example.", 1},
+		{both, TypeDSYNC, "dsync.parent.example.", 2},
+	} {
+		prrs, err := NotifyQuery("parent.example.", tc.server)
+		if err != nil {
+			t.Fatalf("NotifyQuery: %v", err)
+		}
+		if len(prrs) != tc.count {
+			t.Fatalf("got %d RRs, want %d", len(prrs), tc.count)
+		}
+		if prrs[0].Header().Rrtype != tc.rrtype {
+			t.Errorf("got %s, want %s", dns.TypeToString[prrs[0].Header().Rrtype], dns.TypeToString[tc.rrtype])
+		}
+		d, ok := DSYNCData(prrs[0])
+		if !ok || d.Target != tc.target || d.Scheme != SchemeNotify || d.Type != dns.TypeCDS {
+			t.Errorf("got DSYNC data %+v, want CDS NOTIFY to %s", d, tc.target)
+		}
+	}
+}
@@ -2,9 +2,15 @@ module lib
 
 go 1.19
 
-require github.com/miekg/dns v1.1.55
+require (
+	github.com/mattn/go-sqlite3 v1.14.17
+	github.com/miekg/dns v1.1.55
+	github.com/spf13/cobra v1.6.1
+)
 
 require (
+	github.com/inconshreveable/mousetrap v1.0.1 // indirect
+	github.com/spf13/pflag v1.0.5 // indirect
 	golang.org/x/mod v0.7.0 // indirect
 	golang.org/x/net v0.2.0 // indirect
 	golang.org/x/sys v0.2.0 // indirect
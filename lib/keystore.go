@@ -0,0 +1,220 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+package lib
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// States for keys in a KeyStore.
+const (
+	KeyStoreActive  = "active"
+	KeyStoreRetired = "retired"
+)
+
+// KeyInfo describes a key in a KeyStore.
+type KeyInfo struct {
+	Owner      string
+	KeyId      uint16
+	Algorithm  uint8
+	KeyRR      *dns.KEY
+	State      string
+	HasPrivate bool // false for keys where only the public key is known
+}
+
+// KeyStore is a store of SIG(0) keys, indexed on owner name and keyid. It holds
+// both key pairs that are used for signing and public keys that are only used to
+// verify signatures.
+type KeyStore interface {
+	// List returns the keys for the owner, or all keys if owner is "". Retired
+	// keys are not included.
+	List(owner string) ([]KeyInfo, error)
+	// Load returns the key pair. An error is returned if there is no private key.
+	Load(owner string, keyid uint16) (*dns.KEY, crypto.Signer, error)
+	// Store adds the key to the store. privkey may be nil for a public key only.
+	// Storing a key that is already in the store is not an error, and makes a
+	// retired key active again. Storing a different key with the same keyid for
+	// the same owner is an error.
+	Store(keyrr *dns.KEY, privkey crypto.PrivateKey, timing KeyTiming) error
+	// Retire marks the key as no longer in use. It is kept, but not listed.
+	Retire(owner string, keyid uint16) error
+}
+
+// OpenKeyStore returns the KeyStore of the type ("directory" or "sqlite") at
+// the path (the directory or the database file).
+func OpenKeyStore(kstype, path string) (KeyStore, error) {
+	switch kstype {
+	case "directory", "dir", "":
+		return NewDirKeyStore(path)
+	case "sqlite":
+		return NewSqliteKeyStore(path)
+	}
+	return nil, fmt.Errorf("unknown keystore type: \"%s\"", kstype)
+}
+
+// SigningKey returns the key pair to sign with for the owner: the key with the
+// keyid if it is non-zero, otherwise the only active key pair for the owner.
+func SigningKey(ks KeyStore, owner string, keyid uint16) (*dns.KEY, crypto.Signer, error) {
+	owner = dns.Fqdn(owner)
+	if keyid != 0 {
+		return ks.Load(owner, keyid)
+	}
+
+	keys, err := ks.List(owner)
+	if err != nil {
+		return nil, nil, err
+	}
+	var candidates []KeyInfo
+	for _, ki := range keys {
+		if ki.HasPrivate {
+			candidates = append(candidates, ki)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil, nil, fmt.Errorf("no private key for %s in the keystore", owner)
+	case 1:
+		return ks.Load(owner, candidates[0].KeyId)
+	}
+	return nil, nil, fmt.Errorf("%d private keys for %s in the keystore, specify the keyid",
+		len(candidates), owner)
+}
+
+// DirKeyStore keeps the keys as BIND style K<name>+<alg>+<keyid>.key and .private
+// files in a directory. Retired keys are renamed with a ".retired" suffix.
+type DirKeyStore struct {
+	Dir string
+}
+
+func NewDirKeyStore(dir string) (*DirKeyStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("keystore directory not specified")
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("keystore %s is not a directory", dir)
+	}
+	return &DirKeyStore{Dir: dir}, nil
+}
+
+func (ks *DirKeyStore) List(owner string) ([]KeyInfo, error) {
+	var keys []KeyInfo
+
+	entries, err := os.ReadDir(ks.Dir)
+	if err != nil {
+		return keys, fmt.Errorf("error from os.ReadDir(%s): %v", ks.Dir, err)
+	}
+
+	for _, f := range entries {
+		fname := f.Name()
+		if !strings.HasPrefix(fname, "K") || !strings.HasSuffix(fname, ".key") {
+			continue
+		}
+		rr, err := ReadPubKeyFile(filepath.Join(ks.Dir, fname))
+		if err != nil {
+			return keys, err
+		}
+		keyrr, ok := rr.(*dns.KEY)
+		if !ok {
+			continue
+		}
+		if owner != "" && !SameName(keyrr.Header().Name, owner) {
+			continue
+		}
+		_, err = os.Stat(filepath.Join(ks.Dir, strings.TrimSuffix(fname, ".key")+".private"))
+		keys = append(keys, KeyInfo{
+			Owner:      keyrr.Header().Name,
+			KeyId:      keyrr.KeyTag(),
+			Algorithm:  keyrr.Algorithm,
+			KeyRR:      keyrr,
+			State:      KeyStoreActive,
+			HasPrivate: err == nil,
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Owner != keys[j].Owner {
+			return keys[i].Owner < keys[j].Owner
+		}
+		return keys[i].KeyId < keys[j].KeyId
+	})
+	return keys, nil
+}
+
+// basename returns the basename of the key files, whatever the algorithm.
+func (ks *DirKeyStore) basename(owner string, keyid uint16) (string, error) {
+	keys, err := ks.List(owner)
+	if err != nil {
+		return "", err
+	}
+	for _, ki := range keys {
+		if ki.KeyId == keyid {
+			return filepath.Join(ks.Dir, KeyBasename(ki.KeyRR)), nil
+		}
+	}
+	return "", fmt.Errorf("no key %d for %s in keystore %s", keyid, owner, ks.Dir)
+}
+
+func (ks *DirKeyStore) Load(owner string, keyid uint16) (*dns.KEY, crypto.Signer, error) {
+	basename, err := ks.basename(owner, keyid)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, cs, rr, ktype, err := ReadKey(basename + ".private")
+	if err != nil {
+		return nil, nil, err
+	}
+	if ktype != "KEY" {
+		return nil, nil, fmt.Errorf("%s is not a KEY", basename)
+	}
+	return rr.(*dns.KEY), cs, nil
+}
+
+func (ks *DirKeyStore) Store(keyrr *dns.KEY, privkey crypto.PrivateKey, timing KeyTiming) error {
+	basename := filepath.Join(ks.Dir, KeyBasename(keyrr))
+	if rr, err := ReadPubKeyFile(basename + ".key"); err == nil {
+		if !dns.IsDuplicate(rr, keyrr) {
+			return fmt.Errorf("keystore %s has a different key in %s.key", ks.Dir, basename)
+		}
+		if _, err := os.Stat(basename + ".private"); err == nil || privkey == nil {
+			return nil // already stored
+		}
+		if err := os.Remove(basename + ".key"); err != nil {
+			return err // replaced below, now together with the private key
+		}
+	}
+
+	if privkey == nil {
+		pubstr := fmt.Sprintf("; This is a key, keyid %d, for %s\n%s\n", keyrr.KeyTag(),
+			keyrr.Header().Name, keyrr.String())
+		return writeNewFile(basename+".key", pubstr, 0644)
+	}
+	_, err := WriteKeyFiles(ks.Dir, keyrr, privkey, timing)
+	return err
+}
+
+func (ks *DirKeyStore) Retire(owner string, keyid uint16) error {
+	basename, err := ks.basename(owner, keyid)
+	if err != nil {
+		return err
+	}
+	suffix := "." + time.Now().UTC().Format("20060102150405") + ".retired"
+	for _, ext := range []string{".key", ".private"} {
+		err := os.Rename(basename+ext, basename+ext+suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
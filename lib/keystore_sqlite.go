@@ -0,0 +1,196 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+package lib
+
+import (
+	"crypto"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/miekg/dns"
+)
+
+const sqliteKeyStoreTable = `CREATE TABLE IF NOT EXISTS 'Sig0Keys' (
+id		  INTEGER PRIMARY KEY,
+owner		  TEXT,
+keyid		  INTEGER,
+algorithm	  INTEGER,
+keyrr		  TEXT,
+privatekey	  TEXT,
+state		  TEXT,
+created		  INTEGER,
+publish		  INTEGER,
+activate	  INTEGER,
+UNIQUE (owner, keyid)
+)`
+
+// SqliteKeyStore keeps the keys in the Sig0Keys table in a sqlite database. The
+// private key is stored in the same format as in a BIND .private file.
+type SqliteKeyStore struct {
+	DB *sql.DB
+	mu sync.Mutex
+}
+
+func NewSqliteKeyStore(dbfile string) (*SqliteKeyStore, error) {
+	if dbfile == "" {
+		return nil, fmt.Errorf("keystore database not specified")
+	}
+	db, err := sql.Open("sqlite3", dbfile)
+	if err != nil {
+		return nil, fmt.Errorf("error opening keystore %s: %v", dbfile, err)
+	}
+	if _, err := db.Exec(sqliteKeyStoreTable); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating keystore table in %s: %v", dbfile, err)
+	}
+	return &SqliteKeyStore{DB: db}, nil
+}
+
+func (ks *SqliteKeyStore) List(owner string) ([]KeyInfo, error) {
+	var keys []KeyInfo
+
+	q := "SELECT keyrr, privatekey FROM Sig0Keys WHERE state=?"
+	args := []interface{}{KeyStoreActive}
+	if owner != "" {
+		q += " AND owner=?"
+		args = append(args, dns.CanonicalName(owner))
+	}
+	rows, err := ks.DB.Query(q+" ORDER BY owner, keyid", args...)
+	if err != nil {
+		return keys, fmt.Errorf("List: Error from db query: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var keystr, privstr string
+		if err := rows.Scan(&keystr, &privstr); err != nil {
+			return keys, fmt.Errorf("List: Error from rows.Scan: %v", err)
+		}
+		rr, err := dns.NewRR(keystr)
+		if err != nil {
+			return keys, fmt.Errorf("List: Error parsing stored key: %v", err)
+		}
+		keyrr, ok := rr.(*dns.KEY)
+		if !ok {
+			continue
+		}
+		keys = append(keys, KeyInfo{
+			Owner:      keyrr.Header().Name,
+			KeyId:      keyrr.KeyTag(),
+			Algorithm:  keyrr.Algorithm,
+			KeyRR:      keyrr,
+			State:      KeyStoreActive,
+			HasPrivate: privstr != "",
+		})
+	}
+	return keys, rows.Err()
+}
+
+func (ks *SqliteKeyStore) Load(owner string, keyid uint16) (*dns.KEY, crypto.Signer, error) {
+	var keystr, privstr string
+	err := ks.DB.QueryRow("SELECT keyrr, privatekey FROM Sig0Keys WHERE owner=? AND keyid=? AND state=?",
+		dns.CanonicalName(owner), keyid, KeyStoreActive).Scan(&keystr, &privstr)
+	if err == sql.ErrNoRows {
+		return nil, nil, fmt.Errorf("no key %d for %s in the keystore", keyid, owner)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Load: Error from db query: %v", err)
+	}
+	if privstr == "" {
+		return nil, nil, fmt.Errorf("no private key for key %d for %s in the keystore", keyid, owner)
+	}
+
+	rr, err := dns.NewRR(keystr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Load: Error parsing stored key: %v", err)
+	}
+	keyrr, ok := rr.(*dns.KEY)
+	if !ok {
+		return nil, nil, fmt.Errorf("stored key %d for %s is not a KEY", keyid, owner)
+	}
+	k, err := keyrr.ReadPrivateKey(strings.NewReader(privstr), "keystore")
+	if err != nil {
+		return nil, nil, fmt.Errorf("Load: Error parsing stored private key: %v", err)
+	}
+	cs, err := PrivateKeyToSigner(k)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keyrr, cs, nil
+}
+
+func (ks *SqliteKeyStore) Store(keyrr *dns.KEY, privkey crypto.PrivateKey, timing KeyTiming) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	var privstr string
+	if privkey != nil {
+		privstr = keyrr.PrivateKeyString(privkey)
+		if privstr == "" {
+			return fmt.Errorf("unable to encode private key for %s", keyrr.Header().Name)
+		}
+	}
+
+	unix := func(t time.Time) int64 {
+		if t.IsZero() {
+			return 0
+		}
+		return t.Unix()
+	}
+
+	owner := dns.CanonicalName(keyrr.Header().Name)
+	tx, err := ks.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("Store: Error from db.Begin: %v", err)
+	}
+	defer tx.Rollback()
+
+	var keystr string
+	err = tx.QueryRow("SELECT keyrr FROM Sig0Keys WHERE owner=? AND keyid=?",
+		owner, keyrr.KeyTag()).Scan(&keystr)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec(`INSERT INTO Sig0Keys (owner, keyid, algorithm, keyrr, privatekey, state, created, publish, activate)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			owner, keyrr.KeyTag(), keyrr.Algorithm, keyrr.String(),
+			privstr, KeyStoreActive, unix(timing.Created), unix(timing.Publish), unix(timing.Activate))
+
+	case err != nil:
+		return fmt.Errorf("Store: Error from db query: %v", err)
+
+	default:
+		// the keyid is only a checksum, so two keys for the same owner may collide
+		if rr, perr := dns.NewRR(keystr); perr != nil || !dns.IsDuplicate(rr, keyrr) {
+			return fmt.Errorf("keystore has a different key with keyid %d for %s", keyrr.KeyTag(), owner)
+		}
+		// The key is already stored: a retired key becomes active again and a
+		// private key that is already stored is never lost.
+		_, err = tx.Exec(`UPDATE Sig0Keys SET state=?, privatekey=CASE WHEN privatekey='' THEN ? ELSE privatekey END
+WHERE owner=? AND keyid=?`,
+			KeyStoreActive, privstr, owner, keyrr.KeyTag())
+	}
+	if err != nil {
+		return fmt.Errorf("Store: Error storing key %d for %s: %v", keyrr.KeyTag(), keyrr.Header().Name, err)
+	}
+	return tx.Commit()
+}
+
+func (ks *SqliteKeyStore) Retire(owner string, keyid uint16) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	res, err := ks.DB.Exec("UPDATE Sig0Keys SET state=? WHERE owner=? AND keyid=?",
+		KeyStoreRetired, dns.CanonicalName(owner), keyid)
+	if err != nil {
+		return fmt.Errorf("Retire: Error retiring key %d for %s: %v", keyid, owner, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no key %d for %s in the keystore", keyid, owner)
+	}
+	return nil
+}
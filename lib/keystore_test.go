@@ -0,0 +1,136 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+package lib
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestKeyStores(t *testing.T) {
+	dir := t.TempDir()
+	dirks, err := NewDirKeyStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlks, err := NewSqliteKeyStore(filepath.Join(t.TempDir(), "keys.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, ks := range map[string]KeyStore{"directory": dirks, "sqlite": sqlks} {
+		owner := "child.parent.example."
+		timing := KeyTiming{Created: time.Now()}
+
+		key1, priv1, err := GenerateKey(owner, dns.ED25519, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key2, priv2, err := GenerateKey(owner, dns.ECDSAP256SHA256, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubonly, _, err := GenerateKey("other.parent.example.", dns.ED25519, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, k := range []struct {
+			rr   *dns.KEY
+			priv interface{}
+		}{{key1, priv1}, {key2, priv2}, {pubonly, nil}, {key1, priv1}} {
+			if err := ks.Store(k.rr, k.priv, timing); err != nil {
+				t.Fatalf("%s: Store: %v", name, err)
+			}
+		}
+
+		keys, err := ks.List("")
+		if err != nil || len(keys) != 3 {
+			t.Fatalf("%s: List(\"\") returned %d keys, err %v", name, len(keys), err)
+		}
+		keys, err = ks.List("CHILD.parent.example.")
+		if err != nil || len(keys) != 2 {
+			t.Fatalf("%s: List(owner) returned %d keys, err %v", name, len(keys), err)
+		}
+
+		if _, _, err := SigningKey(ks, owner, 0); err == nil {
+			t.Errorf("%s: SigningKey picked a key among two", name)
+		}
+		if _, _, err := SigningKey(ks, "other.parent.example.", 0); err == nil {
+			t.Errorf("%s: SigningKey returned a key without private key", name)
+		}
+
+		rr, cs, err := SigningKey(ks, owner, key2.KeyTag())
+		if err != nil {
+			t.Fatalf("%s: SigningKey: %v", name, err)
+		}
+		if !dns.IsDuplicate(rr, key2) {
+			t.Errorf("%s: loaded %s, want %s", name, rr.String(), key2.String())
+		}
+		m := new(dns.Msg)
+		m.SetUpdate("parent.example.")
+		signed, err := SignMsgNG(*m, owner, cs, rr)
+		if err != nil {
+			t.Fatalf("%s: SignMsgNG: %v", name, err)
+		}
+		buf, _ := signed.Pack()
+		if err := signed.Extra[0].(*dns.SIG).Verify(key2, buf); err != nil {
+			t.Errorf("%s: signature by loaded key does not verify: %v", name, err)
+		}
+
+		if err := ks.Retire(owner, key1.KeyTag()); err != nil {
+			t.Fatalf("%s: Retire: %v", name, err)
+		}
+		if _, _, err := ks.Load(owner, key1.KeyTag()); err == nil {
+			t.Errorf("%s: retired key could still be loaded", name)
+		}
+		if _, _, err := SigningKey(ks, owner, 0); err != nil {
+			t.Errorf("%s: SigningKey with one key left: %v", name, err)
+		}
+
+		// storing a retired key again makes it active
+		if err := ks.Store(key1, priv1, timing); err != nil {
+			t.Fatalf("%s: Store of retired key: %v", name, err)
+		}
+		if _, _, err := ks.Load(owner, key1.KeyTag()); err != nil {
+			t.Errorf("%s: key stored again after Retire: %v", name, err)
+		}
+
+		collision := collidingKey(t, key2)
+		if err := ks.Store(collision, nil, timing); err == nil {
+			t.Errorf("%s: Store of a different key with keyid %d did not fail", name, key2.KeyTag())
+		}
+		if rr, _, err := ks.Load(owner, key2.KeyTag()); err != nil || !dns.IsDuplicate(rr, key2) {
+			t.Errorf("%s: key %d changed by a colliding Store: %v", name, key2.KeyTag(), err)
+		}
+	}
+}
+
+// collidingKey returns a different key with the same owner, algorithm and keyid.
+// The keyid sums the rdata bytes at even and odd offsets separately, and the
+// public key starts at an even offset, so swapping two bytes at even offsets in
+// the public key does not change it.
+func collidingKey(t *testing.T, key *dns.KEY) *dns.KEY {
+	t.Helper()
+	pub, err := base64.StdEncoding.DecodeString(key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i < len(pub); i += 2 {
+		if pub[i] != pub[0] {
+			pub[0], pub[i] = pub[i], pub[0]
+			break
+		}
+	}
+	c := *key
+	c.PublicKey = base64.StdEncoding.EncodeToString(pub)
+	if c.KeyTag() != key.KeyTag() || c.PublicKey == key.PublicKey {
+		t.Fatalf("unable to create a key colliding with %s", key.String())
+	}
+	return &c
+}
@@ -0,0 +1,96 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+package lib
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// CanonicalLabels returns the labels of the name as they are on the wire (i.e. with
+// escapes like "\." and "\065" resolved), lower-cased according to RFC 4343. The
+// root label is not included. IDNs are compared in their A-label ("xn--") form,
+// there is no IDNA mapping of U-labels.
+func CanonicalLabels(name string) ([]string, bool) {
+	buf := make([]byte, 256)
+	n, err := dns.PackDomainName(dns.Fqdn(name), buf, 0, nil, false)
+	if err != nil {
+		return nil, false
+	}
+
+	var labels []string
+	for off := 0; off < n; {
+		l := int(buf[off])
+		if l == 0 {
+			break
+		}
+		label := buf[off+1 : off+1+l]
+		for i, c := range label {
+			if c >= 'A' && c <= 'Z' {
+				label[i] = c + ('a' - 'A')
+			}
+		}
+		labels = append(labels, string(label))
+		off += l + 1
+	}
+	return labels, true
+}
+
+// InBailiwick returns true if name is equal to or below zone. Names are compared
+// label by label, case-insensitively, so "ample." is not in the bailiwick of
+// "example." even though the strings share a suffix.
+func InBailiwick(zone, name string) bool {
+	zl, ok := CanonicalLabels(zone)
+	if !ok {
+		return false
+	}
+	nl, ok := CanonicalLabels(name)
+	if !ok || len(nl) < len(zl) {
+		return false
+	}
+	offset := len(nl) - len(zl)
+	for i := range zl {
+		if nl[offset+i] != zl[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// SameName returns true if the two names are equal, compared in the same way as
+// InBailiwick.
+func SameName(a, b string) bool {
+	al, ok := CanonicalLabels(a)
+	if !ok {
+		return false
+	}
+	bl, ok := CanonicalLabels(b)
+	if !ok || len(al) != len(bl) {
+		return false
+	}
+	for i := range al {
+		if al[i] != bl[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// BelowZone returns true if name is strictly below zone.
+func BelowZone(zone, name string) bool {
+	return InBailiwick(zone, name) && !SameName(zone, name)
+}
+
+// IsCdsDelete returns true for the RFC 8078 delete sentinel "CDS 0 0 0 00".
+func IsCdsDelete(cds *dns.CDS) bool {
+	return cds.KeyTag == 0 && cds.Algorithm == 0 && cds.DigestType == 0 &&
+		strings.TrimLeft(cds.Digest, "0") == ""
+}
+
+// IsCdnskeyDelete returns true for the RFC 8078 delete sentinel "CDNSKEY 0 3 0 AA==".
+func IsCdnskeyDelete(cdnskey *dns.CDNSKEY) bool {
+	return cdnskey.Flags == 0 && cdnskey.Protocol == 3 && cdnskey.Algorithm == 0 &&
+		cdnskey.PublicKey == "AA=="
+}
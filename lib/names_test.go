@@ -0,0 +1,114 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+package lib
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestInBailiwick(t *testing.T) {
+	tests := []struct {
+		zone, name string
+		in, below  bool
+	}{
+		// plain hierarchy
+		{"example.", "example.", true, false},
+		{"example.", "www.example.", true, true},
+		{"example.", "a.b.c.example.", true, true},
+		{"www.example.", "example.", false, false},
+		{"example.", "example.net.", false, false},
+		{".", "example.", true, true},
+
+		// suffix, but not on a label boundary
+		{"ample.", "example.", false, false},
+		{"child.parent.example.", "evilchild.parent.example.", false, false},
+		{"child.parent.example.", "ns1.evilchild.parent.example.", false, false},
+
+		// not fully qualified
+		{"parent.example", "child.parent.example", true, true},
+
+		// mixed case
+		{"Child.Parent.Example.", "ns1.CHILD.parent.example.", true, true},
+		{"child.parent.example.", "CHILD.PARENT.EXAMPLE.", true, false},
+
+		// escaped labels
+		{"example.", "\\065mple.", false, false},
+		{"\\097mple.", "ns.AMPLE.", true, true},
+		{"ample.", "foo\\.ample.", false, false},
+		{"foo\\.ample.", "ns.foo\\.ample.", true, true},
+		{"ample.", "ns.foo\\.ample.", false, false},
+		{"ex\\ ample.", "ns.EX\\032AMPLE.", true, true},
+
+		// IDNs, compared as A-labels
+		{"xn--bcher-kva.example.", "ns1.xn--bcher-kva.example.", true, true},
+		{"XN--BCHER-KVA.example.", "ns1.xn--bcher-kva.example.", true, true},
+		{"cher-kva.example.", "xn--bcher-kva.example.", false, false},
+		{"xn--bcher-kva.example.", "ns1.bücher.example.", false, false},
+		{"bücher.example.", "ns1.bücher.example.", true, true},
+	}
+
+	for _, tt := range tests {
+		if got := InBailiwick(tt.zone, tt.name); got != tt.in {
+			t.Errorf("InBailiwick(%q, %q) = %v, want %v", tt.zone, tt.name, got, tt.in)
+		}
+		if got := BelowZone(tt.zone, tt.name); got != tt.below {
+			t.Errorf("BelowZone(%q, %q) = %v, want %v", tt.zone, tt.name, got, tt.below)
+		}
+	}
+}
+
+func TestSameName(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"example.", "example.", true},
+		{"example", "example.", true},
+		{"Example.", "eXAMPLE.", true},
+		{"\\069xample.", "example.", true},
+		{"a\\.b.example.", "a.b.example.", false},
+		{"xn--bcher-kva.", "XN--BCHER-KVA.", true},
+		{"example.", "ample.", false},
+	}
+
+	for _, tt := range tests {
+		if got := SameName(tt.a, tt.b); got != tt.same {
+			t.Errorf("SameName(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.same)
+		}
+	}
+}
+
+func TestDeleteSentinels(t *testing.T) {
+	tests := []struct {
+		rr     string
+		delete bool
+	}{
+		{"child.example. IN CDS 0 0 0 00", true},
+		{"child.example. IN CDS 0 0 0 0000", true},
+		{"child.example. IN CDS 12345 13 2 0123456789ABCDEF", false},
+		{"child.example. IN CDS 0 0 1 00", false},
+		{"child.example. IN CDNSKEY 0 3 0 AA==", true},
+		{"child.example. IN CDNSKEY 257 3 0 AA==", false},
+		{"child.example. IN CDNSKEY 0 3 13 AA==", false},
+	}
+
+	for _, tt := range tests {
+		rr, err := dns.NewRR(tt.rr)
+		if err != nil {
+			t.Fatalf("dns.NewRR(%q): %v", tt.rr, err)
+		}
+		var got bool
+		switch r := rr.(type) {
+		case *dns.CDS:
+			got = IsCdsDelete(r)
+		case *dns.CDNSKEY:
+			got = IsCdnskeyDelete(r)
+		}
+		if got != tt.delete {
+			t.Errorf("%q: delete sentinel = %v, want %v", tt.rr, got, tt.delete)
+		}
+	}
+}
@@ -25,31 +25,31 @@ type NOTIFY struct {
 func NewNOTIFY() dns.PrivateRdata { return new(NOTIFY) }
 
 func (rd NOTIFY) String() string {
-	return fmt.Sprintf("%s\t%d %d %s", dns.TypeToString[rd.Type], rd.Scheme, rd.Port, rd.Dest)
+	return fmt.Sprintf("%s\t%d %d %s", dns.Type(rd.Type).String(), rd.Scheme, rd.Port, rd.Dest)
 }
 
 func (rd *NOTIFY) Parse(txt []string) error {
 	if len(txt) != 4 {
 		return errors.New("NOTIFY requires a type, a scheme, a port and a destination")
 	}
-	t := dns.StringToType[txt[0]]
-	if t == 0 {
+	t, ok := parseType(txt[0])
+	if !ok {
 		return errors.New("invalid type in NOTIFY specification")
 	}
 
-	scheme, err := strconv.Atoi(txt[1])
+	scheme, err := strconv.ParseUint(txt[1], 10, 8)
 	if err != nil {
 		return fmt.Errorf("invalid NOTIFY scheme: %s. Error: %v", txt[1], err)
 	}
 
-	port, err := strconv.Atoi(txt[2])
+	port, err := strconv.ParseUint(txt[2], 10, 16)
 	if err != nil {
 		return fmt.Errorf("invalid NOTIFY port: %s. Error: %v", txt[2], err)
 	}
 
-	dst := dns.Fqdn(txt[3])
-	if _, ok := dns.IsDomainName(dst); !ok {
-		return fmt.Errorf("invalid NOTIFY destination: %s. Error: %v", txt[3], err)
+	dst, ok := presentationName(txt[3])
+	if !ok {
+		return fmt.Errorf("invalid NOTIFY destination: %s", txt[3])
 	}
 
 	rd.Type = t
@@ -115,6 +115,7 @@ func (rd *NOTIFY) Pack(buf []byte) (int, error) {
 	return off, nil
 }
 
+// Unpack requires all the fields to be present and no trailing data.
 func (rd *NOTIFY) Unpack(buf []byte) (int, error) {
 	var off = 0
 	var err error
@@ -123,54 +124,45 @@ func (rd *NOTIFY) Unpack(buf []byte) (int, error) {
 	if err != nil {
 		return off, err
 	}
-	if off == len(buf) {
-		return off, nil
-	}
 
 	rd.Scheme, off, err = unpackUint8(buf, off)
 	if err != nil {
 		return off, err
 	}
-	if off == len(buf) {
-		return off, nil
-	}
 
 	rd.Port, off, err = unpackUint16(buf, off)
 	if err != nil {
 		return off, err
 	}
-	if off == len(buf) {
-		return off, nil
-	}
 
 	rd.Dest, off, err = dns.UnpackDomainName(buf, off)
 	if err != nil {
 		return off, err
 	}
+	if off != len(buf) {
+		return off, errors.New("trailing data after NOTIFY destination")
+	}
 	return off, nil
 }
 
 func (rd *NOTIFY) Copy(dest dns.PrivateRdata) error {
-     	cp := make([]byte, rd.Len())
-	_, err := rd.Pack(cp)
-	if err != nil {
-		return err
+	d, ok := dest.(*NOTIFY)
+	if !ok {
+		return dns.ErrRdata
 	}
-
-	d := dest.(*NOTIFY)
-	d.Type = rd.Type
-	d.Scheme = rd.Scheme
-	d.Port = rd.Port
-	d.Dest = rd.Dest
+	*d = *rd
 	return nil
 }
 
+// Len is the length of the rdata in wire format, the destination is never compressed.
 func (rd *NOTIFY) Len() int {
-	return 1 + 2 + 2 + len(rd.Dest) + 1 // add 1 for terminating 0
+	return 2 + 1 + 2 + domainNameLen(rd.Dest)
 }
 
+// RegisterNotifyRR registers both the DSYNC RR and the legacy private NOTIFY RR
+// with the dns package.
 func RegisterNotifyRR() error {
+	dns.PrivateHandle("DSYNC", TypeDSYNC, NewDSYNC)
 	dns.PrivateHandle("NOTIFY", TypeNOTIFY, NewNOTIFY)
 	return nil
 }
-
@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) Johan Stenstam, johani@johani.org
+ */
+
+package lib
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// privateTypes are the DSYNC RR and the legacy NOTIFY RR, which share the rdata
+// wire format.
+var privateTypes = []struct {
+	name   string
+	rrtype uint16
+	new    func() dns.PrivateRdata
+}{
+	{"DSYNC", TypeDSYNC, NewDSYNC},
+	{"NOTIFY", TypeNOTIFY, NewNOTIFY},
+}
+
+// packRdata returns the rdata in wire format and checks that Len() agrees
+// with the number of bytes packed.
+func packRdata(t testing.TB, rd dns.PrivateRdata) []byte {
+	t.Helper()
+	buf := make([]byte, 2+1+2+256)
+	n, err := rd.Pack(buf)
+	if err != nil {
+		t.Fatalf("Pack(%s): %v", rd.String(), err)
+	}
+	if n != rd.Len() {
+		t.Fatalf("Len(%s) = %d, but %d bytes were packed", rd.String(), rd.Len(), n)
+	}
+	return buf[:n]
+}
+
+func TestNOTIFYLen(t *testing.T) {
+	for _, dest := range []string{
+		".",
+		"notifications.parent.example.",
+		`a\.b.parent.example.`,
+		`\000\255.parent.example.`,
+		"NOTIFICATIONS.Parent.Example.",
+	} {
+		rd := &NOTIFY{Type: dns.TypeCDS, Scheme: 1, Port: 5302, Dest: dest}
+		packRdata(t, rd)
+
+		// the RR as a whole must also be sized correctly for the dns package
+		rr := &dns.PrivateRR{Hdr: dns.RR_Header{Name: "parent.example.", Rrtype: TypeNOTIFY,
+			Class: dns.ClassINET, Ttl: 3600}, Data: rd}
+		buf := make([]byte, dns.Len(rr))
+		if _, err := dns.PackRR(rr, buf, 0, nil, false); err != nil {
+			t.Errorf("PackRR(%s) into dns.Len() bytes: %v", rr.String(), err)
+		}
+	}
+}
+
+func TestMalformedRdata(t *testing.T) {
+	valid, _ := hex.DecodeString("003b0114b60d6e6f74696669636174696f6e7306706172656e74076578616d706c6500")
+
+	for _, pt := range privateTypes {
+		for i := 0; i < len(valid); i++ {
+			if _, err := pt.new().Unpack(valid[:i]); err == nil {
+				t.Errorf("%s: Unpack of rdata truncated to %d bytes did not fail", pt.name, i)
+			}
+		}
+		if _, err := pt.new().Unpack(append(valid[:len(valid):len(valid)], 0)); err == nil {
+			t.Errorf("%s: Unpack of rdata with trailing data did not fail", pt.name)
+		}
+		if _, err := pt.new().Unpack(valid); err != nil {
+			t.Errorf("%s: Unpack of valid rdata: %v", pt.name, err)
+		}
+
+		// the generic encoding of the truncated rdata must be rejected too
+		rr := fmt.Sprintf("parent.example. 3600 IN TYPE%d \\# 5 003b0114b6", pt.rrtype)
+		if _, err := dns.NewRR(rr); err == nil {
+			t.Errorf("%s: NewRR(%q) did not fail", pt.name, rr)
+		}
+	}
+
+	for _, bad := range []string{
+		"parent.example. IN NOTIFY CDS 256 5302 x.parent.example.",
+		"parent.example. IN NOTIFY CDS 1 70000 x.parent.example.",
+		"parent.example. IN NOTIFY BOGUS 1 5302 x.parent.example.",
+	} {
+		if _, err := dns.NewRR(bad); err == nil {
+			t.Errorf("NewRR(%q) did not fail", bad)
+		}
+	}
+}
+
+func TestRdataRoundTrip(t *testing.T) {
+	for _, rr := range []string{
+		"parent.example. 3600 IN NOTIFY CDS 1 5302 notifications.parent.example.",
+		"parent.example. 3600 IN NOTIFY TYPE65000 255 0 .",
+		"parent.example. 3600 IN DSYNC CSYNC NOTIFY 5302 notifications.parent.example.",
+		"parent.example. 3600 IN DSYNC ANY UPDATE 53 ddns.parent.example.",
+		`parent.example. 3600 IN DSYNC CDS 200 65535 a\.b.parent.example.`,
+	} {
+		checkRoundTrip(t, rr)
+	}
+}
+
+// checkRoundTrip parses the RR, and checks that the presentation format, the
+// wire format and the RFC 3597 generic encoding all give back the same rdata.
+func checkRoundTrip(t testing.TB, s string) {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("NewRR(%q): %v", s, err)
+	}
+	prr, ok := rr.(*dns.PrivateRR)
+	if !ok {
+		t.Fatalf("NewRR(%q) is a %T, not a private RR", s, rr)
+	}
+	wire := packRdata(t, prr.Data)
+
+	again, err := dns.NewRR(prr.String())
+	if err != nil {
+		t.Fatalf("NewRR(%q) of the presentation format: %v", prr.String(), err)
+	}
+	if b := packRdata(t, again.(*dns.PrivateRR).Data); !bytes.Equal(b, wire) {
+		t.Errorf("%q: presentation format round trip gave %x, want %x", s, b, wire)
+	}
+
+	rd := NewDSYNC()
+	if prr.Header().Rrtype == TypeNOTIFY {
+		rd = NewNOTIFY()
+	}
+	if _, err := rd.Unpack(wire); err != nil {
+		t.Fatalf("%q: Unpack: %v", s, err)
+	}
+	if b := packRdata(t, rd); !bytes.Equal(b, wire) {
+		t.Errorf("%q: wire format round trip gave %x, want %x", s, b, wire)
+	}
+
+	u := new(dns.RFC3597)
+	if err := u.ToRFC3597(prr); err != nil {
+		t.Fatalf("%q: ToRFC3597: %v", s, err)
+	}
+	if u.Rdata != hex.EncodeToString(wire) {
+		t.Errorf("%q: RFC 3597 rdata is %s, want %x", s, u.Rdata, wire)
+	}
+	generic, err := dns.NewRR(u.String())
+	if err != nil {
+		t.Fatalf("NewRR(%q) of the RFC 3597 format: %v", u.String(), err)
+	}
+	gprr, ok := generic.(*dns.PrivateRR)
+	if !ok || gprr.Header().Rrtype != prr.Header().Rrtype {
+		t.Fatalf("RFC 3597 round trip of %q gave %q", prr.String(), generic.String())
+	}
+	if b := packRdata(t, gprr.Data); !bytes.Equal(b, wire) {
+		t.Errorf("RFC 3597 round trip of %q gave %x, want %x", prr.String(), b, wire)
+	}
+}
+
+func FuzzRdataUnpack(f *testing.F) {
+	for _, seed := range []string{
+		"003b0114b60d6e6f74696669636174696f6e7306706172656e74076578616d706c6500",
+		"00ff0200350400646e7300",
+		"003b0114b600",
+		"003b0114b60100",
+		"003b0114b6c000",
+	} {
+		b, _ := hex.DecodeString(seed)
+		f.Add(b)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, pt := range privateTypes {
+			rd := pt.new()
+			if _, err := rd.Unpack(data); err != nil {
+				// the generic encoding of the same rdata must be rejected as well
+				rr := fmt.Sprintf("x. IN TYPE%d \\# %d %x", pt.rrtype, len(data), data)
+				if len(data) > 0 {
+					if _, err := dns.NewRR(rr); err == nil {
+						t.Errorf("%s: %x does not unpack, but NewRR(%q) succeeds", pt.name, data, rr)
+					}
+				}
+				continue
+			}
+			wire := packRdata(t, rd)
+			rd2 := pt.new()
+			if _, err := rd2.Unpack(wire); err != nil || rd2.String() != rd.String() {
+				t.Fatalf("%s: repacked %x unpacks to %q, %v; want %q", pt.name, wire, rd2.String(), err, rd.String())
+			}
+			prr := &dns.PrivateRR{Hdr: dns.RR_Header{Name: "x.", Rrtype: pt.rrtype,
+				Class: dns.ClassINET, Ttl: 3600}, Data: rd}
+			checkRoundTrip(t, prr.String())
+		}
+	})
+}
+
+func FuzzRdataParse(f *testing.F) {
+	for _, seed := range []string{
+		"CDS 1 5302 notifications.parent.example.",
+		"CSYNC NOTIFY 5302 notifications.parent.example.",
+		"ANY UPDATE 53 ddns",
+		"TYPE65000 17 0 .",
+		`CDS 1 1 a\.b\000.example.`,
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, rdata string) {
+		for _, pt := range privateTypes {
+			s := fmt.Sprintf("x. 3600 IN %s %s", pt.name, rdata)
+			rr, err := dns.NewRR(s)
+			if err != nil || rr == nil {
+				continue
+			}
+			if _, ok := rr.(*dns.PrivateRR); !ok {
+				continue
+			}
+			checkRoundTrip(t, s)
+		}
+	})
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright (c) Johan Stenstam, johani@johani.org
+ */
+package lib
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// PublishPlan describes the notification endpoints of a parent zone. The
+// DSYNC (or legacy NOTIFY) RRset and the address records of the targets are
+// generated from it, rather than written one record at a time:
+//
+//	parent:   parent.example.
+//	endpoints:
+//	  - types:     [ CDS, CSYNC ]
+//	    schemes:   [ notify ]
+//	    port:      5302
+//	    target:    notifications
+//	    addresses: [ 127.0.0.1 ]
+//
+// Relative names are relative to the parent zone.
+type PublishPlan struct {
+	Parent    string
+	Ttl       uint32 // default 3600
+	RRtype    string // DSYNC (default) or NOTIFY
+	Owner     string // default _dsync.<parent> for DSYNC and the apex for NOTIFY
+	Endpoints []PublishEndpoint
+}
+
+type PublishEndpoint struct {
+	Owner     string // overrides the owner of the plan, e.g. for a specific child
+	Types     []string
+	Schemes   []string
+	Port      uint16 // default 53
+	Target    string
+	Addresses []string // only for targets in the parent zone
+}
+
+// absName makes name absolute, relative names are relative to the origin.
+func absName(name, origin string) string {
+	switch {
+	case name == "" || name == "@":
+		return origin
+	case dns.IsFqdn(name):
+		return name
+	case origin == ".":
+		return name + "."
+	}
+	return name + "." + origin
+}
+
+// RRs returns the DSYNC (or NOTIFY) RRs and the address records for the targets
+// in the plan.
+func (p *PublishPlan) RRs() ([]dns.RR, []dns.RR, error) {
+	var dsyncrrs, addrrrs []dns.RR
+
+	if p.Parent == "" {
+		return nil, nil, fmt.Errorf("publish plan: parent zone not specified")
+	}
+	parent := dns.Fqdn(p.Parent)
+	ttl := p.Ttl
+	if ttl == 0 {
+		ttl = 3600
+	}
+
+	rrtype := uint16(TypeDSYNC)
+	owner := "_dsync"
+	switch strings.ToUpper(p.RRtype) {
+	case "", "DSYNC":
+	case "NOTIFY":
+		rrtype, owner = TypeNOTIFY, "@"
+	default:
+		return nil, nil, fmt.Errorf("publish plan: unknown rrtype %s, must be DSYNC or NOTIFY", p.RRtype)
+	}
+	if p.Owner != "" {
+		owner = p.Owner
+	}
+
+	if len(p.Endpoints) == 0 {
+		return nil, nil, fmt.Errorf("publish plan: no endpoints for %s", parent)
+	}
+
+	for i, ep := range p.Endpoints {
+		epowner := owner
+		if ep.Owner != "" {
+			epowner = ep.Owner
+		}
+		epowner = absName(epowner, parent)
+		if !InBailiwick(parent, epowner) {
+			return nil, nil, fmt.Errorf("publish plan: endpoint %d: owner %s is not in the parent zone %s", i, epowner, parent)
+		}
+
+		if ep.Target == "" {
+			return nil, nil, fmt.Errorf("publish plan: endpoint %d: target not specified", i)
+		}
+		target := absName(ep.Target, parent)
+		if _, ok := dns.IsDomainName(target); !ok {
+			return nil, nil, fmt.Errorf("publish plan: endpoint %d: invalid target %s", i, ep.Target)
+		}
+		port := ep.Port
+		if port == 0 {
+			port = 53
+		}
+
+		if len(ep.Types) == 0 || len(ep.Schemes) == 0 {
+			return nil, nil, fmt.Errorf("publish plan: endpoint %d (%s): both types and schemes must be specified", i, target)
+		}
+		for _, ts := range ep.Types {
+			t, ok := parseType(ts)
+			if !ok {
+				return nil, nil, fmt.Errorf("publish plan: endpoint %d (%s): unknown type %s", i, target, ts)
+			}
+			for _, ss := range ep.Schemes {
+				scheme, err := parseScheme(ss)
+				if err != nil {
+					return nil, nil, fmt.Errorf("publish plan: endpoint %d (%s): %v", i, target, err)
+				}
+				prr := &dns.PrivateRR{
+					Hdr: dns.RR_Header{Name: epowner, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl},
+				}
+				if rrtype == TypeNOTIFY {
+					prr.Data = &NOTIFY{Type: t, Scheme: scheme, Port: port, Dest: target}
+				} else {
+					prr.Data = &DSYNC{Type: t, Scheme: scheme, Port: port, Target: target}
+				}
+				dsyncrrs = appendUnique(dsyncrrs, prr)
+			}
+		}
+
+		if len(ep.Addresses) > 0 && !InBailiwick(parent, target) {
+			return nil, nil, fmt.Errorf("publish plan: endpoint %d: the addresses of %s can not be published in %s", i, target, parent)
+		}
+		for _, a := range ep.Addresses {
+			ip := net.ParseIP(a)
+			hdr := dns.RR_Header{Name: target, Class: dns.ClassINET, Ttl: ttl}
+			switch {
+			case ip == nil:
+				return nil, nil, fmt.Errorf("publish plan: endpoint %d (%s): invalid address %s", i, target, a)
+			case ip.To4() != nil:
+				hdr.Rrtype = dns.TypeA
+				addrrrs = appendUnique(addrrrs, &dns.A{Hdr: hdr, A: ip.To4()})
+			default:
+				hdr.Rrtype = dns.TypeAAAA
+				addrrrs = appendUnique(addrrrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	}
+	return dsyncrrs, addrrrs, nil
+}
+
+// Update returns a DDNS update for the parent zone that replaces the RRsets in
+// the plan (at the DSYNC owners and the targets) with the generated RRs.
+func (p *PublishPlan) Update() (*dns.Msg, error) {
+	dsyncrrs, addrrrs, err := p.RRs()
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(p.Parent))
+
+	removed := map[string]bool{}
+	for _, rr := range append(append([]dns.RR{}, dsyncrrs...), addrrrs...) {
+		key := dns.CanonicalName(rr.Header().Name) + "/" + strconv.Itoa(int(rr.Header().Rrtype))
+		if removed[key] {
+			continue
+		}
+		removed[key] = true
+		m.RemoveRRset([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: rr.Header().Name, Rrtype: rr.Header().Rrtype}}})
+	}
+	m.Insert(dsyncrrs)
+	m.Insert(addrrrs)
+	return m, nil
+}
+
+func parseScheme(s string) (uint8, error) {
+	if scheme, ok := StringToScheme[strings.ToUpper(s)]; ok {
+		return scheme, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("unknown scheme %s", s)
+	}
+	return uint8(n), nil
+}
+
+// appendUnique compares the presentation format, as dns.IsDuplicate() is always
+// false for private RR types.
+func appendUnique(rrs []dns.RR, rr dns.RR) []dns.RR {
+	for _, r := range rrs {
+		if strings.EqualFold(r.String(), rr.String()) {
+			return rrs
+		}
+	}
+	return append(rrs, rr)
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) Johan Stenstam, johani@johani.org
+ */
+
+package lib
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPublishPlan(t *testing.T) {
+	plan := PublishPlan{
+		Parent: "parent.example",
+		Endpoints: []PublishEndpoint{
+			{Types: []string{"CDS", "csync"}, Schemes: []string{"notify"}, Port: 5302,
+				Target: "notifications", Addresses: []string{"127.0.0.1", "::1"}},
+			{Types: []string{"ANY"}, Schemes: []string{"UPDATE"},
+				Target: "ddns.parent.example.", Addresses: []string{"192.0.2.53"}},
+			{Owner: "child._dsync", Types: []string{"CDS"}, Schemes: []string{"notify"}, Port: 5302,
+				Target: "scanner.operator.example."},
+			// the same target again gives no duplicate records
+			{Types: []string{"CDS"}, Schemes: []string{"notify"}, Port: 5302,
+				Target: "notifications.parent.example.", Addresses: []string{"127.0.0.1"}},
+		},
+	}
+
+	dsyncrrs, addrrrs, err := plan.RRs()
+	if err != nil {
+		t.Fatalf("RRs: %v", err)
+	}
+
+	var got []string
+	for _, rr := range append(dsyncrrs, addrrrs...) {
+		got = append(got, rr.String())
+	}
+	want := []string{
+		"_dsync.parent.example.\t3600\tIN\tDSYNC\tCDS\tNOTIFY 5302 notifications.parent.example.",
+		"_dsync.parent.example.\t3600\tIN\tDSYNC\tCSYNC\tNOTIFY 5302 notifications.parent.example.",
+		"_dsync.parent.example.\t3600\tIN\tDSYNC\tANY\tUPDATE 53 ddns.parent.example.",
+		"child._dsync.parent.example.\t3600\tIN\tDSYNC\tCDS\tNOTIFY 5302 scanner.operator.example.",
+		"notifications.parent.example.\t3600\tIN\tA\t127.0.0.1",
+		"notifications.parent.example.\t3600\tIN\tAAAA\t::1",
+		"ddns.parent.example.\t3600\tIN\tA\t192.0.2.53",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// the generated records must be usable in RFC 3597 form as well
+	for _, rr := range dsyncrrs {
+		u, err := ToRFC3597(rr)
+		if err != nil {
+			t.Fatalf("ToRFC3597(%s): %v", rr.String(), err)
+		}
+		if back, err := FromRFC3597(u); err != nil || back.String() != rr.String() {
+			t.Errorf("RFC 3597 round trip of %s gave %v, %v", rr.String(), back, err)
+		}
+	}
+
+	m, err := plan.Update()
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if m.Opcode != dns.OpcodeUpdate || m.Question[0].Name != "parent.example." {
+		t.Errorf("not an update for parent.example.: %s", m.String())
+	}
+	// 5 RRsets are replaced: two DSYNC owners, A+AAAA for notifications, A for ddns
+	if len(m.Ns) != 5+len(want) {
+		t.Errorf("got %d RRs in the update section, want %d:\n%s", len(m.Ns), 5+len(want), m.String())
+	}
+	for _, rr := range m.Ns[:5] {
+		if rr.Header().Class != dns.ClassANY {
+			t.Errorf("expected an RRset deletion, got %s", rr.String())
+		}
+	}
+
+	legacy := PublishPlan{Parent: "parent.example.", RRtype: "notify", Ttl: 600,
+		Endpoints: []PublishEndpoint{{Types: []string{"CDS"}, Schemes: []string{"1"}, Port: 5302, Target: "notifications"}}}
+	dsyncrrs, _, err = legacy.RRs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := dsyncrrs[0].String(); s != "parent.example.\t600\tIN\tNOTIFY\tCDS\t1 5302 notifications.parent.example." {
+		t.Errorf("legacy plan gave %q", s)
+	}
+}
+
+func TestPublishPlanErrors(t *testing.T) {
+	ep := PublishEndpoint{Types: []string{"CDS"}, Schemes: []string{"notify"}, Target: "notifications"}
+	tests := []struct {
+		name string
+		plan PublishPlan
+		edit func(ep *PublishEndpoint)
+	}{
+		{"no parent", PublishPlan{}, nil},
+		{"bad rrtype", PublishPlan{Parent: "parent.example.", RRtype: "TXT"}, nil},
+		{"no endpoints", PublishPlan{Parent: "parent.example."}, nil},
+		{"bad type", PublishPlan{Parent: "parent.example."}, func(ep *PublishEndpoint) { ep.Types = []string{"BOGUS"} }},
+		{"bad scheme", PublishPlan{Parent: "parent.example."}, func(ep *PublishEndpoint) { ep.Schemes = []string{"carrier-pigeon"} }},
+		{"no target", PublishPlan{Parent: "parent.example."}, func(ep *PublishEndpoint) { ep.Target = "" }},
+		{"bad address", PublishPlan{Parent: "parent.example."}, func(ep *PublishEndpoint) { ep.Addresses = []string{"256.1.1.1"} }},
+		{"out of zone owner", PublishPlan{Parent: "parent.example."}, func(ep *PublishEndpoint) { ep.Owner = "other.example." }},
+		{"out of zone address", PublishPlan{Parent: "parent.example."}, func(ep *PublishEndpoint) {
+			ep.Target = "scanner.operator.example."
+			ep.Addresses = []string{"192.0.2.1"}
+		}},
+	}
+
+	for _, tc := range tests {
+		if tc.edit != nil {
+			e := ep
+			tc.edit(&e)
+			tc.plan.Endpoints = []PublishEndpoint{e}
+		} else if tc.name == "bad rrtype" {
+			tc.plan.Endpoints = []PublishEndpoint{ep}
+		}
+		if _, _, err := tc.plan.RRs(); err == nil {
+			t.Errorf("%s: RRs() did not fail", tc.name)
+		}
+	}
+}
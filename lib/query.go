@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strings"
 
 	"github.com/miekg/dns"
 	"github.com/spf13/cobra"
@@ -24,12 +25,22 @@ var Global = Globals{
 	Debug:   false,
 }
 
-var Zonename string
+var Zonename, Childname string
 
 var QueryCmd = &cobra.Command{
 	Use:   "query",
-	Short: "Send a DNS query for 'zone. NOTIFY' and present the result.",
+	Short: "Send a DNS query for 'zone. DSYNC' (or the legacy 'zone. NOTIFY') and present the result.",
+	Long: `Send a DNS query for 'zone. DSYNC' (or the legacy 'zone. NOTIFY') and present the result.
+
+With --child the DSYNC RRset that applies to that child is looked up instead: first at
+the child specific name '<child labels>._dsync.<parent>', then at '_dsync.<parent>' and
+last at the parent apex. The parent zone is given by --zone or located via the IMR.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		if Childname != "" {
+			ChildQuery(dns.Fqdn(Childname), Zonename, Global.IMR)
+			return
+		}
+
 		Zonename = dns.Fqdn(Zonename)
 		rrs, err := NotifyQuery(Zonename, Global.IMR)
 		if err != nil {
@@ -37,7 +48,7 @@ var QueryCmd = &cobra.Command{
 		}
 
 		if len(rrs) == 0 {
-			fmt.Printf("No '%s NOTIFY' RR found\n", Zonename)
+			fmt.Printf("No '%s DSYNC' or '%s NOTIFY' RR found\n", Zonename, Zonename)
 		} else {
 			for _, nr := range rrs {
 				fmt.Printf("%s\n", nr.String())
@@ -48,61 +59,102 @@ var QueryCmd = &cobra.Command{
 
 func init() {
 	//	rootCmd.AddCommand(queryCmd)
-	QueryCmd.PersistentFlags().StringVarP(&Zonename, "zone", "z", "", "Zone to query for the NOTIFY RRset in")
+	QueryCmd.PersistentFlags().StringVarP(&Zonename, "zone", "z", "", "Zone to query for the DSYNC RRset in")
+	QueryCmd.PersistentFlags().StringVarP(&Childname, "child", "c", "", "Child zone to look up the applicable DSYNC RRset for")
 	QueryCmd.PersistentFlags().StringVarP(&Global.IMR, "imr", "i", "", "IMR to send the query to")
 }
 
+func ChildQuery(child, parent, imr string) {
+	var err error
+	if parent == "" {
+		parent, err = ParentZone(child, imr)
+		if err != nil {
+			log.Fatalf("Error locating the parent zone of %s: %v", child, err)
+		}
+		if Global.Verbose {
+			fmt.Printf("Parent zone of %s is %s\n", child, parent)
+		}
+	}
+
+	owner, rrs, err := LookupDSYNC(child, parent, imr)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	if len(rrs) == 0 {
+		fmt.Printf("No DSYNC RRset for child %s found in parent zone %s\n", child, dns.Fqdn(parent))
+		return
+	}
+	if Global.Verbose {
+		fmt.Printf("DSYNC RRset for child %s found at %s:\n", child, owner)
+	}
+	for _, nr := range rrs {
+		fmt.Printf("%s\n", nr.String())
+	}
+}
+
+// NotifyQuery looks up the DSYNC RRset for the zone. If there is none, the
+// legacy private NOTIFY RRset is looked up instead. Use DSYNCData() to get at
+// the rdata of either type.
 func NotifyQuery(z, imr string) ([]*dns.PrivateRR, error) {
+	prrs, err := dsyncQuery(z, imr, TypeDSYNC)
+	if err != nil {
+		log.Printf("NotifyQuery: Error looking up %s DSYNC: %v. Trying NOTIFY.", z, err)
+	}
+	if len(prrs) > 0 {
+		return prrs, nil
+	}
+
+	if Global.Debug {
+		fmt.Printf("No %s DSYNC RRset, looking for legacy NOTIFY RRset\n", z)
+	}
+	return dsyncQuery(z, imr, TypeNOTIFY)
+}
+
+// dsyncQuery queries for either the DSYNC or the NOTIFY RRset at the name.
+func dsyncQuery(z, imr string, rrtype uint16) ([]*dns.PrivateRR, error) {
 	m := new(dns.Msg)
-	m.SetQuestion(z, TypeNOTIFY)
+	m.SetQuestion(z, rrtype)
 
 	var prrs []*dns.PrivateRR
+	typestr := dns.TypeToString[rrtype]
 
 	if Global.Debug {
-		fmt.Printf("TypeNOTIFY=%d\n", TypeNOTIFY)
 		fmt.Printf("DEBUG: Sending to server %s query:\n%s\n", imr, m.String())
 	}
 
 	res, err := dns.Exchange(m, imr)
-
-	if err != nil && !Global.Debug {
-		log.Fatalf("Error from dns.Exchange(%s, NOTIFY): %v", z, err)
+	if err != nil {
+		return prrs, fmt.Errorf("error from dns.Exchange(%s, %s): %v", z, typestr, err)
 	}
 
 	if Global.Debug {
-		log.Printf("Response from dns.Exchange(%s, NOTIFY): %v", z, res.String())
+		log.Printf("Response from dns.Exchange(%s, %s): %v", z, typestr, res.String())
 	}
 
-	if res == nil {
-		return prrs, fmt.Errorf("Error: nil response to NOTIFY query")
+	// NXDOMAIN is the common answer for a child specific name without a DSYNC RRset
+	if res.Rcode == dns.RcodeNameError {
+		return prrs, nil
 	}
-
 	if res.Rcode != dns.RcodeSuccess {
-		log.Fatalf("Error: Query for %s NOTIFY received rcode: %s",
-			z, dns.RcodeToString[res.Rcode])
+		return prrs, fmt.Errorf("query for %s %s received rcode: %s",
+			z, typestr, dns.RcodeToString[res.Rcode])
 	}
 
-	if len(res.Answer) > 0 {
-		if Global.Debug {
-			fmt.Printf("Looking up %s NOTIFY RRset:\n", z)
-		}
-		for _, rr := range res.Answer {
+	for _, rr := range res.Answer {
+		if rr.Header().Rrtype == rrtype {
 			if prr, ok := rr.(*dns.PrivateRR); ok {
-				if Global.Debug {
-					fmt.Printf("%s\n", rr.String())
-				}
-
-				if _, ok := prr.Data.(*NOTIFY); ok {
+				if _, ok := DSYNCData(prr); ok {
+					if Global.Debug {
+						fmt.Printf("%s\n", rr.String())
+					}
 					prrs = append(prrs, prr)
-				} else {
-					log.Fatalf("Error: answer is not a NOTIFY RR: %s", rr.String())
+					continue
 				}
-			} else if _, ok = rr.(*dns.RRSIG); ok {
-				// ignore RRSIGs for the moment
-			} else {
-				log.Fatalf("Error: answer is not a NOTIFY RR: %s", rr.String())
 			}
+			return prrs, fmt.Errorf("answer is not a %s RR: %s", typestr, rr.String())
 		}
+		// ignore RRSIGs (and CNAMEs) for the moment
 	}
 	return prrs, nil
 }
@@ -200,6 +252,58 @@ func AuthQuery(qname, ns string, rrtype uint16) ([]dns.RR, error) {
 	return rrs, nil
 }
 
+// AuthQueryNG is like AuthQuery, but it returns errors instead of terminating
+// (which is needed by long-running processes like the receiver) and it sets
+// the DO bit and returns the RRSIGs covering the RRset separately.
+func AuthQueryNG(qname, ns string, rrtype uint16) ([]dns.RR, []*dns.RRSIG, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(qname, rrtype)
+	m.SetEdns0(4096, true)
+
+	if Global.Debug {
+		fmt.Printf("Sending query %s %s to nameserver %s\n", qname,
+			dns.TypeToString[rrtype], ns)
+	}
+
+	var rrs []dns.RR
+	var sigs []*dns.RRSIG
+
+	res, err := dns.Exchange(m, ns)
+	if err != nil {
+		return rrs, sigs, fmt.Errorf("Error from dns.Exchange(%s, %s, %s): %v",
+			qname, dns.TypeToString[rrtype], ns, err)
+	}
+
+	if res.Rcode != dns.RcodeSuccess {
+		return rrs, sigs, fmt.Errorf("Query for %s %s to %s received rcode: %s",
+			qname, dns.TypeToString[rrtype], ns, dns.RcodeToString[res.Rcode])
+	}
+
+	for _, section := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range section {
+			if !strings.EqualFold(rr.Header().Name, qname) {
+				continue
+			}
+			if rr.Header().Rrtype == rrtype {
+				rrs = append(rrs, rr)
+			} else if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == rrtype {
+				sigs = append(sigs, sig)
+			}
+		}
+		if len(rrs) > 0 { // found something
+			break
+		}
+	}
+
+	if Global.Debug {
+		for _, rr := range rrs {
+			fmt.Printf("%s\n", rr.String())
+		}
+	}
+
+	return rrs, sigs, nil
+}
+
 func RRsetDiffer(zone string, newrrs, oldrrs []dns.RR, rrtype uint16, lg *log.Logger) (bool, []dns.RR, []dns.RR) {
 	var match, rrsets_differ bool
 	typestr := dns.TypeToString[rrtype]
@@ -264,9 +368,9 @@ type DDNSTarget struct {
 }
 
 type DSYNCTarget struct {
-	Name      string
-	Addresses []string
-	Port      uint16
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses"`
+	Port      uint16   `json:"port"`
 }
 
 func LookupDDNSTarget(parentzone, parentprimary string) (DDNSTarget, error) {
@@ -279,93 +383,89 @@ func LookupDDNSTarget(parentzone, parentprimary string) (DDNSTarget, error) {
 		return ddnstarget, err
 	}
 
-	const update_scheme = 2
-
 	if Global.Debug {
-		fmt.Printf("Found %d NOTIFY RRs\n", len(prrs))
+		fmt.Printf("Found %d DSYNC RRs\n", len(prrs))
 	}
 
-	found := false
 	var dsync_rr *dns.PrivateRR
+	var dsync *DSYNC
 
 	for _, prr := range prrs {
-		if prr.Data.(*NOTIFY).Scheme == update_scheme {
-			found = true
-			dsync_rr = prr
+		if d, _ := DSYNCData(prr); d.Scheme == SchemeUpdate {
+			dsync_rr, dsync = prr, d
 			break
 		}
 	}
-	if !found {
+	if dsync == nil {
 		return ddnstarget, fmt.Errorf("No DDNS update destination found for for zone %s\n", parentzone)
 	}
 
-	dsync, _ := dsync_rr.Data.(*NOTIFY)
-
 	if Global.Verbose {
 		fmt.Printf("Looked up published DDNS update target for zone %s:\n\n%s\n\n",
 			parentzone, dsync_rr.String())
 	}
 
-	addrs, err = net.LookupHost(dsync.Dest)
+	addrs, err = net.LookupHost(dsync.Target)
 	if err != nil {
 		return ddnstarget, fmt.Errorf("Error: %v", err)
 	}
 
 	if Global.Verbose {
-		fmt.Printf("%s has the IP addresses: %v\n", dsync.Dest, addrs)
+		fmt.Printf("%s has the IP addresses: %v\n", dsync.Target, addrs)
 	}
 	ddnstarget.Port = dsync.Port
 	ddnstarget.Addresses = addrs
-	ddnstarget.Name = dsync.Dest
+	ddnstarget.Name = dsync.Target
 
 	return ddnstarget, nil
 }
 
-func LookupDSYNCTarget(parentzone, parentprimary string, dtype uint16, scheme uint8) (DSYNCTarget, error) {
+// LookupDSYNCTarget finds the target for the type and scheme in the DSYNC
+// RRset that applies to the child (see LookupDSYNC()) in the parent zone. With
+// an empty child only the RRset at the parent apex is used.
+func LookupDSYNCTarget(child, parentzone, parentprimary string, dtype uint16, scheme uint8) (DSYNCTarget, error) {
 	var addrs []string
 	var dsynctarget DSYNCTarget
 
-	prrs, err := NotifyQuery(parentzone, parentprimary)
+	_, prrs, err := LookupDSYNC(child, parentzone, parentprimary)
 	if err != nil {
 		return dsynctarget, err
 	}
 
 	if Global.Debug {
-		fmt.Printf("Found %d NOTIFY RRs\n", len(prrs))
+		fmt.Printf("Found %d DSYNC RRs\n", len(prrs))
 	}
 
-	found := false
-	var dsync *NOTIFY
+	var dsync_rr *dns.PrivateRR
+	var dsync *DSYNC
 
-	for _, rr := range prrs {
-		dsyncrr := rr.Data.(*NOTIFY)
-		if dsyncrr.Scheme == scheme && dsyncrr.Type == dtype {
-			found = true
-			dsync = dsyncrr
+	for _, prr := range prrs {
+		if d, _ := DSYNCData(prr); d.Scheme == scheme && d.Type == dtype {
+			dsync_rr, dsync = prr, d
 			break
 		}
 	}
-	if !found {
-		return dsynctarget, fmt.Errorf("No DSYNC type %s scheme %d destination found for for zone %s",
-			dns.TypeToString, scheme, parentzone)
+	if dsync == nil {
+		return dsynctarget, fmt.Errorf("No DSYNC type %s scheme %s destination found for for zone %s",
+			dns.TypeToString[dtype], SchemeString(scheme), parentzone)
 	}
 
 	if Global.Verbose {
-		fmt.Printf("Looked up published DSYNC update target for zone %s:\n\n%s\tIN\tNOTIFY\t%s\n\n",
-			parentzone, parentzone, dsync.String())
+		fmt.Printf("Looked up published DSYNC target for zone %s:\n\n%s\n\n",
+			parentzone, dsync_rr.String())
 	}
 
-	addrs, err = net.LookupHost(dsync.Dest)
+	addrs, err = net.LookupHost(dsync.Target)
 	if err != nil {
 		return dsynctarget, fmt.Errorf("Error: %v", err)
 	}
 
 	if Global.Verbose {
-		fmt.Printf("%s has the IP addresses: %v\n", dsync.Dest, addrs)
+		fmt.Printf("%s has the IP addresses: %v\n", dsync.Target, addrs)
 	}
 	dsynctarget.Port = dsync.Port
 	dsynctarget.Addresses = addrs
-	dsynctarget.Name = dsync.Dest
+	dsynctarget.Name = dsync.Target
 
 	return dsynctarget, nil
 }
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -58,6 +59,8 @@ func sigLifetime(t time.Time) (uint32, uint32) {
 	return incep, expir
 }
 
+// SignMsgNG returns a copy of the message with a SIG(0) by the key appended to the
+// additional section.
 func SignMsgNG(m dns.Msg, name string, cs crypto.Signer, keyrr *dns.KEY) (dns.Msg, error) {
 
 	sigrr := new(dns.SIG)
@@ -72,29 +75,30 @@ func SignMsgNG(m dns.Msg, name string, cs crypto.Signer, keyrr *dns.KEY) (dns.Ms
 	sigrr.RRSIG.Inception, sigrr.RRSIG.Expiration = sigLifetime(time.Now())
 	sigrr.RRSIG.SignerName = name
 
-	fmt.Printf("SIG pre-signing: %v\n", sigrr.String())
-	fmt.Printf("Msg additional pre-signing: %d\n", len(m.Extra))
+	if Global.Debug {
+		fmt.Printf("SIG pre-signing: %v\n", sigrr.String())
+		fmt.Printf("Msg additional pre-signing: %d\n", len(m.Extra))
+	}
 
 	res, err := sigrr.Sign(cs, &m)
 	if err != nil {
-		log.Fatalf("Error from sig.Sign: %v", err)
+		return m, fmt.Errorf("error from sig.Sign: %v", err)
 	}
-	// fmt.Printf("Res: %s\n", string(res))
-	fmt.Printf("len(signed msg): %d\n", len(res))
 	m.Extra = append(m.Extra, sigrr)
 
-	fmt.Printf("len(msg+sig): %d\n", m.Len())
-
-	fmt.Printf("Signed msg: %s\n", m.String())
-	// fmt.Printf("Completed SIG RR: %s\n", sigrr.String())
+	if Global.Debug {
+		fmt.Printf("len(signed msg): %d\n", len(res))
+		fmt.Printf("Signed msg: %s\n", m.String())
+	}
 
 	return m, nil
 }
 
+// ReadKey reads a key pair from BIND style key files. The filename may be either
+// the .key or the .private file, the other one is found from the basename.
 func ReadKey(filename string) (crypto.PrivateKey, crypto.Signer, dns.RR, string, error) {
-
 	if filename == "" {
-		log.Fatalf("Error: filename of key not specified")
+		return nil, nil, nil, "", fmt.Errorf("filename of key not specified")
 	}
 
 	var basename, pubfile, privfile string
@@ -108,125 +112,113 @@ func ReadKey(filename string) (crypto.PrivateKey, crypto.Signer, dns.RR, string,
 		privfile = filename
 		pubfile = basename + ".key"
 	} else {
-		log.Fatalf("Error: filename %s does not end in either .key or .private", filename)
-	}
-
-	file, err := os.Open(pubfile)
-	if err != nil {
-		log.Fatalf("Error opening public key file '%s': %v",
-			pubfile, err)
-	}
-	pubkeybytes, err := os.ReadFile(pubfile)
-	if err != nil {
-		log.Fatalf("Error reading public key file '%s': %v",
-			pubfile, err)
+		return nil, nil, nil, "", fmt.Errorf("filename %s does not end in either .key or .private", filename)
 	}
-	pubkey := string(pubkeybytes)
 
-	file, err = os.Open(privfile)
+	rr, err := ReadPubKeyFile(pubfile)
 	if err != nil {
-		log.Fatalf("Error opening private key file '%s': %v",
-			privfile, err)
+		return nil, nil, nil, "", err
 	}
 
-	rr, err := dns.NewRR(pubkey)
+	file, err := os.Open(privfile)
 	if err != nil {
-		log.Fatalf("Error reading public key '%s': %v",
-			pubkey, err)
+		return nil, nil, nil, "", fmt.Errorf("error opening private key file '%s': %v", privfile, err)
 	}
+	defer file.Close()
 
 	var k crypto.PrivateKey
-	var cs crypto.Signer
 	var ktype string
-	var alg uint8
 
-	// fmt.Printf("PubKey is a %s\n", dns.AlgorithmToString[rr.Algorithm])
+	var alg uint8
 
-	switch rr.(type) {
+	switch rrk := rr.(type) {
 	case *dns.DNSKEY:
-		rrk := rr.(*dns.DNSKEY)
-		k, err = rrk.ReadPrivateKey(file, "/allan/tar/kakan")
-		if err != nil {
-			log.Fatalf("Error reading private key file '%s': %v", filename, err)
-		}
+		k, err = rrk.ReadPrivateKey(file, privfile)
 		ktype = "DNSKEY"
 		alg = rrk.Algorithm
-		fmt.Printf("PubKey is a %s\n", dns.AlgorithmToString[rrk.Algorithm])
 	case *dns.KEY:
-		rrk := rr.(*dns.KEY)
-		k, err = rrk.ReadPrivateKey(file, "/allan/tar/kakan")
+		k, err = rrk.ReadPrivateKey(file, privfile)
 		ktype = "KEY"
 		alg = rrk.Algorithm
-		fmt.Printf("PubKey is a %s\n", dns.AlgorithmToString[rrk.Algorithm])
 	default:
-		log.Fatalf("Error: rr is of type %v", "foo")
+		return nil, nil, nil, "", fmt.Errorf("%s does not contain a KEY or DNSKEY but a %s",
+			pubfile, dns.TypeToString[rr.Header().Rrtype])
 	}
-
-	switch alg {
-	case dns.RSASHA256, dns.RSASHA512:
-		cs = k.(*rsa.PrivateKey)
-	case dns.ED25519:
-		cs = k.(*ed25519.PrivateKey)
-	case dns.ECDSAP256SHA256, dns.ECDSAP384SHA384:
-		cs = k.(*ecdsa.PrivateKey)
-	default:
-		log.Fatalf("Error: no support for algorithm %s yet", dns.AlgorithmToString[alg])
+	if err != nil {
+		return nil, nil, nil, "", fmt.Errorf("error reading private key file '%s': %v", privfile, err)
 	}
 
+	cs, err := PrivateKeyToSigner(k)
+	if err != nil {
+		return nil, nil, nil, "", fmt.Errorf("%s: %v", privfile, err)
+	}
+	if Global.Debug {
+		fmt.Printf("Read %s %s from %s\n", ktype, dns.AlgorithmToString[alg], pubfile)
+	}
 	return k, cs, rr, ktype, nil
 }
 
-func ReadPubKeys(keydir string) (map[string]dns.KEY, error) {
+// PrivateKeyToSigner returns the crypto.Signer for a private key as returned by
+// ReadPrivateKey and Generate in the dns package.
+func PrivateKeyToSigner(k crypto.PrivateKey) (crypto.Signer, error) {
+	switch pk := k.(type) {
+	case *rsa.PrivateKey:
+		return pk, nil
+	case ed25519.PrivateKey:
+		return pk, nil
+	case *ecdsa.PrivateKey:
+		return pk, nil
+	}
+	return nil, fmt.Errorf("no support for private key type %T yet", k)
+}
+
+// ReadPubKeyFile reads the KEY or DNSKEY in a BIND style .key file.
+func ReadPubKeyFile(pubfile string) (dns.RR, error) {
+	pubkeybytes, err := os.ReadFile(pubfile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading public key file '%s': %v", pubfile, err)
+	}
+
+	rr, err := dns.NewRR(string(pubkeybytes))
+	if err != nil {
+		return nil, fmt.Errorf("error reading public key from '%s': %v", pubfile, err)
+	}
+	if rr == nil {
+		return nil, fmt.Errorf("no public key in '%s'", pubfile)
+	}
+	return rr, nil
+}
 
-	var keymap = make(map[string]dns.KEY, 5)
+// ReadPubKeys reads all the public KEYs in the directory, indexed on owner name.
+// There may be multiple keys for the same owner, e.g. during a key rollover.
+func ReadPubKeys(keydir string) (map[string][]dns.KEY, error) {
+	var keymap = make(map[string][]dns.KEY, 5)
 
 	if keydir == "" {
-		log.Fatalf("Error: key directory not specified in YAML config")
+		return keymap, fmt.Errorf("key directory not specified")
 	}
 
 	entries, err := os.ReadDir(keydir)
 	if err != nil {
-		log.Fatalf("Error from os.ReadDir(%s): %v", keydir, err)
+		return keymap, fmt.Errorf("error from os.ReadDir(%s): %v", keydir, err)
 	}
 
 	for _, f := range entries {
 		fname := f.Name()
-		fmt.Println(fname)
-
-		if strings.HasSuffix(fname, ".key") {
-			// basename = strings.TrimSuffix(filename, ".key")
-			pubfile := keydir + "/" + fname
-			_, err := os.Open(pubfile)
-			if err != nil {
-				log.Fatalf("Error opening public key file '%s': %v",
-					pubfile, err)
-			}
-			pubkeybytes, err := os.ReadFile(pubfile)
-			if err != nil {
-				log.Fatalf("Error reading public key file '%s': %v",
-					pubfile, err)
-			}
-			pubkey := string(pubkeybytes)
-			rr, err := dns.NewRR(pubkey)
-			if err != nil {
-				log.Fatalf("Error reading public key '%s': %v",
-					pubkey, err)
-			}
-
-			switch rr.(type) {
-			case *dns.KEY:
-				rrk := rr.(*dns.KEY)
-				keymap[rr.Header().Name] = *rrk
-				//		k, err = rrk.ReadPrivateKey(file, "/allan/tar/kakan")
-				//		ktype = "KEY"
-				//		alg = rrk.Algorithm
-				//		fmt.Printf("PubKey is a %s\n", dns.AlgorithmToString[rrk.Algorithm])
-			default:
-				log.Fatalf("Error: rr is of type %v", "foo")
-			}
-
-		} else {
-			fmt.Printf("File %s is not a public key file. Ignored.\n", fname)
+		if !strings.HasSuffix(fname, ".key") {
+			continue
+		}
+
+		rr, err := ReadPubKeyFile(filepath.Join(keydir, fname))
+		if err != nil {
+			return keymap, err
+		}
+
+		switch rrk := rr.(type) {
+		case *dns.KEY:
+			keymap[rr.Header().Name] = append(keymap[rr.Header().Name], *rrk)
+		default:
+			log.Printf("ReadPubKeys: %s does not contain a KEY. Ignored.", fname)
 		}
 	}
 
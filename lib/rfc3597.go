@@ -4,33 +4,90 @@
 package lib
 
 import (
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"strings"
 
 	"github.com/miekg/dns"
 	"github.com/spf13/cobra"
 )
 
-var rrstr string
+var rrstr, rrzone, zonefile, origin string
+var reverse bool
 
 var ToRFC3597Cmd = &cobra.Command{
 	Use:   "rfc3597",
 	Short: "Generate the RFC 3597 representation of a DNS record",
+	Long: `Generate the RFC 3597 representation of a DNS record given with --record, or of
+the published DSYNC RRset (or legacy NOTIFY RRset) of the zone given with --zone.
+A record given in RFC 3597 form ("TYPE66 \# ...") is decoded. With --reverse only
+the normal presentation format is printed.
+
+With --zonefile every DSYNC and NOTIFY record in the master file is rewritten to
+RFC 3597 form (or, with --reverse, from RFC 3597 form) and the zone is printed on
+stdout. Note that the whole zone is re-serialised: $ORIGIN, $TTL and $INCLUDE are
+not kept, all names (also the DSYNC and NOTIFY targets) become absolute and every
+other record is printed on one line in normalised form (comments are kept). With -v the number of records that
+changed form is printed on stderr.`,
 	Run: func(cmd *cobra.Command, args []string) {
-	        if rrstr == "" {
-		   log.Fatalf("Record to generate RFC 3597 representation for not specified.")
-		}
-		
-		rr, err := dns.NewRR(rrstr)
-		if err != nil {
-			log.Fatal("Could not parse record \"%s\": %v", rrstr, err)
+		var rrs []dns.RR
+
+		switch {
+		case zonefile != "":
+			f, err := os.Open(zonefile)
+			if err != nil {
+				log.Fatalf("Error opening zone file: %v", err)
+			}
+			defer f.Close()
+			n, err := ConvertZonefile(f, zonefile, dns.Fqdn(origin), os.Stdout, reverse)
+			if err != nil {
+				log.Fatalf("Error converting zone file %s: %v", zonefile, err)
+			}
+			if Global.Verbose {
+				fmt.Fprintf(os.Stderr, "Converted %d records\n", n)
+			}
+			return
+
+		case rrzone != "":
+			prrs, err := NotifyQuery(dns.Fqdn(rrzone), Global.IMR)
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			if len(prrs) == 0 {
+				log.Fatalf("No '%s DSYNC' or '%s NOTIFY' RR found", rrzone, rrzone)
+			}
+			for _, prr := range prrs {
+				rrs = append(rrs, prr)
+			}
+
+		case rrstr != "":
+			rr, err := dns.NewRR(rrstr)
+			if err != nil {
+				log.Fatalf("Could not parse record \"%s\": %v", rrstr, err)
+			}
+			rrs = append(rrs, rr)
+
+		default:
+			log.Fatalf("Record to generate RFC 3597 representation for not specified.")
 		}
 
-		fmt.Printf("Normal   (len=%d): \"%s\"\n", dns.Len(rr), rr.String())
-		u := new(dns.RFC3597)
-		u.ToRFC3597(rr)
-		fmt.Printf("RFC 3597 (len=%d): \"%s\"\n", dns.Len(u), u.String())
+		for _, rr := range rrs {
+			rr, err := FromRFC3597(rr)
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			if reverse {
+				fmt.Printf("%s\n", rr.String())
+				continue
+			}
+			fmt.Printf("Normal   (len=%d): \"%s\"\n", dns.Len(rr), rr.String())
+			u := new(dns.RFC3597)
+			u.ToRFC3597(rr)
+			fmt.Printf("RFC 3597 (len=%d): \"%s\"\n", dns.Len(u), u.String())
+		}
 	},
 }
 
@@ -41,44 +98,227 @@ func init() {
 
 //	sendCmd.PersistentFlags().StringVarP(&zonename, "zone", "z", "", "Zone to send a parent notify for")
 	ToRFC3597Cmd.Flags().StringVarP(&rrstr, "record", "r", "", "Record to convert to RFC 3597 notation")
+	ToRFC3597Cmd.Flags().StringVarP(&rrzone, "zone", "z", "", "Zone to look up the DSYNC RRset to convert in")
+	ToRFC3597Cmd.Flags().StringVarP(&Global.IMR, "imr", "i", "", "IMR to send the query to")
+	ToRFC3597Cmd.Flags().StringVarP(&zonefile, "zonefile", "f", "", "Master file to convert all DSYNC and NOTIFY records in")
+	ToRFC3597Cmd.Flags().StringVarP(&origin, "origin", "o", ".", "Origin for relative names in the zone file")
+	ToRFC3597Cmd.Flags().BoolVarP(&reverse, "reverse", "R", false, "Convert from RFC 3597 form to the normal presentation format")
 }
 
-func ParentZone(z, imr string) string {
-	labels := strings.Split(z, ".")
-	var parent string
+// isDSYNCType is true for the types that the RFC 3597 conversion applies to.
+func isDSYNCType(rrtype uint16) bool {
+	return rrtype == TypeDSYNC || rrtype == TypeNOTIFY
+}
 
-	if len(labels) == 1 {
-		return z
-	} else if len(labels) > 1 {
-		upone := dns.Fqdn(strings.Join(labels[1:], "."))
+// ToRFC3597 returns DSYNC and NOTIFY RRs in RFC 3597 form. Other RRs are
+// returned unchanged.
+func ToRFC3597(rr dns.RR) (dns.RR, error) {
+	if _, ok := rr.(*dns.PrivateRR); !ok || !isDSYNCType(rr.Header().Rrtype) {
+		return rr, nil
+	}
+	u := new(dns.RFC3597)
+	if err := u.ToRFC3597(rr); err != nil {
+		return nil, fmt.Errorf("error converting %s to RFC 3597 form: %v", rr.String(), err)
+	}
+	return u, nil
+}
 
-		m := new(dns.Msg)
-		m.SetQuestion(upone, dns.TypeSOA)
-		m.SetEdns0(4096, true)
-		m.CheckingDisabled = true
+// FromRFC3597 decodes DSYNC and NOTIFY RRs in RFC 3597 form. Other RRs are
+// returned unchanged. The zone parser does this by itself once the types are
+// registered with RegisterNotifyRR(), but then the rdata is checked here.
+func FromRFC3597(rr dns.RR) (dns.RR, error) {
+	u, ok := rr.(*dns.RFC3597)
+	if !ok || !isDSYNCType(rr.Header().Rrtype) {
+		return rr, nil
+	}
 
-		r, err := dns.Exchange(m, imr)
+	rdata, err := hex.DecodeString(u.Rdata)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RFC 3597 rdata in %s: %v", u.String(), err)
+	}
+	prr := &dns.PrivateRR{Hdr: u.Hdr, Data: NewDSYNC()}
+	if u.Hdr.Rrtype == TypeNOTIFY {
+		prr.Data = NewNOTIFY()
+	}
+	if _, err := prr.Data.Unpack(rdata); err != nil {
+		return nil, fmt.Errorf("invalid %s rdata in %s: %v", dns.Type(u.Hdr.Rrtype).String(), u.String(), err)
+	}
+	prr.Hdr.Rdlength = 0
+	return prr, nil
+}
+
+// ConvertZonefile reads the master file from r and writes it to w with all the
+// DSYNC and NOTIFY records in RFC 3597 form, or with reverse set, in normal
+// presentation format. Relative targets of DSYNC and NOTIFY records are
+// qualified with the origin in effect. The number of records that changed form
+// is returned.
+//
+// The whole zone is re-serialised from the parsed records: $ORIGIN, $TTL and
+// $INCLUDE directives are not kept, all names are written as absolute names and
+// every record is written on one line in the normal presentation format of the
+// dns package (with an explicit TTL and class). Comments on the records are kept.
+func ConvertZonefile(r io.Reader, filename, origin string, w io.Writer, reverse bool) (int, error) {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	text, count := prepareZonefile(string(buf), dns.Fqdn(origin), reverse)
+	zp := dns.NewZoneParser(strings.NewReader(text), origin, filename)
+
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if reverse {
+			rr, err = FromRFC3597(rr)
+		} else {
+			rr, err = ToRFC3597(rr)
+		}
 		if err != nil {
-			return fmt.Sprintf("Error from dns.Exchange: %v\n", err)
-		}
-		if r != nil {
-			if len(r.Answer) != 0 {
-				parent = r.Answer[0].Header().Name
-				return parent
-			}
-			if len(r.Ns) > 0 {
-				for _, rr := range r.Ns {
-					if rr.Header().Rrtype == dns.TypeSOA {
-						parent = r.Ns[0].Header().Name
-						return parent
-					}
-				}
+			return count, err
+		}
+
+		line := rr.String()
+		if c := zp.Comment(); c != "" {
+			line += " " + c
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return count, err
+		}
+	}
+	return count, zp.Err()
+}
+
+// zoneToken is a token in a master file and where it is in the text.
+type zoneToken struct {
+	text       string
+	start, end int
+}
+
+// prepareZonefile makes the targets of the DSYNC and NOTIFY records in normal
+// presentation format absolute and counts the records that a conversion will
+// change the form of. The dns package does not pass the origin on to the rdata
+// parser of private types, so this is done in the text before parsing, keeping
+// track of $ORIGIN.
+func prepareZonefile(text, origin string, reverse bool) (string, int) {
+	type edit struct {
+		start, end int
+		name       string
+	}
+	var edits []edit
+	var count int
+
+	entry := func(tokens []zoneToken, blankowner bool) {
+		if len(tokens) == 0 {
+			return
+		}
+		if !blankowner && strings.HasPrefix(tokens[0].text, "$") {
+			if strings.EqualFold(tokens[0].text, "$ORIGIN") && len(tokens) > 1 {
+				origin = qualifyName(tokens[1].text, origin)
 			}
+			return
+		}
+		i := 0
+		if !blankowner {
+			i = 1 // the owner
+		}
+		// skip the TTL and the class, in any order
+		for ; i < len(tokens); i++ {
+			t := strings.ToUpper(tokens[i].text)
+			_, isclass := dns.StringToClass[t]
+			if !isclass && !strings.HasPrefix(t, "CLASS") && (t[0] < '0' || t[0] > '9') {
+				break
+			}
+		}
+		if i >= len(tokens) {
+			return
+		}
+		if rrtype, ok := parseType(tokens[i].text); !ok || !isDSYNCType(rrtype) {
+			return
+		}
+		rdata := tokens[i+1:]
+		generic := len(rdata) > 0 && rdata[0].text == `\#`
+		if generic == reverse {
+			count++
+		}
+		if !generic && len(rdata) == 4 && !dns.IsFqdn(rdata[3].text) {
+			edits = append(edits, edit{rdata[3].start, rdata[3].end, qualifyName(rdata[3].text, origin)})
+		}
+	}
 
-			log.Printf("ParentZone: ERROR: Failed to locate parent of '%s' via Answer and Authority. Now guessing.", z)
-			return upone
+	var tokens []zoneToken
+	var depth int
+	blankowner := false
+	tstart := -1
+	endtoken := func(i int) {
+		if tstart >= 0 {
+			tokens = append(tokens, zoneToken{text[tstart:i], tstart, i})
+			tstart = -1
 		}
 	}
-	log.Printf("ParentZone: had difficulties splitting zone '%s'\n", z)
-	return z
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text):
+			if tstart < 0 {
+				tstart = i
+			}
+			i++
+		case c == '"':
+			if tstart < 0 {
+				tstart = i
+			}
+			for i++; i < len(text) && text[i] != '"'; i++ {
+				if text[i] == '\\' {
+					i++
+				}
+			}
+		case c == ';':
+			endtoken(i)
+			for i+1 < len(text) && text[i+1] != '\n' {
+				i++
+			}
+		case c == '(' || c == ')':
+			endtoken(i)
+			if c == '(' {
+				depth++
+			} else if depth > 0 {
+				depth--
+			}
+		case c == '\n':
+			endtoken(i)
+			if depth == 0 {
+				entry(tokens, blankowner)
+				tokens = nil
+				blankowner = i+1 < len(text) && (text[i+1] == ' ' || text[i+1] == '\t')
+			}
+		case c == ' ' || c == '\t' || c == '\r':
+			endtoken(i)
+			if i == 0 {
+				blankowner = true
+			}
+		default:
+			if tstart < 0 {
+				tstart = i
+			}
+		}
+	}
+	endtoken(len(text))
+	entry(tokens, blankowner)
+
+	for i := len(edits) - 1; i >= 0; i-- {
+		e := edits[i]
+		text = text[:e.start] + e.name + text[e.end:]
+	}
+	return text, count
+}
+
+// qualifyName makes a name from a master file absolute.
+func qualifyName(name, origin string) string {
+	switch {
+	case name == "@":
+		return origin
+	case dns.IsFqdn(name):
+		return name
+	case origin == ".":
+		return name + "."
+	}
+	return name + "." + origin
 }
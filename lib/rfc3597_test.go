@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) Johan Stenstam, johani@johani.org
+ */
+
+package lib
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testZone = `$ORIGIN parent.example.
+$TTL 3600
+@	IN SOA ns hostmaster 1 3600 600 86400 300
+	IN NS ns
+	IN DSYNC CDS NOTIFY 5302 notifications.parent.example. ; the scanner
+	IN NOTIFY CSYNC 1 5302 notifications.parent.example.
+child._dsync IN DSYNC ANY UPDATE 53 ddns.parent.example.
+ns	IN A 192.0.2.1
+`
+
+func TestConvertZonefile(t *testing.T) {
+	var generic bytes.Buffer
+	n, err := ConvertZonefile(strings.NewReader(testZone), "test", "parent.example.", &generic, false)
+	if err != nil {
+		t.Fatalf("ConvertZonefile: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("converted %d records, want 3", n)
+	}
+	out := generic.String()
+	for _, want := range []string{
+		"parent.example.\t3600\tCLASS1\tTYPE66\t\\# 35 003b0114b60d6e6f74696669636174696f6e7306706172656e74076578616d706c6500 ; the scanner",
+		"parent.example.\t3600\tCLASS1\tTYPE3994\t\\# ",
+		"child._dsync.parent.example.\t3600\tCLASS1\tTYPE66\t\\# ",
+		"ns.parent.example.\t3600\tIN\tA\t192.0.2.1",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("converted zone lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "\tDSYNC\t") || strings.Contains(out, "\tNOTIFY\t") {
+		t.Errorf("converted zone still has DSYNC or NOTIFY records:\n%s", out)
+	}
+	// the zone is re-serialised without the directives
+	if strings.Contains(out, "$ORIGIN") || strings.Contains(out, "$TTL") {
+		t.Errorf("converted zone still has directives:\n%s", out)
+	}
+
+	var normal bytes.Buffer
+	n, err = ConvertZonefile(strings.NewReader(out), "generic", ".", &normal, true)
+	if err != nil {
+		t.Fatalf("ConvertZonefile --reverse: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("reversed %d records, want 3", n)
+	}
+	for _, want := range []string{
+		"parent.example.\t3600\tIN\tDSYNC\tCDS\tNOTIFY 5302 notifications.parent.example. ; the scanner",
+		"parent.example.\t3600\tIN\tNOTIFY\tCSYNC\t1 5302 notifications.parent.example.",
+		"child._dsync.parent.example.\t3600\tIN\tDSYNC\tANY\tUPDATE 53 ddns.parent.example.",
+	} {
+		if !strings.Contains(normal.String(), want) {
+			t.Errorf("reversed zone lacks %q:\n%s", want, normal.String())
+		}
+	}
+
+	// only the records that change form are counted
+	mixed := "parent.example. 3600 IN DSYNC CDS NOTIFY 5302 notifications.parent.example.\n" +
+		"child._dsync.parent.example. 3600 IN TYPE66 \\# 26 00ff0200350464646e7306706172656e74076578616d706c6500\n"
+	for _, reverse := range []bool{false, true} {
+		var conv bytes.Buffer
+		n, err := ConvertZonefile(strings.NewReader(mixed), "mixed", ".", &conv, reverse)
+		if err != nil {
+			t.Fatalf("ConvertZonefile of a mixed zone (reverse %v): %v", reverse, err)
+		}
+		if n != 1 {
+			t.Errorf("converted %d records of a mixed zone (reverse %v), want 1", n, reverse)
+		}
+	}
+
+	bad := "parent.example. 3600 IN TYPE66 \\# 5 003b0114b6\n"
+	if _, err := ConvertZonefile(strings.NewReader(bad), "bad", ".", new(bytes.Buffer), true); err == nil {
+		t.Errorf("ConvertZonefile accepted truncated DSYNC rdata")
+	}
+
+	// relative targets are qualified with the origin in effect
+	relative := `@ 3600 IN DSYNC CDS NOTIFY 5302 notifications ; "quoted" (comment)
+$ORIGIN other.example.
+@ 3600 IN NOTIFY CSYNC 1 5302 @
+$ORIGIN sub
+child._dsync 3600 IN DSYNC ANY UPDATE 53 ( ddns
+	)
+	3600 IN TXT "a ; b" "DSYNC CDS NOTIFY 53 x"
+`
+	var qualified bytes.Buffer
+	n, err = ConvertZonefile(strings.NewReader(relative), "relative", "parent.example.", &qualified, true)
+	if err != nil {
+		t.Fatalf("ConvertZonefile with relative targets: %v", err)
+	}
+	if n != 0 {
+		t.Errorf("reversed %d records already in normal form, want 0", n)
+	}
+	for _, want := range []string{
+		"parent.example.\t3600\tIN\tDSYNC\tCDS\tNOTIFY 5302 notifications.parent.example. ;",
+		"other.example.\t3600\tIN\tNOTIFY\tCSYNC\t1 5302 other.example.",
+		"child._dsync.sub.other.example.\t3600\tIN\tDSYNC\tANY\tUPDATE 53 ddns.sub.other.example.",
+		"child._dsync.sub.other.example.\t3600\tIN\tTXT\t\"a ; b\" \"DSYNC CDS NOTIFY 53 x\"",
+	} {
+		if !strings.Contains(qualified.String(), want) {
+			t.Errorf("zone with relative targets lacks %q:\n%s", want, qualified.String())
+		}
+	}
+}
+
+func TestFromRFC3597(t *testing.T) {
+	rr, err := dns.NewRR("parent.example. 3600 IN DSYNC CDS NOTIFY 5302 notifications.parent.example.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := ToRFC3597(rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := u.(*dns.RFC3597); !ok {
+		t.Fatalf("ToRFC3597 returned a %T", u)
+	}
+	back, err := FromRFC3597(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.String() != rr.String() {
+		t.Errorf("got %q, want %q", back.String(), rr.String())
+	}
+
+	u.(*dns.RFC3597).Rdata = "003b0114b6"
+	if _, err := FromRFC3597(u); err == nil {
+		t.Errorf("FromRFC3597 accepted truncated rdata")
+	}
+
+	a, _ := dns.NewRR("ns.parent.example. 3600 IN A 192.0.2.1")
+	if got, _ := ToRFC3597(a); got != a {
+		t.Errorf("ToRFC3597 converted an A record")
+	}
+}
@@ -0,0 +1,61 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+package lib
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TsigFudge is the allowed clock skew (in seconds) for TSIG signatures.
+const TsigFudge = 300
+
+// TsigKey is a TSIG key. Only HMAC-SHA256 and HMAC-SHA512 are supported.
+type TsigKey struct {
+	Name      string
+	Algorithm string
+	Secret    string // base64
+}
+
+// NewTsigKey checks the key and returns it with the name and the algorithm in
+// the form the dns package wants them. The default algorithm is HMAC-SHA256.
+func NewTsigKey(name, algorithm, secret string) (*TsigKey, error) {
+	if name == "" {
+		return nil, fmt.Errorf("TSIG key name not specified")
+	}
+	name = dns.CanonicalName(name)
+
+	var alg string
+	switch dns.Fqdn(strings.ToLower(algorithm)) {
+	case dns.HmacSHA256, ".":
+		alg = dns.HmacSHA256
+	case dns.HmacSHA512:
+		alg = dns.HmacSHA512
+	default:
+		return nil, fmt.Errorf("TSIG key %s: unsupported algorithm \"%s\"", name, algorithm)
+	}
+
+	if secret == "" {
+		return nil, fmt.Errorf("TSIG key %s has no secret", name)
+	}
+	if _, err := base64.StdEncoding.DecodeString(secret); err != nil {
+		return nil, fmt.Errorf("TSIG key %s: secret is not valid base64: %v", name, err)
+	}
+	return &TsigKey{Name: name, Algorithm: alg, Secret: secret}, nil
+}
+
+// Secrets returns the key in the form used for dns.Client.TsigSecret.
+func (k *TsigKey) Secrets() map[string]string {
+	return map[string]string{k.Name: k.Secret}
+}
+
+// Sign adds a TSIG RR to the message. The MAC is computed when the message is
+// sent by a dns.Client (or written by a dns.Server) that knows the secret.
+func (k *TsigKey) Sign(m *dns.Msg) {
+	m.SetTsig(k.Name, k.Algorithm, TsigFudge, time.Now().Unix())
+}
@@ -0,0 +1,116 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+package lib
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// KeyTiming is the key timing metadata written to the key files, like
+// dnssec-keygen does. Zero times are not written.
+type KeyTiming struct {
+	Created  time.Time
+	Publish  time.Time
+	Activate time.Time
+}
+
+// GenerateKey generates a new SIG(0) KEY for the owner. The bits are only used
+// for RSA, the other algorithms have a fixed key size.
+func GenerateKey(owner string, alg uint8, bits int) (*dns.KEY, crypto.PrivateKey, error) {
+	switch alg {
+	case dns.ECDSAP256SHA256, dns.ED25519:
+		bits = 256
+	case dns.ECDSAP384SHA384:
+		bits = 384
+	case dns.RSASHA256, dns.RSASHA512:
+		if bits == 0 {
+			bits = 2048
+		}
+	default:
+		return nil, nil, fmt.Errorf("no support for algorithm %s yet", dns.AlgorithmToString[alg])
+	}
+
+	keyrr := new(dns.KEY)
+	keyrr.Hdr = dns.RR_Header{Name: dns.Fqdn(owner), Rrtype: dns.TypeKEY, Class: dns.ClassINET, Ttl: 3600}
+	keyrr.Flags = 256
+	keyrr.Protocol = 3
+	keyrr.Algorithm = alg
+	privkey, err := keyrr.Generate(bits)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error generating %s key: %v", dns.AlgorithmToString[alg], err)
+	}
+	return keyrr, privkey, nil
+}
+
+// KeyBasename returns the BIND style basename for the key: K<name>+<alg>+<keyid>.
+func KeyBasename(keyrr *dns.KEY) string {
+	return fmt.Sprintf("K%s+%03d+%05d", keyrr.Header().Name, keyrr.Algorithm, keyrr.KeyTag())
+}
+
+// WriteKeyFiles writes the key pair to a .key and a .private file in the
+// directory, in the same format as dnssec-keygen, so that it can be read back
+// with ReadKey. The .private file is only readable by the owner. Existing files
+// are never overwritten. Returns the name of the .key file.
+func WriteKeyFiles(keydir string, keyrr *dns.KEY, privkey crypto.PrivateKey, timing KeyTiming) (string, error) {
+	if keydir == "" {
+		keydir = "."
+	}
+	basename := filepath.Join(keydir, KeyBasename(keyrr))
+
+	privstr := keyrr.PrivateKeyString(privkey)
+	if privstr == "" {
+		return "", fmt.Errorf("unable to encode private key for %s", keyrr.Header().Name)
+	}
+
+	var meta, comments strings.Builder
+	for _, t := range []struct {
+		name string
+		when time.Time
+	}{
+		{"Created", timing.Created},
+		{"Publish", timing.Publish},
+		{"Activate", timing.Activate},
+	} {
+		if t.when.IsZero() {
+			continue
+		}
+		ts := t.when.UTC().Format("20060102150405")
+		fmt.Fprintf(&meta, "%s: %s\n", t.name, ts)
+		fmt.Fprintf(&comments, "; %s: %s (%s)\n", t.name, ts, t.when.UTC().Format(time.ANSIC))
+	}
+
+	// write the private key first, so that there is never a .key without it
+	err := writeNewFile(basename+".private", privstr+meta.String(), 0600)
+	if err != nil {
+		return "", fmt.Errorf("error writing private key: %v", err)
+	}
+
+	pubstr := fmt.Sprintf("; This is a key, keyid %d, for %s\n%s%s\n", keyrr.KeyTag(),
+		keyrr.Header().Name, comments.String(), keyrr.String())
+	err = writeNewFile(basename+".key", pubstr, 0644)
+	if err != nil {
+		os.Remove(basename + ".private")
+		return "", fmt.Errorf("error writing public key: %v", err)
+	}
+	return basename + ".key", nil
+}
+
+func writeNewFile(filename, data string, perm os.FileMode) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,79 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+package lib
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestWriteKeyFilesRoundTrip(t *testing.T) {
+	now := time.Now()
+	timing := KeyTiming{Created: now, Publish: now, Activate: now.Add(time.Hour)}
+
+	for _, alg := range []uint8{dns.ED25519, dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.RSASHA256} {
+		algstr := dns.AlgorithmToString[alg]
+		keydir := t.TempDir()
+
+		keyrr, privkey, err := GenerateKey("child.parent.example.", alg, 0)
+		if err != nil {
+			t.Fatalf("%s: GenerateKey: %v", algstr, err)
+		}
+		keyfile, err := WriteKeyFiles(keydir, keyrr, privkey, timing)
+		if err != nil {
+			t.Fatalf("%s: WriteKeyFiles: %v", algstr, err)
+		}
+		if !strings.HasSuffix(keyfile, KeyBasename(keyrr)+".key") {
+			t.Errorf("%s: unexpected key file name %s", algstr, keyfile)
+		}
+
+		privfile := strings.TrimSuffix(keyfile, ".key") + ".private"
+		fi, err := os.Stat(privfile)
+		if err != nil {
+			t.Fatalf("%s: %v", algstr, err)
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("%s: private key file has mode %v", algstr, fi.Mode().Perm())
+		}
+		buf, _ := os.ReadFile(privfile)
+		for _, tag := range []string{"Created: ", "Publish: ", "Activate: "} {
+			if !strings.Contains(string(buf), tag) {
+				t.Errorf("%s: private key file has no %s", algstr, tag)
+			}
+		}
+
+		_, cs, rr, ktype, err := ReadKey(keyfile)
+		if err != nil {
+			t.Fatalf("%s: ReadKey: %v", algstr, err)
+		}
+		if ktype != "KEY" || !dns.IsDuplicate(rr, keyrr) {
+			t.Fatalf("%s: read back %s %s, want %s", algstr, ktype, rr.String(), keyrr.String())
+		}
+
+		m := new(dns.Msg)
+		m.SetUpdate("parent.example.")
+		m.Insert([]dns.RR{keyrr})
+		signed, err := SignMsgNG(*m, keyrr.Header().Name, cs, rr.(*dns.KEY))
+		if err != nil {
+			t.Fatalf("%s: SignMsgNG: %v", algstr, err)
+		}
+		sig := signed.Extra[len(signed.Extra)-1].(*dns.SIG)
+		buf, err = signed.Pack()
+		if err != nil {
+			t.Fatalf("%s: Pack: %v", algstr, err)
+		}
+		if err := sig.Verify(keyrr, buf); err != nil {
+			t.Errorf("%s: signature by read back key does not verify: %v", algstr, err)
+		}
+
+		// the files must never be overwritten
+		if _, err := WriteKeyFiles(keydir, keyrr, privkey, timing); err == nil {
+			t.Errorf("%s: WriteKeyFiles overwrote existing key files", algstr)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) Johan Stenstam, johani@johani.org
+ */
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+var planfile string
+var rfc3597, sendupdate bool
+
+var publishPlanCmd = &cobra.Command{
+	Use:   "publish-plan",
+	Short: "Generate the DSYNC RRset and the target address records of a parent from a YAML plan",
+	Long: `Generate the complete DSYNC (or legacy NOTIFY) RRset of a parent zone, plus the
+address records of the notification targets, from a YAML description of the
+endpoints:
+
+parent:    parent.example.
+ttl:       3600
+rrtype:    DSYNC        # or NOTIFY
+owner:     _dsync       # default, relative to the parent
+endpoints:
+   - types:      [ CDS, CSYNC ]
+     schemes:    [ notify ]
+     port:       5302
+     target:     notifications
+     addresses:  [ 127.0.0.1, "::1" ]
+   - types:      [ ANY ]
+     schemes:    [ update ]
+     port:       53
+     target:     ddns.parent.example.
+     addresses:  [ 192.0.2.53 ]
+
+The records are printed in normal presentation format, or with --rfc3597 in
+RFC 3597 form. With --update they are instead sent as a DDNS update to the parent
+primary, replacing the existing RRsets.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if planfile == "" {
+			log.Fatalf("Error: publish plan not specified.")
+		}
+		plan, err := LoadPublishPlan(planfile)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		if sendupdate {
+			PublishUpdate(plan)
+			return
+		}
+
+		dsyncrrs, addrrrs, err := plan.RRs()
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		for _, rr := range append(dsyncrrs, addrrrs...) {
+			if rfc3597 {
+				rr, err = lib.ToRFC3597(rr)
+				if err != nil {
+					log.Fatalf("Error: %v", err)
+				}
+			}
+			fmt.Printf("%s\n", rr.String())
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(publishPlanCmd)
+
+	publishPlanCmd.Flags().StringVarP(&planfile, "plan", "f", "", "YAML file with the notification endpoints of the parent")
+	publishPlanCmd.Flags().BoolVarP(&rfc3597, "rfc3597", "", false, "Print the DSYNC or NOTIFY records in RFC 3597 form")
+	publishPlanCmd.Flags().BoolVarP(&sendupdate, "update", "u", false, "Send the records as a DDNS update to the parent primary")
+	publishPlanCmd.Flags().StringVarP(&parpri, "pprimary", "P", "", "Address:port of parent primary nameserver")
+	publishPlanCmd.Flags().StringVarP(&keyfile, "keyfile", "k", "", "SIG(0) sign the update with the key in this file")
+	publishPlanCmd.Flags().StringVarP(&tsigname, "tsig-name", "", "", "TSIG sign the update with this key")
+	publishPlanCmd.Flags().StringVarP(&tsigalg, "tsig-alg", "", "hmac-sha256", "TSIG algorithm (hmac-sha256 or hmac-sha512)")
+	publishPlanCmd.Flags().StringVarP(&tsigsecret, "tsig-secret", "", "", "TSIG secret (base64)")
+}
+
+func LoadPublishPlan(file string) (*lib.PublishPlan, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("error reading publish plan %s: %v", file, err)
+	}
+
+	var plan lib.PublishPlan
+	if err := v.Unmarshal(&plan); err != nil {
+		return nil, fmt.Errorf("error parsing publish plan %s: %v", file, err)
+	}
+	return &plan, nil
+}
+
+func PublishUpdate(plan *lib.PublishPlan) {
+	if parpri == "" {
+		log.Fatalf("Error: parent primary nameserver not specified.")
+	}
+
+	m, err := plan.Update()
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	signer, err := NewNotifySigner()
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	signername := m.Question[0].Name
+	if signer != nil && signer.Sig0Key != nil {
+		signername = signer.Sig0Key.Header().Name
+	}
+	m, c, err := signer.Sign(m, signername)
+	if err != nil {
+		log.Fatalf("Error signing the update: %v", err)
+	}
+
+	if lib.Global.Debug {
+		fmt.Printf("Sending Update:\n%s\n", m.String())
+	}
+
+	res, _, err := c.Exchange(m, parpri)
+	if err != nil {
+		log.Fatalf("Error from Exchange(%s, UPDATE): %v", parpri, err)
+	}
+	if res.Rcode != dns.RcodeSuccess {
+		log.Fatalf("Error: update of %s sent to %s got rcode %s back",
+			m.Question[0].Name, parpri, dns.RcodeToString[res.Rcode])
+	}
+	if lib.Global.Verbose {
+		fmt.Printf("Update of %s sent to %s got rcode NOERROR back (good)\n", m.Question[0].Name, parpri)
+	}
+}
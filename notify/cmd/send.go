@@ -4,6 +4,7 @@
 package cmd
 
 import (
+	"crypto"
 	"fmt"
 	"log"
 	"net"
@@ -63,12 +64,72 @@ func init() {
 	sendCmd.PersistentFlags().StringVarP(&pzone, "pzone", "Z", "", "Parent zone to sync via DDNS")
 	sendCmd.PersistentFlags().StringVarP(&childpri, "primary", "p", "", "Address:port of child primary namserver")
 	sendCmd.PersistentFlags().StringVarP(&parpri, "pprimary", "P", "", "Address:port of parent primary nameserver")
+	sendCmd.PersistentFlags().StringVarP(&keyfile, "keyfile", "k", "", "SIG(0) sign the NOTIFY with the key in this file")
+	sendCmd.PersistentFlags().StringVarP(&tsigname, "tsig-name", "", "", "TSIG sign the NOTIFY with this key")
+	sendCmd.PersistentFlags().StringVarP(&tsigalg, "tsig-alg", "", "hmac-sha256", "TSIG algorithm (hmac-sha256 or hmac-sha512)")
+	sendCmd.PersistentFlags().StringVarP(&tsigsecret, "tsig-secret", "", "", "TSIG secret (base64)")
 }
 
 var pzone, childpri, parpri string
+var keyfile, tsigname, tsigalg, tsigsecret string
+
+// NotifySigner signs NOTIFY messages with the child's SIG(0) key or with a TSIG
+// key, so that the receiver can tell them from unauthenticated notifications.
+// It also signs the updates sent by publish-plan.
+type NotifySigner struct {
+	Sig0Key    *dns.KEY
+	Sig0Signer crypto.Signer
+	TsigKey    *lib.TsigKey
+}
+
+// NewNotifySigner returns nil if neither a SIG(0) key nor a TSIG key is specified.
+func NewNotifySigner() (*NotifySigner, error) {
+	var ns NotifySigner
+	switch {
+	case keyfile != "" && tsigname != "":
+		return nil, fmt.Errorf("both a SIG(0) key and a TSIG key specified, choose one")
+	case keyfile != "":
+		_, cs, rr, ktype, err := lib.ReadKey(keyfile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading key '%s': %v", keyfile, err)
+		}
+		if ktype != "KEY" {
+			return nil, fmt.Errorf("key in %s must be a KEY RR", keyfile)
+		}
+		ns.Sig0Key, ns.Sig0Signer = rr.(*dns.KEY), cs
+	case tsigname != "":
+		tsigkey, err := lib.NewTsigKey(tsigname, tsigalg, tsigsecret)
+		if err != nil {
+			return nil, err
+		}
+		ns.TsigKey = tsigkey
+	default:
+		return nil, nil
+	}
+	return &ns, nil
+}
+
+// Sign signs the message and returns it together with the client to send it
+// with. A TSIG signature is computed by the client when the message is sent.
+func (ns *NotifySigner) Sign(m *dns.Msg, zonename string) (*dns.Msg, *dns.Client, error) {
+	c := new(dns.Client)
+	switch {
+	case ns == nil:
+	case ns.Sig0Key != nil:
+		signed, err := lib.SignMsgNG(*m, zonename, ns.Sig0Signer, ns.Sig0Key)
+		if err != nil {
+			return m, c, err
+		}
+		m = &signed
+	case ns.TsigKey != nil:
+		c.TsigSecret = ns.TsigKey.Secrets()
+		ns.TsigKey.Sign(m)
+	}
+	return m, c, nil
+}
 
 func SendNotify(zonename string, ntype string) {
-	var lookupzone, lookupserver string
+	var child, lookupzone, lookupserver string
 	if zonename == "." {
 		fmt.Printf("Error: zone name not specified. Terminating.\n")
 		os.Exit(1)
@@ -83,7 +144,6 @@ func SendNotify(zonename string, ntype string) {
 		lookupzone = zonename
 		lookupserver = childpri
 	default:
-		// lookupzone = lib.ParentZone(zonename, lib.Global.IMR)
 		if pzone == "" {
 			log.Fatalf("Error: parent zone name not specified.")
 		}
@@ -92,12 +152,17 @@ func SendNotify(zonename string, ntype string) {
 		if parpri == "" {
 			log.Fatalf("Error: parent primary nameserver not specified.")
 		}
+		child = zonename
 		lookupzone = pzone
 		lookupserver = parpri
 	}
 
-	const notify_scheme = 1
-	dsynctarget, err := lib.LookupDSYNCTarget(lookupzone, lookupserver, dns.StringToType[ntype], notify_scheme)
+	signer, err := NewNotifySigner()
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	dsynctarget, err := lib.LookupDSYNCTarget(child, lookupzone, lookupserver, dns.StringToType[ntype], lib.SchemeNotify)
 	if err != nil {
 	   log.Fatalf("Error from LookupDSYNCTarget(%s, %s): %v", lookupzone, lookupserver, err)
 	}
@@ -112,16 +177,21 @@ func SendNotify(zonename string, ntype string) {
 		m.SetNotify(zonename)
 
 		// remove SOA, add ntype
-		m.Question = []dns.Question{dns.Question{zonename, dns.StringToType[ntype], dns.ClassINET}}
+		m.Question = []dns.Question{{Name: zonename, Qtype: dns.StringToType[ntype], Qclass: dns.ClassINET}}
+
+		m, c, err := signer.Sign(m, zonename)
+		if err != nil {
+			log.Fatalf("Error signing NOTIFY(%s): %v", ntype, err)
+		}
 
 		if lib.Global.Debug {
 			fmt.Printf("Sending Notify:\n%s\n", m.String())
 		}
 
 		dst = net.JoinHostPort(dst, fmt.Sprintf("%d", dsynctarget.Port))
-		res, err := dns.Exchange(m, dst)
+		res, _, err := c.Exchange(m, dst)
 		if err != nil {
-			log.Fatalf("Error from dns.Exchange(%s, NOTIFY(%s)): %v", dst, ntype, err)
+			log.Fatalf("Error from Exchange(%s, NOTIFY(%s)): %v", dst, ntype, err)
 		}
 
 		if res.Rcode != dns.RcodeSuccess {
@@ -0,0 +1,132 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// BootstrapKey returns the KEY if the update is a key bootstrap request, i.e. an
+// update that only adds a KEY for the signer and that is signed by that same KEY.
+// Otherwise nil is returned.
+func BootstrapKey(zone string, r *dns.Msg) *dns.KEY {
+	if len(r.Ns) != 1 || len(r.Extra) == 0 {
+		return nil
+	}
+	key, ok := r.Ns[0].(*dns.KEY)
+	if !ok || key.Header().Class != dns.ClassINET {
+		return nil
+	}
+	sig, ok := r.Extra[len(r.Extra)-1].(*dns.SIG)
+	if !ok {
+		return nil
+	}
+
+	owner := dns.CanonicalName(key.Header().Name)
+	if owner != dns.CanonicalName(sig.RRSIG.SignerName) {
+		return nil
+	}
+	if owner == dns.CanonicalName(zone) || !dns.IsSubDomain(zone, owner) {
+		return nil
+	}
+	if key.KeyTag() != sig.RRSIG.KeyTag || key.Algorithm != sig.RRSIG.Algorithm {
+		return nil
+	}
+	return key
+}
+
+// BootstrapUpdate is the apply stage for an approved key bootstrap request: the
+// key is stored as pending in the KeyDB.
+func BootstrapUpdate(zone string, key *dns.KEY, ar ApprovalResult, kdb *KeyDB) UpdateResult {
+	result := UpdateResult{Rcode: int(ar.Rcode), UpstreamRcode: -1}
+	if !ar.Approved {
+		result.Error = fmt.Errorf("key bootstrap not approved: %s", ar.Reason)
+		return result
+	}
+
+	if err := kdb.AddKey(zone, key, KeyStatePending, "bootstrap upload"); err != nil {
+		result.Rcode = dns.RcodeServerFailure
+		result.Error = err
+		return result
+	}
+	log.Printf("DnsEngine: bootstrap KEY %d for %s stored as pending until verified",
+		key.KeyTag(), key.Header().Name)
+	return result
+}
+
+// KeyBootstrapScanner verifies pending child keys out of band: a pending key
+// becomes trusted once all the child nameservers publish it in the KEY RRset
+// at the child apex (and, if so configured, that KEY RRset validates).
+func (scanner *Scanner) KeyBootstrapScanner(zone string) {
+	zone = dns.Fqdn(zone)
+	pending, err := scanner.KeyDB.PendingKeys(scanner.ParentZone, zone)
+	if err != nil {
+		log.Printf("KeyBootstrapScanner: %s: %v", zone, err)
+		return
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	published, err := scanner.PublishedKeys(zone)
+	if err != nil {
+		log.Printf("KeyBootstrapScanner: %s: %v", zone, err)
+		return
+	}
+
+	for _, pkey := range pending {
+		found := false
+		for _, rr := range published {
+			if dns.IsDuplicate(rr, &pkey) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Printf("KeyBootstrapScanner: %s: pending key %d is not published in the child zone (yet)",
+				zone, pkey.KeyTag())
+			continue
+		}
+		err := scanner.KeyDB.SetKeyState(scanner.ParentZone, zone, pkey.KeyTag(), KeyStateTrusted)
+		if err != nil {
+			log.Printf("KeyBootstrapScanner: %s: %v", zone, err)
+			continue
+		}
+		log.Printf("KeyBootstrapScanner: %s: key %d verified via the child nameservers and is now trusted",
+			zone, pkey.KeyTag())
+	}
+}
+
+// PublishedKeys returns the KEY RRset at the child apex, as served by all the
+// child nameservers.
+func (scanner *Scanner) PublishedKeys(zone string) ([]dns.RR, error) {
+	nameservers, err := scanner.ChildNameservers(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, keysigs, err := scanner.QueryAllNS(zone, nameservers, dns.TypeKEY)
+	if err != nil {
+		return nil, err
+	}
+
+	if viper.GetBool("ddns.bootstrap.require-dnssec") {
+		dnskeys, err := scanner.ValidatedDNSKEYs(zone, nameservers)
+		if err != nil {
+			return nil, err
+		}
+		if len(dnskeys) == 0 {
+			return nil, fmt.Errorf("child zone is not signed, but bootstrap requires DNSSEC")
+		}
+		if err := VerifyRRset(keys, keysigs, dnskeys); err != nil {
+			return nil, fmt.Errorf("KEY RRset: %v", err)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,124 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"crypto"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+func testKey(t *testing.T, owner string) (*dns.KEY, crypto.Signer) {
+	t.Helper()
+	key := &dns.KEY{DNSKEY: dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: owner, Rrtype: dns.TypeKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     256,
+		Protocol:  3,
+		Algorithm: dns.ED25519,
+	}}
+	privkey, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := privkey.(crypto.Signer)
+	return key, cs
+}
+
+func TestBootstrapKey(t *testing.T) {
+	const zone = "parent.example."
+	const child = "child.parent.example."
+	key, cs := testKey(t, child)
+	otherkey, othercs := testKey(t, child)
+	siblingkey, siblingcs := testKey(t, "sibling.parent.example.")
+	apexkey, apexcs := testKey(t, zone)
+	outsidekey, outsidecs := testKey(t, "child.other.example.")
+	otheralg := twinKey(t, key, dns.ECDSAP256SHA256)
+
+	update := func(rrs ...dns.RR) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetUpdate(zone)
+		m.Ns = append(m.Ns, rrs...)
+		return m
+	}
+	sign := func(m *dns.Msg, cs crypto.Signer, key *dns.KEY) *dns.Msg {
+		signed, err := lib.SignMsgNG(*m, key.Header().Name, cs, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &signed
+	}
+	removal := dns.Copy(key).(*dns.KEY)
+	removal.Hdr.Class = dns.ClassNONE
+	removal.Hdr.Ttl = 0
+
+	tests := []struct {
+		name      string
+		msg       *dns.Msg
+		bootstrap bool
+	}{
+		{"KEY signed by itself", sign(update(key), cs, key), true},
+		{"unsigned", update(key), false},
+		{"more than the KEY", sign(update(key, mustRR(t, child+" 3600 IN NS ns1.example.net.")), cs, key), false},
+		{"not a KEY", sign(update(mustRR(t, child+" 3600 IN NS ns1.example.net.")), cs, key), false},
+		{"KEY removal", sign(update(removal), cs, key), false},
+		{"KEY signed by another key of the child", sign(update(key), othercs, otherkey), false},
+		{"KEY with the keytag of the signer, but another algorithm", sign(update(&otheralg), cs, key), false},
+		{"KEY for another child", sign(update(key), siblingcs, siblingkey), false},
+		{"KEY for the parent apex", sign(update(apexkey), apexcs, apexkey), false},
+		{"KEY outside the parent zone", sign(update(outsidekey), outsidecs, outsidekey), false},
+	}
+
+	for _, tt := range tests {
+		got := BootstrapKey(zone, tt.msg)
+		if (got != nil) != tt.bootstrap {
+			t.Errorf("%s: BootstrapKey returned %v, want bootstrap %v", tt.name, got, tt.bootstrap)
+		}
+	}
+}
+
+func TestBootstrapUpdate(t *testing.T) {
+	viper.Reset()
+	viper.Set("keydb.db", filepath.Join(t.TempDir(), "receiver.db"))
+	t.Cleanup(viper.Reset)
+	kdb := NewKeyDB(false)
+	t.Cleanup(func() { kdb.Close() })
+
+	const zone = "parent.example."
+	const child = "child.parent.example."
+	key, _ := testKey(t, child)
+
+	result := BootstrapUpdate(zone, key, ApprovalResult{Rcode: dns.RcodeRefused, Reason: "denied"}, kdb)
+	if result.Error == nil || result.Rcode != dns.RcodeRefused {
+		t.Errorf("unapproved bootstrap: rcode %s, error %v", dns.RcodeToString[result.Rcode], result.Error)
+	}
+	if pending, err := kdb.PendingKeys(zone, child); err != nil || len(pending) != 0 {
+		t.Errorf("unapproved bootstrap stored %d pending keys (%v)", len(pending), err)
+	}
+
+	result = BootstrapUpdate(zone, key, ApprovalResult{Approved: true, Rcode: dns.RcodeSuccess}, kdb)
+	if result.Error != nil || result.Rcode != dns.RcodeSuccess {
+		t.Fatalf("bootstrap: rcode %s, error %v", dns.RcodeToString[result.Rcode], result.Error)
+	}
+	pending, err := kdb.PendingKeys(zone, child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || !dns.IsDuplicate(&pending[0], key) {
+		t.Errorf("pending keys after the bootstrap are %v, want the bootstrapped key", pending)
+	}
+	// the key is not trusted until it has been verified out of band
+	keymap, err := kdb.KeyMap(zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keymap[child]) != 0 {
+		t.Errorf("bootstrapped key is trusted before it was verified")
+	}
+}
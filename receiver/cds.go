@@ -0,0 +1,244 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+// CdsScanner implements the parent side of RFC 7344 and RFC 8078: look up the
+// CDS and CDNSKEY RRsets in all the child nameservers, validate them against
+// the child DNSKEY RRset and queue the resulting DS changes for the updater.
+func (scanner *Scanner) CdsScanner(zone string) {
+	zone = dns.Fqdn(zone)
+	adds, removes, err := scanner.CheckCDS(zone)
+	if err != nil {
+		log.Printf("CdsScanner: %s: %v", zone, err)
+		return
+	}
+
+	if len(adds) == 0 && len(removes) == 0 {
+		log.Printf("CdsScanner: %s: DS RRset in parent is in sync with child CDS/CDNSKEY. No update needed.", zone)
+		return
+	}
+
+	for _, rr := range removes {
+		log.Printf("CdsScanner: %s: Remove DS: %s", zone, rr.String())
+	}
+	for _, rr := range adds {
+		log.Printf("CdsScanner: %s: Add DS: %s", zone, rr.String())
+	}
+	scanner.QueueUpdate(adds, removes)
+}
+
+// CheckCDS returns the DS RRs that should be added to and removed from the parent
+// to get in sync with what the child publishes as CDS and/or CDNSKEY.
+func (scanner *Scanner) CheckCDS(zone string) ([]dns.RR, []dns.RR, error) {
+	nameservers, err := scanner.ChildNameservers(zone)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cds, cdssigs, err := scanner.QueryAllNS(zone, nameservers, dns.TypeCDS)
+	if err != nil {
+		return nil, nil, err
+	}
+	cdnskey, cdnskeysigs, err := scanner.QueryAllNS(zone, nameservers, dns.TypeCDNSKEY)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(cds) == 0 && len(cdnskey) == 0 {
+		if scanner.Verbose {
+			log.Printf("CdsScanner: %s: no CDS or CDNSKEY published. Nothing to do.", zone)
+		}
+		return nil, nil, nil
+	}
+
+	dnskeys, dnskeysigs, err := scanner.QueryAllNS(zone, nameservers, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(dnskeys) == 0 {
+		return nil, nil, fmt.Errorf("child publishes CDS/CDNSKEY but no DNSKEY RRset")
+	}
+
+	curds, _, err := lib.AuthQueryNG(zone, scanner.ParentPrimary, dns.TypeDS)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The DNSKEY RRset must be signed by a key that is in the current DS RRset.
+	// If there is no DS RRset the delegation is insecure and we can only accept
+	// the CDS/CDNSKEY if explicitly configured to.
+	if len(curds) == 0 {
+		if !viper.GetBool("scanner.cds.insecure-bootstrap") {
+			return nil, nil, fmt.Errorf("delegation is unsigned and insecure CDS bootstrap is not allowed")
+		}
+		log.Printf("CdsScanner: %s: unsigned delegation, accepting CDS/CDNSKEY via insecure bootstrap", zone)
+		if err := VerifyRRset(dnskeys, dnskeysigs, dnskeys); err != nil {
+			return nil, nil, fmt.Errorf("DNSKEY RRset: %v", err)
+		}
+	} else {
+		if err := VerifyRRset(dnskeys, dnskeysigs, TrustedKeys(dnskeys, curds)); err != nil {
+			return nil, nil, fmt.Errorf("DNSKEY RRset is not signed by a key in the current DS RRset: %v", err)
+		}
+	}
+
+	if len(cds) > 0 {
+		if err := VerifyRRset(cds, cdssigs, dnskeys); err != nil {
+			return nil, nil, fmt.Errorf("CDS RRset: %v", err)
+		}
+	}
+	if len(cdnskey) > 0 {
+		if err := VerifyRRset(cdnskey, cdnskeysigs, dnskeys); err != nil {
+			return nil, nil, fmt.Errorf("CDNSKEY RRset: %v", err)
+		}
+	}
+
+	newds, err := CdsToDS(zone, cds, cdnskey, dnskeys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ttl uint32 = 3600
+	if len(curds) > 0 {
+		ttl = curds[0].Header().Ttl
+	}
+	for _, rr := range newds {
+		rr.Header().Ttl = ttl
+	}
+
+	_, adds, removes := lib.RRsetDiffer(zone, newds, curds, dns.TypeDS, log.Default())
+	return adds, removes, nil
+}
+
+// CdsToDS computes the DS RRset that the child is asking for. An RFC 8078 delete
+// request results in an empty DS RRset. Every resulting DS must correspond to a
+// key in the child DNSKEY RRset.
+func CdsToDS(zone string, cds, cdnskey, dnskeys []dns.RR) ([]dns.RR, error) {
+	var newds []dns.RR
+
+	cdsdelete, cdnskeydelete := false, false
+	for _, rr := range cds {
+		if lib.IsCdsDelete(rr.(*dns.CDS)) {
+			cdsdelete = true
+		}
+	}
+	for _, rr := range cdnskey {
+		if lib.IsCdnskeyDelete(rr.(*dns.CDNSKEY)) {
+			cdnskeydelete = true
+		}
+	}
+	if cdsdelete || cdnskeydelete {
+		if (cdsdelete && len(cds) != 1) || (cdnskeydelete && len(cdnskey) != 1) {
+			return newds, fmt.Errorf("DS delete request mixed with other CDS/CDNSKEY records")
+		}
+		if (len(cds) > 0 && !cdsdelete) || (len(cdnskey) > 0 && !cdnskeydelete) {
+			return newds, fmt.Errorf("CDS and CDNSKEY RRsets disagree about DS delete request")
+		}
+		log.Printf("CdsScanner: %s: child requests removal of all DS records (RFC 8078)", zone)
+		return newds, nil
+	}
+
+	for _, rr := range cds {
+		ds := rr.(*dns.CDS).DS
+		ds.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypeDS, Class: dns.ClassINET}
+		newds = append(newds, &ds)
+	}
+
+	for _, rr := range cdnskey {
+		key := rr.(*dns.CDNSKEY).DNSKEY
+		key.Hdr.Rrtype = dns.TypeDNSKEY
+		ds := key.ToDS(dns.SHA256)
+		if ds == nil {
+			return newds, fmt.Errorf("could not compute DS from CDNSKEY %s", rr.String())
+		}
+		if len(cds) == 0 {
+			ds.Hdr = dns.RR_Header{Name: zone, Rrtype: dns.TypeDS, Class: dns.ClassINET}
+			newds = append(newds, ds)
+			continue
+		}
+		// Both CDS and CDNSKEY are published, they must refer to the same keys.
+		found := false
+		for _, nds := range newds {
+			d := nds.(*dns.DS)
+			if d.KeyTag == ds.KeyTag && d.Algorithm == ds.Algorithm {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return newds, fmt.Errorf("CDNSKEY with keyid %d has no corresponding CDS", ds.KeyTag)
+		}
+	}
+
+	for _, rr := range newds {
+		ds := rr.(*dns.DS)
+		if MatchingDNSKEY(ds, dnskeys) == nil {
+			return newds, fmt.Errorf("DS with keyid %d does not match any key in the DNSKEY RRset", ds.KeyTag)
+		}
+	}
+	return newds, nil
+}
+
+// MatchingDNSKEY returns the DNSKEY that the DS refers to, or nil.
+func MatchingDNSKEY(ds *dns.DS, dnskeys []dns.RR) *dns.DNSKEY {
+	for _, rr := range dnskeys {
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok || key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+			continue
+		}
+		if kds := key.ToDS(ds.DigestType); kds != nil && strings.EqualFold(kds.Digest, ds.Digest) {
+			return key
+		}
+	}
+	return nil
+}
+
+// TrustedKeys returns the DNSKEYs that are referred to by any of the DS records.
+func TrustedKeys(dnskeys, dsrrs []dns.RR) []dns.RR {
+	var keys []dns.RR
+	for _, rr := range dsrrs {
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			continue
+		}
+		if key := MatchingDNSKEY(ds, dnskeys); key != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// VerifyRRset requires that at least one of the RRSIGs is a currently valid
+// signature over the RRset made by one of the keys.
+func VerifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, keys []dns.RR) error {
+	if len(sigs) == 0 {
+		return fmt.Errorf("RRset is not signed")
+	}
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(time.Now()) {
+			continue
+		}
+		for _, rr := range keys {
+			key, ok := rr.(*dns.DNSKEY)
+			if !ok || key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if err := sig.Verify(key, rrset); err == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no valid RRSIG by a trusted key found")
+}
@@ -0,0 +1,96 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("dns.NewRR(%q): %v", s, err)
+	}
+	return rr
+}
+
+func TestCdsToDS(t *testing.T) {
+	zone := "child.parent.example."
+	keys := make([]*dns.DNSKEY, 3)
+	for i := range keys {
+		buf := make([]byte, 64)
+		for j := range buf {
+			buf[j] = byte(i) + byte(j)
+		}
+		keys[i] = mustRR(t, fmt.Sprintf("%s 3600 IN DNSKEY 257 3 13 %s", zone,
+			base64.StdEncoding.EncodeToString(buf))).(*dns.DNSKEY)
+	}
+	dnskeys := []dns.RR{keys[0], keys[1]} // keys[2] is not in the child DNSKEY RRset
+
+	cds := func(key *dns.DNSKEY) dns.RR {
+		ds := key.ToDS(dns.SHA256)
+		return mustRR(t, fmt.Sprintf("%s 3600 IN CDS %d %d %d %s", zone, ds.KeyTag, ds.Algorithm,
+			ds.DigestType, strings.ToUpper(ds.Digest)))
+	}
+	cdnskey := func(key *dns.DNSKEY) dns.RR {
+		return mustRR(t, strings.Replace(key.String(), "DNSKEY", "CDNSKEY", 1))
+	}
+	badcds := mustRR(t, fmt.Sprintf("%s 3600 IN CDS %d 13 2 %s", zone, keys[0].KeyTag(), strings.Repeat("00", 32)))
+	cdsdelete := mustRR(t, zone+" 3600 IN CDS 0 0 0 00")
+	cdnskeydelete := mustRR(t, zone+" 3600 IN CDNSKEY 0 3 0 AA==")
+
+	tests := []struct {
+		name         string
+		cds, cdnskey []dns.RR
+		keytags      []uint16
+		err          bool
+	}{
+		{"CDS", []dns.RR{cds(keys[0])}, nil, []uint16{keys[0].KeyTag()}, false},
+		{"CDNSKEY", nil, []dns.RR{cdnskey(keys[0]), cdnskey(keys[1])},
+			[]uint16{keys[0].KeyTag(), keys[1].KeyTag()}, false},
+		{"CDS and CDNSKEY agree", []dns.RR{cds(keys[0])}, []dns.RR{cdnskey(keys[0])},
+			[]uint16{keys[0].KeyTag()}, false},
+		{"CDS and CDNSKEY disagree", []dns.RR{cds(keys[0])}, []dns.RR{cdnskey(keys[1])}, nil, true},
+
+		{"CDS delete", []dns.RR{cdsdelete}, nil, nil, false},
+		{"CDNSKEY delete", nil, []dns.RR{cdnskeydelete}, nil, false},
+		{"CDS and CDNSKEY delete", []dns.RR{cdsdelete}, []dns.RR{cdnskeydelete}, nil, false},
+		{"CDS delete mixed with a CDS", []dns.RR{cdsdelete, cds(keys[0])}, nil, nil, true},
+		{"CDNSKEY delete mixed with a CDNSKEY", nil, []dns.RR{cdnskeydelete, cdnskey(keys[0])}, nil, true},
+		{"CDS delete but not CDNSKEY", []dns.RR{cdsdelete}, []dns.RR{cdnskey(keys[0])}, nil, true},
+		{"CDNSKEY delete but not CDS", []dns.RR{cds(keys[0])}, []dns.RR{cdnskeydelete}, nil, true},
+
+		{"CDS for a key not in the DNSKEY RRset", []dns.RR{cds(keys[0]), cds(keys[2])}, nil, nil, true},
+		{"CDNSKEY for a key not in the DNSKEY RRset", nil, []dns.RR{cdnskey(keys[2])}, nil, true},
+		{"CDS with the wrong digest", []dns.RR{badcds}, nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		newds, err := CdsToDS(zone, tt.cds, tt.cdnskey, dnskeys)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: CdsToDS error %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+		if len(newds) != len(tt.keytags) {
+			t.Errorf("%s: %d DS records, want %d", tt.name, len(newds), len(tt.keytags))
+			continue
+		}
+		for i, rr := range newds {
+			ds, ok := rr.(*dns.DS)
+			if !ok || ds.Hdr.Name != zone || ds.Hdr.Rrtype != dns.TypeDS || ds.KeyTag != tt.keytags[i] {
+				t.Errorf("%s: DS %d is %s, want one for keyid %d", tt.name, i, rr.String(), tt.keytags[i])
+			}
+		}
+	}
+}
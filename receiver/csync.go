@@ -0,0 +1,238 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+// CSYNC flags, RFC 7477 section 2.1.1.2
+const (
+	CsyncImmediate  = 0x0001
+	CsyncSoaMinimum = 0x0002
+)
+
+// CsyncScanner implements the parent side of RFC 7477: look up the CSYNC record
+// in all the child nameservers and, for the types in its type bitmap, compare
+// the child data with the delegation and queue the resulting changes.
+func (scanner *Scanner) CsyncScanner(zone string) {
+	zone = dns.Fqdn(zone)
+	adds, removes, csync, err := scanner.CheckCSYNC(zone)
+	if err != nil {
+		log.Printf("CsyncScanner: %s: %v", zone, err)
+		return
+	}
+	if csync == nil {
+		return
+	}
+
+	if len(adds) == 0 && len(removes) == 0 {
+		log.Printf("CsyncScanner: %s: delegation is in sync with child. No update needed.", zone)
+		scanner.SetCsyncSerial(zone, csync.Serial)
+		return
+	}
+
+	for _, rr := range removes {
+		log.Printf("CsyncScanner: %s: Remove: %s", zone, rr.String())
+	}
+	for _, rr := range adds {
+		log.Printf("CsyncScanner: %s: Add: %s", zone, rr.String())
+	}
+
+	// RFC 7477 section 4.4: the CSYNC serial is only recorded as processed once
+	// the update has been applied, otherwise it is retried on the next scan.
+	result := scanner.SubmitUpdate(adds, removes)
+	if result.Rcode != dns.RcodeSuccess {
+		log.Printf("CsyncScanner: %s: update failed with rcode %s, will retry: %v",
+			zone, dns.RcodeToString[result.Rcode], result.Error)
+		return
+	}
+	scanner.SetCsyncSerial(zone, csync.Serial)
+}
+
+// CheckCSYNC returns the delegation RRs that should be added to and removed from
+// the parent according to the child CSYNC record, together with the CSYNC record
+// itself. The CSYNC record is nil if there is nothing to process.
+func (scanner *Scanner) CheckCSYNC(zone string) ([]dns.RR, []dns.RR, *dns.CSYNC, error) {
+	var adds, removes []dns.RR
+
+	nameservers, err := scanner.ChildNameservers(zone)
+	if err != nil {
+		return adds, removes, nil, err
+	}
+
+	csyncrrs, csyncsigs, err := scanner.QueryAllNS(zone, nameservers, dns.TypeCSYNC)
+	if err != nil {
+		return adds, removes, nil, err
+	}
+	if len(csyncrrs) == 0 {
+		if scanner.Verbose {
+			log.Printf("CsyncScanner: %s: no CSYNC published. Nothing to do.", zone)
+		}
+		return adds, removes, nil, nil
+	}
+	if len(csyncrrs) != 1 {
+		return adds, removes, nil, fmt.Errorf("CSYNC RRset contains %d records, must be exactly one", len(csyncrrs))
+	}
+	csync := csyncrrs[0].(*dns.CSYNC)
+
+	dnskeys, err := scanner.ValidatedDNSKEYs(zone, nameservers)
+	if err != nil {
+		return adds, removes, nil, err
+	}
+	if len(dnskeys) == 0 {
+		if !viper.GetBool("scanner.csync.allow-unsigned") {
+			return adds, removes, nil, fmt.Errorf("child zone is not signed and unsigned CSYNC is not allowed")
+		}
+	} else if err := VerifyRRset(csyncrrs, csyncsigs, dnskeys); err != nil {
+		return adds, removes, nil, fmt.Errorf("CSYNC RRset: %v", err)
+	}
+
+	if csync.Flags&CsyncImmediate == 0 {
+		return adds, removes, nil, fmt.Errorf("CSYNC immediate flag not set, out-of-band approval is required")
+	}
+
+	if last, ok := scanner.CsyncSerial(zone); ok && int32(csync.Serial-last) <= 0 {
+		if scanner.Verbose {
+			log.Printf("CsyncScanner: %s: CSYNC serial %d already processed (last: %d)",
+				zone, csync.Serial, last)
+		}
+		return adds, removes, nil, nil
+	}
+
+	soaserial, err := scanner.ChildSerial(zone, nameservers)
+	if err != nil {
+		return adds, removes, nil, err
+	}
+	if csync.Flags&CsyncSoaMinimum != 0 && int32(soaserial-csync.Serial) < 0 {
+		return adds, removes, nil, fmt.Errorf("child SOA serial %d is lower than CSYNC serial %d",
+			soaserial, csync.Serial)
+	}
+
+	types := map[uint16]bool{}
+	for _, t := range csync.TypeBitMap {
+		types[t] = true
+	}
+
+	nsrrs, _, err := scanner.QueryAllNS(zone, nameservers, dns.TypeNS)
+	if err != nil {
+		return adds, removes, nil, err
+	}
+	parentns, _, err := lib.AuthQueryNG(zone, scanner.ParentPrimary, dns.TypeNS)
+	if err != nil {
+		return adds, removes, nil, err
+	}
+
+	if types[dns.TypeNS] {
+		if len(nsrrs) == 0 {
+			return adds, removes, nil, fmt.Errorf("child has an empty NS RRset")
+		}
+		_, nsadds, nsremoves := lib.RRsetDiffer(zone, nsrrs, parentns, dns.TypeNS, log.Default())
+		adds = append(adds, nsadds...)
+		removes = append(removes, nsremoves...)
+
+		// Removing an in-bailiwick NS also means removing its glue.
+		for _, rr := range nsremoves {
+			ns := rr.(*dns.NS)
+			if !dns.IsSubDomain(zone, ns.Ns) {
+				continue
+			}
+			for _, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				glue, _, err := lib.AuthQueryNG(ns.Ns, scanner.ParentPrimary, t)
+				if err != nil {
+					return adds, removes, nil, err
+				}
+				removes = append(removes, glue...)
+			}
+		}
+	}
+
+	for _, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		if !types[t] {
+			continue
+		}
+		for _, rr := range nsrrs {
+			ns := rr.(*dns.NS)
+			if !dns.IsSubDomain(zone, ns.Ns) {
+				continue // only in-bailiwick nameservers have glue
+			}
+			childglue, _, err := scanner.QueryAllNS(ns.Ns, nameservers, t)
+			if err != nil {
+				return adds, removes, nil, err
+			}
+			parentglue, _, err := lib.AuthQueryNG(ns.Ns, scanner.ParentPrimary, t)
+			if err != nil {
+				return adds, removes, nil, err
+			}
+			_, glueadds, glueremoves := lib.RRsetDiffer(ns.Ns, childglue, parentglue, t, log.Default())
+			adds = append(adds, glueadds...)
+			removes = append(removes, glueremoves...)
+		}
+	}
+
+	// RFC 7477 section 4.4: the SOA serial must not have changed while the
+	// data was being collected.
+	if after, err := scanner.ChildSerial(zone, nameservers); err != nil {
+		return nil, nil, nil, err
+	} else if after != soaserial {
+		return nil, nil, nil, fmt.Errorf("child SOA serial changed from %d to %d during processing, will retry",
+			soaserial, after)
+	}
+
+	return adds, removes, csync, nil
+}
+
+// ChildSerial returns the SOA serial of the child zone, which must be the same
+// in all the nameservers.
+func (scanner *Scanner) ChildSerial(zone string, nameservers []string) (uint32, error) {
+	soarrs, _, err := scanner.QueryAllNS(zone, nameservers, dns.TypeSOA)
+	if err != nil {
+		return 0, err
+	}
+	if len(soarrs) != 1 {
+		return 0, fmt.Errorf("child zone has no SOA")
+	}
+	return soarrs[0].(*dns.SOA).Serial, nil
+}
+
+// ValidatedDNSKEYs returns the child DNSKEY RRset if it is signed by a key in the
+// current DS RRset in the parent. For an unsigned delegation no keys are returned.
+func (scanner *Scanner) ValidatedDNSKEYs(zone string, nameservers []string) ([]dns.RR, error) {
+	curds, _, err := lib.AuthQueryNG(zone, scanner.ParentPrimary, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	if len(curds) == 0 {
+		return nil, nil
+	}
+
+	dnskeys, dnskeysigs, err := scanner.QueryAllNS(zone, nameservers, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	if err := VerifyRRset(dnskeys, dnskeysigs, TrustedKeys(dnskeys, curds)); err != nil {
+		return nil, fmt.Errorf("DNSKEY RRset is not signed by a key in the current DS RRset: %v", err)
+	}
+	return dnskeys, nil
+}
+
+func (scanner *Scanner) CsyncSerial(zone string) (uint32, bool) {
+	scanner.mu.Lock()
+	defer scanner.mu.Unlock()
+	serial, ok := scanner.CsyncSerials[zone]
+	return serial, ok
+}
+
+func (scanner *Scanner) SetCsyncSerial(zone string, serial uint32) {
+	scanner.mu.Lock()
+	defer scanner.mu.Unlock()
+	scanner.CsyncSerials[zone] = serial
+}
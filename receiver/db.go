@@ -23,6 +23,7 @@ parent		  TEXT,
 child		  TEXT,
 keyid		  INTEGER,
 keyrr		  TEXT,
+state		  TEXT,
 comment		  TEXT,
 UNIQUE (parent, child, keyid)
 )`,
@@ -77,7 +78,6 @@ func tableExists(db *sql.DB, name string) bool {
 	default:
 		panic(err)
 	}
-	return false
 }
 
 func dbSetupTables(db *sql.DB) bool {
@@ -97,26 +97,73 @@ func dbSetupTables(db *sql.DB) bool {
 	return false
 }
 
+// Columns added after the first version of a table. Older databases get them
+// added by dbMigrateTables.
+var AddedColumns = map[string]map[string]string{
+	"Keys": {"state": "TEXT DEFAULT 'trusted'"},
+}
+
+func dbMigrateTables(db *sql.DB) {
+	for table, columns := range AddedColumns {
+		for column, coltype := range columns {
+			var found int
+			row := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM pragma_table_info('%s') WHERE name=?", table), column)
+			if err := row.Scan(&found); err != nil {
+				log.Fatalf("dbMigrateTables: Error checking for column %s.%s: %v", table, column, err)
+			}
+			if found > 0 {
+				continue
+			}
+			log.Printf("dbMigrateTables: adding column %s to table %s", column, table)
+			_, err := db.Exec(fmt.Sprintf("ALTER TABLE '%s' ADD COLUMN %s %s", table, column, coltype))
+			if err != nil {
+				log.Fatalf("dbMigrateTables: Error adding column %s.%s: %v", table, column, err)
+			}
+		}
+	}
+}
+
 func NewKeyDB(force bool) *KeyDB {
 	dbfile := viper.GetString("keydb.db")
 	fmt.Printf("dbSetup: using sqlite db in file %s\n", dbfile)
 	if err := os.Chmod(dbfile, 0664); err != nil {
 		log.Printf("dbSetup: Error trying to ensure that db %s is writable: %v",
-			err)
+			dbfile, err)
 	}
 	db, err := sql.Open("sqlite3", dbfile)
 	if err != nil {
-		log.Fatalf("NewKeyDB: Error from sql.Open:", err)
+		log.Fatalf("NewKeyDB: Error from sql.Open: %v", err)
         }
 
 	if force {
 		sqlcmd := "DROP TABLE Keys"
 		_, err = db.Exec(sqlcmd)
 		if err != nil {
-			log.Fatalf("NewKeyDB: Error when dropping table Keys:", err)
+			log.Fatalf("NewKeyDB: Error when dropping table Keys: %v", err)
 		}
 	}
 	dbSetupTables(db)
+	dbMigrateTables(db)
 	return &KeyDB{DB: db}
 }
 
+
+// ChildZones returns the child zones of the parent that have keys in the KeyDB.
+func (kdb *KeyDB) ChildZones(parent string) ([]string, error) {
+	var children []string
+
+	rows, err := kdb.Query("SELECT DISTINCT child FROM Keys WHERE parent=?", parent)
+	if err != nil {
+		return children, fmt.Errorf("ChildZones: Error from db query: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var child string
+		if err := rows.Scan(&child); err != nil {
+			return children, fmt.Errorf("ChildZones: Error from rows.Scan: %v", err)
+		}
+		children = append(children, child)
+	}
+	return children, rows.Err()
+}
@@ -7,7 +7,6 @@ package main
 import (
 	// "crypto"
 	"log"
-	"strings"
 	"time"
 
 	"github.com/miekg/dns"
@@ -16,24 +15,36 @@ import (
 	lib "github.com/johanix/gen-notify-test/lib"
 )
 
-type UpdatePolicy struct {
-	Type    string // only "selfsub" known at the moment
-	RRtypes map[uint16]bool
-}
+// How long to wait for the updater to start on an update before responding
+// SERVFAIL to the client. The update is then dropped.
+var updateTimeout = 10 * time.Second
 
-func DnsEngine(scannerq chan ScanRequest, updateq chan UpdateRequest) error {
+func DnsEngine(scannerq chan ScanRequest, updateq chan UpdateRequest, kdb *KeyDB, zd *ZoneData) error {
 	addresses := viper.GetStringSlice("dnsengine.addresses")
 
 	verbose := viper.GetBool("dnsengine.verbose")
 	debug := viper.GetBool("dnsengine.debug")
-	dns.HandleFunc(".", createHandler(scannerq, updateq, verbose, debug))
+
+	tsigkeys, err := LoadTsigKeys()
+	if err != nil {
+		log.Fatalf("Error loading TSIG keys: %v. Terminating.", err)
+	}
+	if len(tsigkeys) > 0 {
+		log.Printf("DnsEngine: accepting updates signed with %d TSIG keys", len(tsigkeys))
+	}
+	dns.HandleFunc(".", createHandler(scannerq, updateq, kdb, zd, tsigkeys, verbose, debug))
 
 	log.Printf("DnsEngine: addresses: %v", addresses)
 	for _, addr := range addresses {
 		for _, net := range []string{"udp", "tcp"} {
 			go func(addr, net string) {
 				log.Printf("DnsEngine: serving on %s (%s)\n", addr, net)
-				server := &dns.Server{Addr: addr, Net: net}
+				server := &dns.Server{
+					Addr:          addr,
+					Net:           net,
+					MsgAcceptFunc: MsgAcceptFunc,
+					TsigSecret:    TsigSecrets(tsigkeys),
+				}
 
 				// Must bump the buffer size of incoming UDP msgs, as updates
 				// may be much larger then queries
@@ -49,40 +60,48 @@ func DnsEngine(scannerq chan ScanRequest, updateq chan UpdateRequest) error {
 	return nil
 }
 
-func createHandler(scannerq chan ScanRequest, updateq chan UpdateRequest, verbose, debug bool) func(w dns.ResponseWriter, r *dns.Msg) {
+// MsgAcceptFunc is the dns.DefaultMsgAcceptFunc, except that UPDATE is accepted.
+func MsgAcceptFunc(dh dns.Header) dns.MsgAcceptAction {
+	const qr = 1 << 15
+	if opcode := int(dh.Bits>>11) & 0xF; opcode == dns.OpcodeUpdate && dh.Bits&qr == 0 {
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+func createHandler(scannerq chan ScanRequest, updateq chan UpdateRequest, kdb *KeyDB, zd *ZoneData, tsigkeys map[string]*lib.TsigKey, verbose, debug bool) func(w dns.ResponseWriter, r *dns.Msg) {
 
-	keydir := viper.GetString("ddns.keydirectory")
-	keymap, err := lib.ReadPubKeys(keydir)
+	// The KeyDB is the authoritative store for child keys. The local keystore
+	// is only used to import keys into the KeyDB.
+	ks, err := OpenKeyStore()
 	if err != nil {
-		log.Fatalf("Error from ReadPublicKeys(%s): %v", keydir, err)
+		log.Fatalf("Error opening keystore: %v", err)
 	}
-
-	policy := UpdatePolicy{
-		Type:    viper.GetString("ddns.policy.type"),
-		RRtypes: map[uint16]bool{},
+	if ks != nil {
+		err := kdb.ImportKeyStore(viper.GetString("parent.zone"), ks)
+		if err != nil {
+			log.Fatalf("Error from ImportKeyStore: %v", err)
+		}
 	}
 
-	switch policy.Type {
-	case "selfsub", "self":
-		// all ok, we know these
-	default:
-		log.Fatalf("Error: unknown update policy type: \"%s\". Terminating.", policy.Type)
+	policy, err := LoadUpdatePolicy()
+	if err != nil {
+		log.Fatalf("Error loading update policy: %v. Terminating.", err)
 	}
-
-	var rrtypes []string
-	for _, rrstr := range viper.GetStringSlice("ddns.policy.rrtypes") {
-		if rrt, ok := dns.StringToType[rrstr]; ok {
-			policy.RRtypes[rrt] = true
-			rrtypes = append(rrtypes, rrstr)
-		} else {
-			log.Printf("Unknown RR type: \"%s\". Ignoring.", rrstr)
-		}
+	log.Printf("DnsEngine: using update policy with %d rules", len(policy.Rules))
+	if verbose {
+		policy.LogPolicy()
 	}
 
-	if len(policy.RRtypes) == 0 {
-		log.Fatalf("Error: zero valid RRtypes listed in policy.")
+	parentzone := viper.GetString("parent.zone")
+
+	bootstrap := viper.GetBool("ddns.bootstrap.enabled")
+	if bootstrap {
+		log.Printf("DnsEngine: accepting self-signed KEY uploads for key bootstrap")
 	}
-	log.Printf("DnsEngine: using update policy \"%s\" with RRtypes: %v", policy.Type, rrtypes)
 
 	return func(w dns.ResponseWriter, r *dns.Msg) {
 		var qtype string
@@ -93,18 +112,41 @@ func createHandler(scannerq chan ScanRequest, updateq chan UpdateRequest, verbos
 
 		switch r.Opcode {
 		case dns.OpcodeNotify:
-			// send NOERROR response
 			m := new(dns.Msg)
 			m.SetReply(r)
+
+			// only SIG(0) signed notifications need the child keys, so an
+			// unsigned NOTIFY does not cost a KeyDB lookup
+			var keymap map[string][]dns.KEY
+			if hasSIG0(r) {
+				var err error
+				keymap, err = kdb.KeyMap(parentzone)
+				if err != nil {
+					log.Printf("Error from KeyMap(%s): %v", parentzone, err)
+				}
+			}
+			auth, vr := ClassifyNotify(zone, r, w.TsigStatus(), keymap, tsigkeys)
+			if auth == NotifyInvalid {
+				log.Printf("DnsEngine: Dropping NOTIFY for zone %s with invalid signature (rcode %s)",
+					zone, dns.RcodeToString[int(vr.Rcode)])
+				SetResponseRcode(m, r, int(vr.Rcode))
+				w.WriteMsg(m)
+				return
+			}
+			if t := r.IsTsig(); t != nil {
+				m.SetTsig(t.Hdr.Name, t.Algorithm, lib.TsigFudge, time.Now().Unix())
+			}
 			w.WriteMsg(m)
 
 			for i := 0; i <= len(r.Question)-1; i++ {
 				m := r.Question[i]
 				qtype = dns.TypeToString[m.Qtype]
 				if verbose {
-					log.Printf("DnsEngine: Received NOTIFY(%s) for zone %s", qtype, zone)
+					log.Printf("DnsEngine: Received %s NOTIFY(%s) for zone %s",
+						NotifyAuthToString[auth], qtype, zone)
 				}
-				scannerq <- ScanRequest{Cmd: "SCAN", ZoneName: zone, RRtype: qtype}
+				scannerq <- ScanRequest{Cmd: "SCAN", ZoneName: zone, RRtype: qtype,
+					Authenticated: auth == NotifyAuthenticated}
 			}
 			return
 
@@ -114,32 +156,48 @@ func createHandler(scannerq chan ScanRequest, updateq chan UpdateRequest, verbos
 			m := new(dns.Msg)
 			m.SetReply(r)
 
-			rcode, signername, err := ValidateUpdate(r, keymap)
+			keymap, err := kdb.KeyMap(zone)
 			if err != nil {
-				log.Printf("Error from ValidateUpdate(): %v", err)
-			}
-
-			// send response
-			m = m.SetRcode(m, int(rcode))
-			w.WriteMsg(m)
-
-			if rcode != dns.RcodeSuccess {
-				log.Printf("Error verifying DDNS update. Ignoring contents.")
+				log.Printf("Error from KeyMap(%s): %v", zone, err)
+				m = m.SetRcode(m, dns.RcodeServerFailure)
+				w.WriteMsg(m)
+				return
 			}
 
-			ok, err := ApproveUpdate(zone, signername, r, policy, verbose, debug)
-			if err != nil {
-				log.Printf("Error from ApproveUpdate: %v. Ignoring update.", err)
-				return
+			var result UpdateResult
+
+			// TSIG signed updates are verified against the configured TSIG keys.
+			// A child without trusted keys may upload its first key, signed by
+			// itself. It is kept as pending until verified out of band.
+			if t := r.IsTsig(); t != nil {
+				vr := ValidateTsig(r, w.TsigStatus(), tsigkeys)
+				ar := ApproveUpdate(zone, vr, r, policy, zd, verbose, debug)
+				result = SubmitUpdate(zone, r, ar, updateq)
+				if vr.Validated {
+					// the response is signed with the same key when it is written
+					m.SetTsig(t.Hdr.Name, t.Algorithm, lib.TsigFudge, time.Now().Unix())
+				}
+			} else if key := BootstrapKey(zone, r); bootstrap && key != nil && len(keymap[dns.CanonicalName(key.Header().Name)]) == 0 {
+				log.Printf("DnsEngine: Received key bootstrap request for %s with keyid %d",
+					key.Header().Name, key.KeyTag())
+				vr := ValidateUpdate(r, map[string][]dns.KEY{dns.CanonicalName(key.Header().Name): {*key}})
+				ar := ApproveUpdate(zone, vr, r, policy, zd, verbose, debug)
+				result = BootstrapUpdate(zone, key, ar, kdb)
+				if result.Rcode == dns.RcodeSuccess {
+					scannerq <- ScanRequest{Cmd: "SCAN", ZoneName: key.Header().Name, RRtype: "KEY",
+						Authenticated: true}
+				}
+			} else {
+				vr := ValidateUpdate(r, keymap)
+				ar := ApproveUpdate(zone, vr, r, policy, zd, verbose, debug)
+				result = SubmitUpdate(zone, r, ar, updateq)
 			}
 
-			if !ok {
-				log.Printf("DnsEngine: ApproveUpdate rejected the update. Ignored.")
-				return
+			if result.Error != nil {
+				log.Printf("DnsEngine: Update for zone %s not applied: %v", zone, result.Error)
 			}
-			log.Printf("DnsEngine: Update validated and approved. Queued for zone update.")
-			// send into suitable channel for pending updates
-			updateq <- UpdateRequest{Cmd: "UPDATE", ZoneName: zone, Actions: r.Ns}
+			SetResponseRcode(m, r, result.Rcode)
+			w.WriteMsg(m)
 			return
 
 		default:
@@ -149,39 +207,55 @@ func createHandler(scannerq chan ScanRequest, updateq chan UpdateRequest, verbos
 	}
 }
 
-func ValidateUpdate(r *dns.Msg, keymap map[string]dns.KEY) (uint8, string, error) {
+// ValidateUpdate verifies the SIG(0) signature on the update. The signer may have
+// several trusted keys (e.g. during a key rollover), so every key that matches the
+// keytag and algorithm in the SIG is tried before giving up.
+func ValidateUpdate(r *dns.Msg, keymap map[string][]dns.KEY) ValidationResult {
 	var rcode uint8 = dns.RcodeSuccess
 
 	if len(r.Extra) == 0 {
-		return dns.RcodeFormatError, "", nil // there is no signature on the update
+		return ValidationResult{Rcode: dns.RcodeFormatError} // there is no signature on the update
 	}
 
 	for _, rr := range r.Extra {
 		if sigRR, ok := rr.(*dns.SIG); ok && sigRR.Header().Rrtype == dns.TypeSIG {
 			// sig := r.Extra[0].(*dns.SIG)
 			sigName := sigRR.RRSIG.SignerName
-			log.Printf("* Update is signed by \"%s\".", sigName)
+			log.Printf("* Update is signed by \"%s\" (keyid %d, algorithm %s).", sigName,
+				sigRR.RRSIG.KeyTag, dns.AlgorithmToString[sigRR.RRSIG.Algorithm])
 
-			keyrr, ok := keymap[sigName]
-			if !ok {
-				log.Printf("= Error: key \"%s\" is unknown.", sigName)
-				rcode = dns.RcodeBadKey
+			var candidates []dns.KEY
+			for _, key := range keymap[dns.CanonicalName(sigName)] {
+				if key.KeyTag() == sigRR.RRSIG.KeyTag && key.Algorithm == sigRR.RRSIG.Algorithm {
+					candidates = append(candidates, key)
+				}
+			}
+			if len(candidates) == 0 {
+				log.Printf("= Error: key \"%s\" with keyid %d is unknown.", sigName, sigRR.RRSIG.KeyTag)
+				return ValidationResult{Rcode: dns.RcodeBadKey, SignerName: sigName}
 			}
 
-			newMsg := r.Copy()
-			newMsg.Extra = newMsg.Extra[:len(newMsg.Extra)-1]
-			msgbuf, err := newMsg.Pack()
+			// sig.Verify() wants the whole message, including the SIG
+			// (which must be the last RR), and finds the signed part itself
+			msgbuf, err := r.Pack()
 			if err != nil {
 				log.Printf("= Error from msg.Pack(): %v", err)
-				rcode = dns.RcodeFormatError
+				return ValidationResult{Rcode: dns.RcodeFormatError, SignerName: sigName, Error: err}
 			}
 
-			err = sigRR.Verify(&keyrr, msgbuf)
-			if err != nil {
-				log.Printf("= Error from sig.Varify(): %v", err)
-				rcode = dns.RcodeBadSig
-			} else {
+			verified := false
+			for _, keyrr := range candidates {
+				err = sigRR.Verify(&keyrr, msgbuf)
+				if err == nil {
+					verified = true
+					break
+				}
+				log.Printf("= Error from sig.Verify() with key %d: %v", keyrr.KeyTag(), err)
+			}
+			if verified {
 				log.Printf("* Update SIG verified correctly")
+			} else {
+				rcode = dns.RcodeBadSig
 			}
 
 			if lib.SIGValidityPeriod(sigRR, time.Now()) {
@@ -190,51 +264,46 @@ func ValidateUpdate(r *dns.Msg, keymap map[string]dns.KEY) (uint8, string, error
 				log.Printf("= Update SIG is NOT within its validity period")
 				rcode = dns.RcodeBadTime
 			}
-			return rcode, sigName, nil
+			return ValidationResult{
+				Validated:  rcode == dns.RcodeSuccess,
+				Rcode:      rcode,
+				SignerName: sigName,
+			}
 		}
 	}
-	return dns.RcodeFormatError, "", nil // there is no SIG(0) signature on the update
+	return ValidationResult{Rcode: dns.RcodeFormatError} // there is no SIG(0) signature on the update
 }
 
-func ApproveUpdate(zone, signername string, r *dns.Msg, policy UpdatePolicy, verbose, debug bool) (bool, error) {
-	log.Printf("Analysing update using policy type %s with allowed RR types %v",
-		policy.Type, policy.RRtypes)
-
-	for i := 0; i <= len(r.Ns)-1; i++ {
-		rr := r.Ns[i]
+// ApproveUpdate checks the update against the policy. Only validated updates can
+// be approved.
+func ApproveUpdate(zone string, vr ValidationResult, r *dns.Msg, policy *UpdatePolicy, zd *ZoneData, verbose, debug bool) ApprovalResult {
+	if !vr.Validated {
+		log.Printf("ApproveUpdate: update not validated (rcode %s). Ignoring contents.",
+			dns.RcodeToString[int(vr.Rcode)])
+		return ApprovalResult{Rcode: vr.Rcode, SignerName: vr.SignerName,
+			Reason: "signature not validated", Error: vr.Error}
+	}
+	signername := vr.SignerName
 
-		if !policy.RRtypes[rr.Header().Rrtype] {
-			log.Printf("ApproveUpdate: update rejected (unapproved RR type: %s)",
-				dns.TypeToString[rr.Header().Rrtype])
-			return false, nil
+	pr := policy.Evaluate(zone, signername, r.Ns, zd)
+	for _, d := range pr.Decisions {
+		verdict := "granted"
+		if !d.Granted {
+			verdict = "denied"
 		}
-
-		switch policy.Type {
-		case "selfsub":
-			if !strings.HasSuffix(rr.Header().Name, signername) {
-				log.Printf("ApproveUpdate: update rejected (owner name %s outside selfsub %s tree)",
-					rr.Header().Name, signername)
-				return false, nil
-			}
-
-		case "self":
-			if rr.Header().Name != signername {
-				log.Printf("ApproveUpdate: update rejected (owner name %s different from signer name %s in violation of \"self\" policy)",
-					rr.Header().Name, signername)
-				return false, nil
-			}
+		switch d.RR.Header().Class {
+		case dns.ClassNONE:
+			log.Printf("ApproveUpdate: Remove RR (%s by %s): %s", verdict, d.Rule, d.RR.String())
+		case dns.ClassANY:
+			log.Printf("ApproveUpdate: Remove RRset (%s by %s): %s", verdict, d.Rule, d.RR.String())
 		default:
-			log.Printf("ApproveUpdate: unknown policy type: \"%s\"", policy.Type)
-			return false, nil
+			log.Printf("ApproveUpdate: Add RR (%s by %s): %s", verdict, d.Rule, d.RR.String())
 		}
+	}
 
-		if rr.Header().Class == dns.ClassNONE {
-			log.Printf("ApproveUpdate: Remove RR: %s", rr.String())
-		} else if rr.Header().Class == dns.ClassANY {
-			log.Printf("ApproveUpdate: Remove RRset: %s", rr.String())
-		} else {
-			log.Printf("ApproveUpdate: Add RR: %s", rr.String())
-		}
+	if !pr.Granted {
+		log.Printf("ApproveUpdate: update rejected (%s)", pr.Reason)
+		return ApprovalResult{Rcode: dns.RcodeRefused, SignerName: signername, Reason: pr.Reason}
 	}
-	return true, nil
+	return ApprovalResult{Approved: true, Rcode: dns.RcodeSuccess, SignerName: signername}
 }
@@ -0,0 +1,93 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"log"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+// Forwarder re-signs approved updates with the receiver's own key and sends
+// them on to the real primary for the parent zone.
+type Forwarder struct {
+	Upstream   string // address:port of the upstream primary
+	TsigKey    *lib.TsigKey
+	Sig0Key    *dns.KEY
+	Sig0Signer crypto.Signer
+}
+
+// NewForwarder returns nil if no upstream primary is configured.
+func NewForwarder() *Forwarder {
+	upstream := viper.GetString("upstream.primary")
+	if upstream == "" {
+		return nil
+	}
+
+	fwd := Forwarder{Upstream: upstream}
+
+	if name := viper.GetString("upstream.tsig.name"); name != "" {
+		var err error
+		fwd.TsigKey, err = lib.NewTsigKey(name, viper.GetString("upstream.tsig.algorithm"),
+			viper.GetString("upstream.tsig.secret"))
+		if err != nil {
+			log.Fatalf("Error: upstream %v", err)
+		}
+	}
+
+	if keyname := viper.GetString("upstream.sig0.keyname"); keyname != "" {
+		ks, err := OpenKeyStore()
+		if err != nil || ks == nil {
+			log.Fatalf("Error: no keystore for upstream SIG(0) key %s: %v", keyname, err)
+		}
+		keyid := uint16(viper.GetUint("upstream.sig0.keyid"))
+		fwd.Sig0Key, fwd.Sig0Signer, err = lib.SigningKey(ks, keyname, keyid)
+		if err != nil {
+			log.Fatalf("Error loading upstream SIG(0) key %s: %v", keyname, err)
+		}
+	}
+
+	if fwd.TsigKey != nil && fwd.Sig0Key != nil {
+		log.Fatalf("Error: both TSIG and SIG(0) configured for upstream %s, choose one", upstream)
+	}
+	log.Printf("Forwarder: approved updates will be forwarded to %s", upstream)
+	return &fwd
+}
+
+// Forward sends the update to the upstream primary and returns its rcode.
+func (fwd *Forwarder) Forward(ur UpdateRequest) (int, error) {
+	m := new(dns.Msg)
+	m.SetUpdate(ur.ZoneName)
+	m.Answer = ur.Prereqs
+	m.Ns = ur.Actions
+
+	c := new(dns.Client)
+
+	switch {
+	case fwd.TsigKey != nil:
+		c.TsigSecret = fwd.TsigKey.Secrets()
+		fwd.TsigKey.Sign(m)
+	case fwd.Sig0Key != nil:
+		signed, err := lib.SignMsgNG(*m, fwd.Sig0Key.Header().Name, fwd.Sig0Signer, fwd.Sig0Key)
+		if err != nil {
+			return dns.RcodeServerFailure, fmt.Errorf("error signing forwarded update: %v", err)
+		}
+		m = &signed
+	}
+
+	res, _, err := c.Exchange(m, fwd.Upstream)
+	if err != nil {
+		return dns.RcodeServerFailure, fmt.Errorf("error forwarding update to %s: %v", fwd.Upstream, err)
+	}
+
+	log.Printf("Forwarder: update for zone %s forwarded to %s, upstream rcode: %s",
+		ur.ZoneName, fwd.Upstream, dns.RcodeToString[res.Rcode])
+	return res.Rcode, nil
+}
@@ -0,0 +1,124 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// Inventory is the set of child zones delegated from the parent zone, i.e. the
+// zones that the receiver is responsible for scanning.
+type Inventory struct {
+	ParentZone string
+	Source     string // "zonefile" or "keydb"
+	ZoneFile   string
+	KeyDB      *KeyDB
+	children   map[string]bool
+	mu         sync.RWMutex
+}
+
+func NewInventory(parent string, kdb *KeyDB) *Inventory {
+	inv := Inventory{
+		ParentZone: parent,
+		Source:     viper.GetString("inventory.source"),
+		ZoneFile:   viper.GetString("inventory.zonefile"),
+		KeyDB:      kdb,
+		children:   map[string]bool{},
+	}
+
+	switch inv.Source {
+	case "zonefile":
+		if inv.ZoneFile == "" {
+			log.Fatalf("Error: inventory source is \"zonefile\" but no zone file specified.")
+		}
+	case "keydb":
+		// all ok
+	default:
+		log.Fatalf("Error: unknown inventory source: \"%s\". Terminating.", inv.Source)
+	}
+	return &inv
+}
+
+// Load (re)reads the list of child zones from the configured source.
+func (inv *Inventory) Load() error {
+	var children []string
+	var err error
+
+	switch inv.Source {
+	case "zonefile":
+		children, err = DelegationsFromZoneFile(inv.ParentZone, inv.ZoneFile)
+	case "keydb":
+		children, err = inv.KeyDB.ChildZones(inv.ParentZone)
+	}
+	if err != nil {
+		return err
+	}
+
+	newchildren := make(map[string]bool, len(children))
+	for _, c := range children {
+		newchildren[dns.CanonicalName(c)] = true
+	}
+
+	inv.mu.Lock()
+	inv.children = newchildren
+	inv.mu.Unlock()
+
+	log.Printf("Inventory: loaded %d child zones of %s from %s", len(children), inv.ParentZone, inv.Source)
+	return nil
+}
+
+func (inv *Inventory) Known(zone string) bool {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	return inv.children[dns.CanonicalName(zone)]
+}
+
+func (inv *Inventory) Children() []string {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	var children []string
+	for c := range inv.children {
+		children = append(children, c)
+	}
+	sort.Strings(children)
+	return children
+}
+
+// DelegationsFromZoneFile returns the names of all delegation points, i.e. all
+// owners of NS RRsets below the apex, in a master file for the parent zone.
+func DelegationsFromZoneFile(parent, zonefile string) ([]string, error) {
+	f, err := os.Open(zonefile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	seen := map[string]bool{}
+	var children []string
+
+	zp := dns.NewZoneParser(f, parent, zonefile)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if rr.Header().Rrtype != dns.TypeNS {
+			continue
+		}
+		owner := dns.CanonicalName(rr.Header().Name)
+		if owner == dns.CanonicalName(parent) || seen[owner] {
+			continue
+		}
+		seen[owner] = true
+		children = append(children, owner)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("error parsing zone file %s: %v", zonefile, err)
+	}
+	return children, nil
+}
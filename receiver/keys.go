@@ -0,0 +1,195 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+// States for child SIG(0) keys in the KeyDB.
+const (
+	KeyStateTrusted = "trusted"
+	KeyStatePending = "pending" // bootstrapped, but not yet verified out of band
+)
+
+// AddKey stores the child KEY (the owner name is the child zone) in the KeyDB. If the
+// key is already known its state is updated.
+func (kdb *KeyDB) AddKey(parent string, key *dns.KEY, state, comment string) error {
+	kdb.mu.Lock()
+	defer kdb.mu.Unlock()
+
+	_, err := kdb.Exec(`INSERT INTO Keys (parent, child, keyid, keyrr, state, comment) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (parent, child, keyid) DO UPDATE SET keyrr=excluded.keyrr, state=excluded.state`,
+		dns.CanonicalName(parent), dns.CanonicalName(key.Header().Name), key.KeyTag(),
+		key.String(), state, comment)
+	if err != nil {
+		return fmt.Errorf("AddKey: Error storing key %d for %s: %v", key.KeyTag(), key.Header().Name, err)
+	}
+	return nil
+}
+
+// RemoveKey removes the child KEY with the keyid from the KeyDB.
+func (kdb *KeyDB) RemoveKey(parent, child string, keyid uint16) error {
+	kdb.mu.Lock()
+	defer kdb.mu.Unlock()
+
+	_, err := kdb.Exec("DELETE FROM Keys WHERE parent=? AND child=? AND keyid=?",
+		dns.CanonicalName(parent), dns.CanonicalName(child), keyid)
+	if err != nil {
+		return fmt.Errorf("RemoveKey: Error removing key %d for %s: %v", keyid, child, err)
+	}
+	return nil
+}
+
+// RemoveKeys removes all KEYs for the child from the KeyDB.
+func (kdb *KeyDB) RemoveKeys(parent, child string) error {
+	kdb.mu.Lock()
+	defer kdb.mu.Unlock()
+
+	_, err := kdb.Exec("DELETE FROM Keys WHERE parent=? AND child=?",
+		dns.CanonicalName(parent), dns.CanonicalName(child))
+	if err != nil {
+		return fmt.Errorf("RemoveKeys: Error removing keys for %s: %v", child, err)
+	}
+	return nil
+}
+
+// KeyMap returns the trusted child keys for the parent, indexed on child name.
+// A child may have more than one trusted key.
+func (kdb *KeyDB) KeyMap(parent string) (map[string][]dns.KEY, error) {
+	keymap := map[string][]dns.KEY{}
+
+	rows, err := kdb.Query("SELECT child, keyrr FROM Keys WHERE parent=? AND state=?",
+		dns.CanonicalName(parent), KeyStateTrusted)
+	if err != nil {
+		return keymap, fmt.Errorf("KeyMap: Error from db query: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var child, keyrr string
+		if err := rows.Scan(&child, &keyrr); err != nil {
+			return keymap, fmt.Errorf("KeyMap: Error from rows.Scan: %v", err)
+		}
+		rr, err := dns.NewRR(keyrr)
+		if err != nil {
+			log.Printf("KeyMap: Error parsing stored key for %s: %v. Ignored.", child, err)
+			continue
+		}
+		if key, ok := rr.(*dns.KEY); ok {
+			owner := dns.CanonicalName(key.Header().Name)
+			keymap[owner] = append(keymap[owner], *key)
+		}
+	}
+	return keymap, rows.Err()
+}
+
+// OpenKeyStore opens the configured local keystore. The default is a directory
+// keystore in ddns.keydirectory. Returns nil if no keystore is configured.
+func OpenKeyStore() (lib.KeyStore, error) {
+	kstype := viper.GetString("keystore.type")
+	path := viper.GetString("keystore.path")
+	if path == "" && (kstype == "" || kstype == "directory") {
+		path = viper.GetString("ddns.keydirectory")
+	}
+	if path == "" {
+		return nil, nil
+	}
+	return lib.OpenKeyStore(kstype, path)
+}
+
+// ImportKeyStore adds all the public keys in the local keystore to the KeyDB
+// as trusted keys. Keys that are already in the KeyDB (in any state) are left
+// alone.
+func (kdb *KeyDB) ImportKeyStore(parent string, ks lib.KeyStore) error {
+	keys, err := ks.List("")
+	if err != nil {
+		return err
+	}
+
+	kdb.mu.Lock()
+	defer kdb.mu.Unlock()
+
+	for _, ki := range keys {
+		res, err := kdb.Exec(`INSERT OR IGNORE INTO Keys (parent, child, keyid, keyrr, state, comment) VALUES (?, ?, ?, ?, ?, ?)`,
+			dns.CanonicalName(parent), dns.CanonicalName(ki.Owner), ki.KeyId,
+			ki.KeyRR.String(), KeyStateTrusted, "imported from keystore")
+		if err != nil {
+			return fmt.Errorf("ImportKeyStore: Error storing key %d for %s: %v", ki.KeyId, ki.Owner, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("ImportKeyStore: imported key %d for %s", ki.KeyId, ki.Owner)
+		}
+	}
+	return nil
+}
+
+// SetKeyState changes the state of a child KEY in the KeyDB.
+func (kdb *KeyDB) SetKeyState(parent, child string, keyid uint16, state string) error {
+	kdb.mu.Lock()
+	defer kdb.mu.Unlock()
+
+	_, err := kdb.Exec("UPDATE Keys SET state=? WHERE parent=? AND child=? AND keyid=?",
+		state, dns.CanonicalName(parent), dns.CanonicalName(child), keyid)
+	if err != nil {
+		return fmt.Errorf("SetKeyState: Error setting state of key %d for %s: %v", keyid, child, err)
+	}
+	return nil
+}
+
+// PendingKeys returns the child keys that are waiting for out of band verification.
+func (kdb *KeyDB) PendingKeys(parent, child string) ([]dns.KEY, error) {
+	var keys []dns.KEY
+
+	rows, err := kdb.Query("SELECT keyrr FROM Keys WHERE parent=? AND child=? AND state=?",
+		dns.CanonicalName(parent), dns.CanonicalName(child), KeyStatePending)
+	if err != nil {
+		return keys, fmt.Errorf("PendingKeys: Error from db query: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var keyrr string
+		if err := rows.Scan(&keyrr); err != nil {
+			return keys, fmt.Errorf("PendingKeys: Error from rows.Scan: %v", err)
+		}
+		rr, err := dns.NewRR(keyrr)
+		if err != nil {
+			log.Printf("PendingKeys: Error parsing stored key for %s: %v. Ignored.", child, err)
+			continue
+		}
+		if key, ok := rr.(*dns.KEY); ok {
+			keys = append(keys, *key)
+		}
+	}
+	return keys, rows.Err()
+}
+
+// PendingChildren returns the child zones that have keys waiting for verification.
+func (kdb *KeyDB) PendingChildren(parent string) ([]string, error) {
+	var children []string
+
+	rows, err := kdb.Query("SELECT DISTINCT child FROM Keys WHERE parent=? AND state=?",
+		dns.CanonicalName(parent), KeyStatePending)
+	if err != nil {
+		return children, fmt.Errorf("PendingChildren: Error from db query: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var child string
+		if err := rows.Scan(&child); err != nil {
+			return children, fmt.Errorf("PendingChildren: Error from rows.Scan: %v", err)
+		}
+		children = append(children, child)
+	}
+	return children, rows.Err()
+}
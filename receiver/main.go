@@ -43,11 +43,18 @@ func main() {
 		log.Printf("Error reading config '%s': %v\n", viper.ConfigFileUsed(), err)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "policy-check" {
+		os.Exit(PolicyCheck(os.Args[2:]))
+	}
+
 	scannerq := make(chan ScanRequest, 5)
 	updateq := make(chan UpdateRequest, 5)
-	go ScannerEngine(scannerq, updateq)
-	go UpdaterEngine(updateq)
-	go DnsEngine(scannerq, updateq)
+	kdb := NewKeyDB(false)
+	zd := LoadParentZone()
+
+	go ScannerEngine(scannerq, updateq, kdb)
+	go UpdaterEngine(updateq, kdb, zd)
+	go DnsEngine(scannerq, updateq, kdb, zd)
 
 	mainloop()
 }
@@ -0,0 +1,69 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"log"
+
+	"github.com/miekg/dns"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+// Notifications are classified by their signature. An authenticated NOTIFY is
+// signed by the notified child itself (with a trusted SIG(0) key, or a TSIG key
+// named after the child) and moves the scan to the front of the queue. An
+// unsigned NOTIFY, or one signed by someone else, only gets the scan queued
+// behind what is already there. A NOTIFY with a signature that does not verify
+// is dropped. So a flood of unauthenticated notifications can delay other
+// unauthenticated notifications, but not the scans of children that sign.
+
+type NotifyAuth uint8
+
+const (
+	NotifyUnauthenticated NotifyAuth = iota
+	NotifyAuthenticated
+	NotifyInvalid
+)
+
+var NotifyAuthToString = map[NotifyAuth]string{
+	NotifyUnauthenticated: "unauthenticated",
+	NotifyAuthenticated:   "authenticated",
+	NotifyInvalid:         "invalid",
+}
+
+// ClassifyNotify checks the signature (if any) on the NOTIFY for zone. tsigstatus
+// is the outcome of the TSIG verification in the dns.Server.
+func ClassifyNotify(zone string, r *dns.Msg, tsigstatus error, keymap map[string][]dns.KEY, tsigkeys map[string]*lib.TsigKey) (NotifyAuth, ValidationResult) {
+	var vr ValidationResult
+
+	switch {
+	case r.IsTsig() != nil:
+		vr = ValidateTsig(r, tsigstatus, tsigkeys)
+	case hasSIG0(r):
+		vr = ValidateUpdate(r, keymap)
+	default:
+		return NotifyUnauthenticated, ValidationResult{Rcode: dns.RcodeSuccess}
+	}
+
+	if !vr.Validated {
+		return NotifyInvalid, vr
+	}
+	if !lib.SameName(vr.SignerName, zone) {
+		log.Printf("ClassifyNotify: NOTIFY for %s is signed by %s, not by the child. Treated as unauthenticated.",
+			zone, vr.SignerName)
+		return NotifyUnauthenticated, vr
+	}
+	return NotifyAuthenticated, vr
+}
+
+func hasSIG0(r *dns.Msg) bool {
+	for _, rr := range r.Extra {
+		if _, ok := rr.(*dns.SIG); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+func TestNotifyClassification(t *testing.T) {
+	childkey, err := lib.NewTsigKey("child.parent.example", "hmac-sha256", testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := startTestServer(t, map[string]*lib.TsigKey{childkey.Name: childkey})
+
+	sig0key, privkey, err := lib.GenerateKey("child.parent.example.", dns.ED25519, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs, err := lib.PrivateKeyToSigner(privkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.KeyDB.AddKey("parent.example.", sig0key, KeyStateTrusted, "test"); err != nil {
+		t.Fatal(err)
+	}
+	untrusted, untrustedpriv, err := lib.GenerateKey("child.parent.example.", dns.ED25519, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	untrustedcs, _ := lib.PrivateKeyToSigner(untrustedpriv)
+
+	wrongsecret := lib.TsigKey{Name: childkey.Name, Algorithm: childkey.Algorithm, Secret: otherSecret}
+
+	tests := []struct {
+		name   string
+		zone   string
+		sign   func(m *dns.Msg) (*dns.Msg, *dns.Client)
+		rcode  int
+		queued bool
+		auth   bool
+	}{
+		{"unsigned", "child.parent.example.", nil, dns.RcodeSuccess, true, false},
+		{"tsig by child", "child.parent.example.", tsigSigner(childkey), dns.RcodeSuccess, true, true},
+		{"tsig by other", "other.parent.example.", tsigSigner(childkey), dns.RcodeSuccess, true, false},
+		{"sig0 by child", "child.parent.example.", sig0Signer(t, sig0key, cs), dns.RcodeSuccess, true, true},
+		{"tsig wrong secret", "child.parent.example.", tsigSigner(&wrongsecret), dns.RcodeNotAuth, false, false},
+		{"sig0 untrusted key", "child.parent.example.", sig0Signer(t, untrusted, untrustedcs), dns.RcodeNotAuth, false, false},
+	}
+
+	for _, tc := range tests {
+		m := new(dns.Msg)
+		m.SetNotify(tc.zone)
+		m.Question[0].Qtype = dns.TypeCDS
+		c := new(dns.Client)
+		if tc.sign != nil {
+			m, c = tc.sign(m)
+		}
+
+		res, _, err := c.Exchange(m, ts.Addr)
+		if err != nil {
+			t.Errorf("%s: Exchange: %v", tc.name, err)
+			continue
+		}
+		if res.Rcode != tc.rcode {
+			t.Errorf("%s: got rcode %s, want %s", tc.name,
+				dns.RcodeToString[res.Rcode], dns.RcodeToString[tc.rcode])
+		}
+
+		select {
+		case sr := <-ts.ScannerQ:
+			if !tc.queued {
+				t.Errorf("%s: NOTIFY with invalid signature queued a scan", tc.name)
+			} else if sr.ZoneName != tc.zone || sr.Authenticated != tc.auth {
+				t.Errorf("%s: got scan request %+v, want zone %s authenticated %v",
+					tc.name, sr, tc.zone, tc.auth)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if tc.queued {
+				t.Errorf("%s: no scan queued", tc.name)
+			}
+		}
+	}
+}
+
+func tsigSigner(key *lib.TsigKey) func(m *dns.Msg) (*dns.Msg, *dns.Client) {
+	return func(m *dns.Msg) (*dns.Msg, *dns.Client) {
+		key.Sign(m)
+		return m, &dns.Client{TsigSecret: key.Secrets()}
+	}
+}
+
+func sig0Signer(t *testing.T, keyrr *dns.KEY, cs crypto.Signer) func(m *dns.Msg) (*dns.Msg, *dns.Client) {
+	return func(m *dns.Msg) (*dns.Msg, *dns.Client) {
+		signed, err := lib.SignMsgNG(*m, keyrr.Header().Name, cs, keyrr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &signed, new(dns.Client)
+	}
+}
+
+func TestScanQueuePriority(t *testing.T) {
+	q := NewScanQueue()
+	q.Push(ScanJob{ZoneName: "a.parent.example.", RRtype: "CDS", Notified: true})
+	q.Push(ScanJob{ZoneName: "b.parent.example.", RRtype: "CDS", Notified: true})
+	q.PushFront(ScanJob{ZoneName: "c.parent.example.", RRtype: "CDS", Notified: true})
+	// an authenticated NOTIFY moves a pending unauthenticated job to the front,
+	// but an unauthenticated NOTIFY never moves a job
+	q.PushFront(ScanJob{ZoneName: "b.parent.example.", RRtype: "CDS", Notified: true})
+	q.Push(ScanJob{ZoneName: "c.parent.example.", RRtype: "CDS", Notified: true})
+
+	for _, want := range []string{"b.parent.example.", "c.parent.example.", "a.parent.example."} {
+		if job := q.Pop(); job.ZoneName != want {
+			t.Errorf("got job for %s, want %s", job.ZoneName, want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/miekg/dns"
+)
+
+// An incoming UPDATE passes through three stages: validate (is the signature
+// good), approve (does the policy allow the signer to make these changes) and
+// apply (hand it to the updater). Each stage takes the result of the previous
+// one, so an update that was not validated can not be approved and an update
+// that was not approved can never reach the updateq.
+
+type ValidationResult struct {
+	Validated  bool
+	Rcode      uint8
+	SignerName string
+	Error      error
+}
+
+type ApprovalResult struct {
+	Approved   bool
+	Rcode      uint8 // REFUSED for policy denials, otherwise from the validation
+	SignerName string
+	Reason     string
+	Error      error
+}
+
+// SubmitUpdate is the apply stage: an approved update is queued for the updater
+// and the outcome from the updater decides the response rcode.
+func SubmitUpdate(zone string, r *dns.Msg, ar ApprovalResult, updateq chan UpdateRequest) UpdateResult {
+	if !ar.Approved {
+		return UpdateResult{
+			Rcode:         int(ar.Rcode),
+			UpstreamRcode: -1,
+			Error:         fmt.Errorf("update not approved: %s", ar.Reason),
+		}
+	}
+
+	log.Printf("DnsEngine: Update validated and approved. Queued for zone update.")
+	// send into suitable channel for pending updates and wait for the outcome
+	ur := UpdateRequest{Cmd: "UPDATE", ZoneName: zone, Prereqs: r.Answer, Actions: r.Ns}
+	result := ur.Submit(updateq)
+	if result.UpstreamRcode >= 0 {
+		log.Printf("DnsEngine: Upstream primary responded %s",
+			dns.RcodeToString[result.UpstreamRcode])
+	}
+	return result
+}
+
+// SetResponseRcode sets the rcode in the response. Extended rcodes (like BADSIG,
+// BADKEY and BADTIME) can only be sent if there is an OPT RR, so if the request
+// did not use EDNS(0) NOTAUTH is returned instead.
+func SetResponseRcode(m, r *dns.Msg, rcode int) {
+	if rcode > 0xF {
+		if opt := r.IsEdns0(); opt != nil {
+			m.SetEdns0(opt.UDPSize(), opt.Do())
+		} else {
+			rcode = dns.RcodeNotAuth
+		}
+	}
+	m.Rcode = rcode
+}
@@ -0,0 +1,369 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+// The update policy is an ordered list of grant and deny rules, in the style of
+// BIND's update-policy. Every RR in the update section is checked against the
+// rules in order and the first rule that matches decides. An RR that no rule
+// matches is denied. The update is only approved if all RRs are granted.
+//
+// The name match is relative to the signer (i.e. the child zone):
+//   self       the owner is the signer name (the delegation point)
+//   selfsub    the owner is the signer name or below it
+//   subdomain  the owner is strictly below the signer name
+//   glue       an address record strictly below the signer name, that is the
+//              target of an NS record at the delegation point
+//   any        any owner name in the parent zone
+//
+// A grant rule may also limit the size of the resulting RRset with min-rrs and
+// max-rrs (0 means no limit). E.g. min-rrs: 1 for NS at the delegation point
+// prevents a child from removing all its NS records.
+
+type PolicyRule struct {
+	Name    string
+	Action  string   // "grant" or "deny"
+	Zones   []string // parent zones the rule applies to, empty means all
+	Keys    []string // signer names the rule applies to, empty means all
+	Match   string
+	RRtypes map[uint16]bool // empty means all types
+	MinRRs  int
+	MaxRRs  int
+}
+
+type UpdatePolicy struct {
+	Rules []PolicyRule
+}
+
+// PolicyRuleConf is a rule as written in the config file.
+type PolicyRuleConf struct {
+	Name    string
+	Action  string
+	Zones   []string
+	Keys    []string
+	Match   string
+	RRtypes []string
+	MinRRs  int `mapstructure:"min-rrs"`
+	MaxRRs  int `mapstructure:"max-rrs"`
+}
+
+// PolicyDecision is the outcome for a single RR in the update section.
+type PolicyDecision struct {
+	RR      dns.RR
+	Rule    string // name of the deciding rule, empty if no rule matched
+	Granted bool
+	Reason  string
+}
+
+type PolicyResult struct {
+	Granted   bool
+	Reason    string
+	Decisions []PolicyDecision
+}
+
+// LoadUpdatePolicy reads the policy from the ddns.policy section of the config.
+// The old ddns.policy.type and ddns.policy.rrtypes settings are still accepted and
+// are turned into a single grant rule when no rules are configured.
+func LoadUpdatePolicy() (*UpdatePolicy, error) {
+	var confrules []PolicyRuleConf
+	if err := viper.UnmarshalKey("ddns.policy.rules", &confrules); err != nil {
+		return nil, fmt.Errorf("error parsing ddns.policy.rules: %v", err)
+	}
+
+	if len(confrules) == 0 {
+		ptype := viper.GetString("ddns.policy.type")
+		if ptype == "" {
+			return nil, fmt.Errorf("no update policy configured")
+		}
+		confrules = append(confrules, PolicyRuleConf{
+			Name:    ptype,
+			Action:  "grant",
+			Match:   ptype,
+			RRtypes: viper.GetStringSlice("ddns.policy.rrtypes"),
+		})
+		if len(confrules[0].RRtypes) == 0 {
+			return nil, fmt.Errorf("zero valid RRtypes listed in policy")
+		}
+	}
+
+	var policy UpdatePolicy
+	for i, cr := range confrules {
+		rule, err := NewPolicyRule(cr)
+		if err != nil {
+			return nil, fmt.Errorf("policy rule %d: %v", i+1, err)
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	return &policy, nil
+}
+
+func NewPolicyRule(cr PolicyRuleConf) (PolicyRule, error) {
+	rule := PolicyRule{
+		Name:    cr.Name,
+		Action:  strings.ToLower(cr.Action),
+		Match:   strings.ToLower(cr.Match),
+		RRtypes: map[uint16]bool{},
+		MinRRs:  cr.MinRRs,
+		MaxRRs:  cr.MaxRRs,
+	}
+
+	switch rule.Action {
+	case "grant", "deny":
+	default:
+		return rule, fmt.Errorf("unknown action: \"%s\"", cr.Action)
+	}
+
+	switch rule.Match {
+	case "self", "selfsub", "subdomain", "glue", "any":
+	case "":
+		rule.Match = "any"
+	default:
+		return rule, fmt.Errorf("unknown match: \"%s\"", cr.Match)
+	}
+
+	for _, zone := range cr.Zones {
+		rule.Zones = append(rule.Zones, dns.CanonicalName(zone))
+	}
+	for _, key := range cr.Keys {
+		rule.Keys = append(rule.Keys, dns.CanonicalName(key))
+	}
+
+	for _, rrstr := range cr.RRtypes {
+		rrt, ok := dns.StringToType[strings.ToUpper(rrstr)]
+		if !ok {
+			return rule, fmt.Errorf("unknown RR type: \"%s\"", rrstr)
+		}
+		rule.RRtypes[rrt] = true
+	}
+	if rule.Match == "glue" && len(rule.RRtypes) == 0 {
+		rule.RRtypes[dns.TypeA] = true
+		rule.RRtypes[dns.TypeAAAA] = true
+	}
+
+	if rule.MinRRs < 0 || rule.MaxRRs < 0 || (rule.MaxRRs > 0 && rule.MinRRs > rule.MaxRRs) {
+		return rule, fmt.Errorf("bad RRset limits: min-rrs %d, max-rrs %d", rule.MinRRs, rule.MaxRRs)
+	}
+	if rule.Name == "" {
+		rule.Name = fmt.Sprintf("%s-%s", rule.Action, rule.Match)
+	}
+	return rule, nil
+}
+
+func (rule *PolicyRule) String() string {
+	var rrtypes []string
+	for rrt := range rule.RRtypes {
+		rrtypes = append(rrtypes, dns.TypeToString[rrt])
+	}
+	return fmt.Sprintf("%s: %s %s %v zones=%v keys=%v", rule.Name, rule.Action, rule.Match,
+		rrtypes, rule.Zones, rule.Keys)
+}
+
+// Evaluate checks all the RRs in the update section against the policy. If zd is
+// non-nil it is used to find the current delegation NS RRset (for glue) and the
+// current RRsets (for the RRset limits). Without it only the contents of the
+// update itself can be taken into account.
+func (policy *UpdatePolicy) Evaluate(zone, signer string, actions []dns.RR, zd *ZoneData) PolicyResult {
+	zone = dns.CanonicalName(zone)
+	signer = dns.CanonicalName(signer)
+	result := PolicyResult{Granted: true}
+
+	deny := func(d PolicyDecision) {
+		if result.Granted {
+			result.Granted = false
+			result.Reason = d.Reason
+		}
+	}
+
+	type rrsetkey struct {
+		owner  string
+		rrtype uint16
+	}
+	limits := map[rrsetkey]*PolicyRule{}
+	var order []rrsetkey
+
+	for _, rr := range actions {
+		d := PolicyDecision{RR: rr}
+		owner := dns.CanonicalName(rr.Header().Name)
+		rrtype := rr.Header().Rrtype
+
+		var rule *PolicyRule
+		for i := range policy.Rules {
+			if policy.Rules[i].Matches(zone, signer, rr, actions, zd) {
+				rule = &policy.Rules[i]
+				break
+			}
+		}
+
+		switch {
+		case rule == nil:
+			d.Reason = fmt.Sprintf("no policy rule matches %s %s from signer %s",
+				owner, dns.TypeToString[rrtype], signer)
+			deny(d)
+		case rule.Action == "deny":
+			d.Rule = rule.Name
+			d.Reason = fmt.Sprintf("%s %s denied by rule %s", owner, dns.TypeToString[rrtype], rule.Name)
+			deny(d)
+		default:
+			d.Rule = rule.Name
+			d.Granted = true
+			if rule.MinRRs > 0 || rule.MaxRRs > 0 {
+				key := rrsetkey{owner: owner, rrtype: rrtype}
+				if _, ok := limits[key]; !ok {
+					order = append(order, key)
+				}
+				limits[key] = rule
+			}
+		}
+		result.Decisions = append(result.Decisions, d)
+	}
+
+	for _, key := range order {
+		rule := limits[key]
+		var current []dns.RR
+		if zd != nil {
+			current = zd.RRset(key.owner, key.rrtype)
+		}
+		n, known := ResultingRRsetSize(current, zd != nil, key.owner, key.rrtype, actions)
+		if rule.MaxRRs > 0 && n > rule.MaxRRs {
+			deny(PolicyDecision{Rule: rule.Name, Reason: fmt.Sprintf("%s %s would have %d RRs, rule %s allows at most %d",
+				key.owner, dns.TypeToString[key.rrtype], n, rule.Name, rule.MaxRRs)})
+		}
+		if known && rule.MinRRs > 0 && n < rule.MinRRs {
+			deny(PolicyDecision{Rule: rule.Name, Reason: fmt.Sprintf("%s %s would have %d RRs, rule %s requires at least %d",
+				key.owner, dns.TypeToString[key.rrtype], n, rule.Name, rule.MinRRs)})
+		}
+	}
+	return result
+}
+
+// Matches returns true if the rule applies to the RR from the update section.
+func (rule *PolicyRule) Matches(zone, signer string, rr dns.RR, actions []dns.RR, zd *ZoneData) bool {
+	if len(rule.Zones) > 0 && !containsName(rule.Zones, zone) {
+		return false
+	}
+	if len(rule.Keys) > 0 && !containsName(rule.Keys, signer) {
+		return false
+	}
+	rrtype := rr.Header().Rrtype
+	if len(rule.RRtypes) > 0 && !rule.RRtypes[rrtype] {
+		return false
+	}
+
+	owner := dns.CanonicalName(rr.Header().Name)
+	switch rule.Match {
+	case "self":
+		return lib.SameName(owner, signer)
+	case "selfsub":
+		return lib.InBailiwick(signer, owner)
+	case "subdomain":
+		return lib.BelowZone(signer, owner)
+	case "glue":
+		if !lib.BelowZone(signer, owner) {
+			return false
+		}
+		if rrtype != dns.TypeA && rrtype != dns.TypeAAAA {
+			return false
+		}
+		return IsNSTarget(owner, signer, actions, zd)
+	case "any":
+		return lib.InBailiwick(zone, owner)
+	}
+	return false
+}
+
+// IsNSTarget returns true if the name is the target of an NS record at the
+// delegation point, either in the zone or added by the update.
+func IsNSTarget(name, delegation string, actions []dns.RR, zd *ZoneData) bool {
+	var nsrrs []dns.RR
+	if zd != nil {
+		nsrrs = append(nsrrs, zd.RRset(delegation, dns.TypeNS)...)
+	}
+	for _, rr := range actions {
+		if rr.Header().Class == dns.ClassINET && lib.SameName(rr.Header().Name, delegation) {
+			nsrrs = append(nsrrs, rr)
+		}
+	}
+	for _, rr := range nsrrs {
+		if ns, ok := rr.(*dns.NS); ok && lib.SameName(ns.Ns, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResultingRRsetSize returns the number of RRs in the RRset after the update has
+// been applied. If the current RRset is not known the size is only known if the
+// update removes the whole RRset, otherwise the number of added RRs is returned
+// as a lower bound.
+func ResultingRRsetSize(current []dns.RR, known bool, owner string, rrtype uint16, actions []dns.RR) (int, bool) {
+	rrset := make([]dns.RR, len(current))
+	copy(rrset, current)
+
+	// removes are applied before adds, just like in ApplyUpdate
+	for _, rr := range actions {
+		h := rr.Header()
+		if !lib.SameName(h.Name, owner) || (h.Rrtype != rrtype && h.Rrtype != dns.TypeANY) {
+			continue
+		}
+		switch h.Class {
+		case dns.ClassANY:
+			rrset = nil
+			known = true
+		case dns.ClassNONE:
+			cp := dns.Copy(rr)
+			cp.Header().Class = dns.ClassINET
+			for i, orr := range rrset {
+				if dns.IsDuplicate(orr, cp) {
+					rrset = append(rrset[:i], rrset[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	for _, rr := range actions {
+		h := rr.Header()
+		if h.Class != dns.ClassINET || !lib.SameName(h.Name, owner) || h.Rrtype != rrtype {
+			continue
+		}
+		dup := false
+		for _, orr := range rrset {
+			if dns.IsDuplicate(orr, rr) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			rrset = append(rrset, rr)
+		}
+	}
+	return len(rrset), known
+}
+
+func containsName(list []string, s string) bool {
+	for _, l := range list {
+		if lib.SameName(l, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// LogPolicy prints the rules in the policy.
+func (policy *UpdatePolicy) LogPolicy() {
+	for i, rule := range policy.Rules {
+		log.Printf("UpdatePolicy: rule %d: %s (min-rrs %d, max-rrs %d)", i+1, rule.String(),
+			rule.MinRRs, rule.MaxRRs)
+	}
+}
@@ -0,0 +1,200 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func removeRRset(name string, rrtype uint16) dns.RR {
+	return &dns.ANY{Hdr: dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassANY}}
+}
+
+func testPolicy(t *testing.T, confs ...PolicyRuleConf) *UpdatePolicy {
+	t.Helper()
+	var policy UpdatePolicy
+	for _, cr := range confs {
+		rule, err := NewPolicyRule(cr)
+		if err != nil {
+			t.Fatalf("NewPolicyRule(%+v): %v", cr, err)
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	return &policy
+}
+
+func TestSelfsubMatch(t *testing.T) {
+	policy := testPolicy(t, PolicyRuleConf{Action: "grant", Match: "selfsub"})
+
+	tests := []struct {
+		signer, owner string
+		granted       bool
+	}{
+		{"child.parent.example.", "child.parent.example.", true},
+		{"child.parent.example.", "ns1.child.parent.example.", true},
+		{"child.parent.example.", "evilchild.parent.example.", false},
+		{"child.parent.example.", "ns1.evilchild.parent.example.", false},
+		{"child.parent.example.", "parent.example.", false},
+		{"Child.Parent.Example.", "NS1.child.PARENT.example.", true},
+		{"child.parent.example.", "ns1\\.child.parent.example.", false},
+		{"ch\\105ld.parent.example.", "ns1.CHILD.parent.example.", true},
+		{"xn--bcher-kva.parent.example.", "ns1.XN--BCHER-KVA.parent.example.", true},
+		{"cher-kva.parent.example.", "xn--bcher-kva.parent.example.", false},
+	}
+
+	for _, tt := range tests {
+		rr := mustRR(t, tt.owner+" 3600 IN A 192.0.2.1")
+		pr := policy.Evaluate("parent.example.", tt.signer, []dns.RR{rr}, nil)
+		if pr.Granted != tt.granted {
+			t.Errorf("signer %s, owner %s: granted = %v, want %v (%s)", tt.signer, tt.owner,
+				pr.Granted, tt.granted, pr.Reason)
+		}
+	}
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	policy := testPolicy(t,
+		PolicyRuleConf{Name: "no-other-zone", Action: "deny", Zones: []string{"other.example."}},
+		PolicyRuleConf{Name: "delegation", Action: "grant", Match: "self",
+			RRtypes: []string{"NS"}, MinRRs: 1, MaxRRs: 3},
+		PolicyRuleConf{Name: "ds", Action: "grant", Match: "self", RRtypes: []string{"DS"}},
+		PolicyRuleConf{Name: "glue", Action: "grant", Match: "glue"},
+		PolicyRuleConf{Name: "trusted", Action: "grant", Match: "any", Keys: []string{"admin.parent.example."}},
+	)
+
+	const signer = "child.parent.example."
+
+	tests := []struct {
+		name    string
+		zone    string
+		signer  string
+		actions []string
+		remove  []string // names for removal of the NS RRset
+		granted bool
+	}{
+		{
+			name:    "ns at delegation",
+			actions: []string{"child.parent.example. 3600 IN NS ns1.child.parent.example."},
+			granted: true,
+		},
+		{
+			name: "ns and in-bailiwick glue",
+			actions: []string{
+				"child.parent.example. 3600 IN NS ns1.child.parent.example.",
+				"ns1.child.parent.example. 3600 IN A 192.0.2.1",
+				"ns1.child.parent.example. 3600 IN AAAA 2001:db8::1",
+			},
+			granted: true,
+		},
+		{
+			name:    "glue that is not an NS target",
+			actions: []string{"www.child.parent.example. 3600 IN A 192.0.2.1"},
+			granted: false,
+		},
+		{
+			name: "glue for a name in another bailiwick",
+			actions: []string{
+				"child.parent.example. 3600 IN NS ns1.other.parent.example.",
+				"ns1.other.parent.example. 3600 IN A 192.0.2.1",
+			},
+			granted: false,
+		},
+		{
+			name:    "ns below the delegation point",
+			actions: []string{"sub.child.parent.example. 3600 IN NS ns1.example.net."},
+			granted: false,
+		},
+		{
+			name:    "ds at another delegation",
+			actions: []string{"other.parent.example. 3600 IN DS 12345 13 2 AABBCCDD"},
+			granted: false,
+		},
+		{
+			name: "too many ns",
+			actions: []string{
+				"child.parent.example. 3600 IN NS ns1.example.net.",
+				"child.parent.example. 3600 IN NS ns2.example.net.",
+				"child.parent.example. 3600 IN NS ns3.example.net.",
+				"child.parent.example. 3600 IN NS ns4.example.net.",
+			},
+			granted: false,
+		},
+		{
+			name:    "remove all ns",
+			remove:  []string{"child.parent.example."},
+			granted: false,
+		},
+		{
+			name:    "replace all ns",
+			remove:  []string{"child.parent.example."},
+			actions: []string{"child.parent.example. 3600 IN NS ns1.example.net."},
+			granted: true,
+		},
+		{
+			name:    "rule for another zone",
+			zone:    "other.example.",
+			actions: []string{"child.other.example. 3600 IN NS ns1.example.net."},
+			signer:  "child.other.example.",
+			granted: false,
+		},
+		{
+			name:    "per-key rule",
+			signer:  "ADMIN.parent.example.",
+			actions: []string{"www.parent.example. 3600 IN A 192.0.2.1"},
+			granted: true,
+		},
+	}
+
+	for _, tt := range tests {
+		zone := tt.zone
+		if zone == "" {
+			zone = "parent.example."
+		}
+		s := tt.signer
+		if s == "" {
+			s = signer
+		}
+		var actions []dns.RR
+		for _, name := range tt.remove {
+			actions = append(actions, removeRRset(name, dns.TypeNS))
+		}
+		for _, a := range tt.actions {
+			actions = append(actions, mustRR(t, a))
+		}
+
+		pr := policy.Evaluate(zone, s, actions, nil)
+		if pr.Granted != tt.granted {
+			t.Errorf("%s: granted = %v, want %v (%s)", tt.name, pr.Granted, tt.granted, pr.Reason)
+		}
+	}
+}
+
+func TestPolicyMinRRsWithZone(t *testing.T) {
+	policy := testPolicy(t, PolicyRuleConf{Name: "delegation", Action: "grant", Match: "self",
+		RRtypes: []string{"NS"}, MinRRs: 1})
+
+	zd := &ZoneData{ZoneName: "parent.example.", Owners: map[string]map[uint16][]dns.RR{}}
+	zd.addRR(mustRR(t, "child.parent.example. 3600 IN NS ns1.example.net."))
+	zd.addRR(mustRR(t, "child.parent.example. 3600 IN NS ns2.example.net."))
+
+	remove := func(s string) dns.RR {
+		rr := mustRR(t, s)
+		rr.Header().Class = dns.ClassNONE
+		rr.Header().Ttl = 0
+		return rr
+	}
+
+	one := []dns.RR{remove("child.parent.example. 3600 IN NS ns1.example.net.")}
+	if pr := policy.Evaluate("parent.example.", "child.parent.example.", one, zd); !pr.Granted {
+		t.Errorf("removing one of two NS: denied (%s)", pr.Reason)
+	}
+
+	both := append(one, remove("child.parent.example. 3600 IN NS ns2.example.net."))
+	if pr := policy.Evaluate("parent.example.", "child.parent.example.", both, zd); pr.Granted {
+		t.Errorf("removing both NS: granted")
+	}
+}
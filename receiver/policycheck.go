@@ -0,0 +1,192 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// PolicyCheck is the "receiver policy-check" dry-run command. It evaluates the
+// update in a file against the configured update policy, without validating any
+// signature and without changing anything. Returns the exit status: 0 if the
+// update would be approved, 1 if it would be refused and 2 on errors.
+func PolicyCheck(args []string) int {
+	fs := flag.NewFlagSet("policy-check", flag.ContinueOnError)
+	signer := fs.String("signer", "", "name of the key that would sign the update (the child zone)")
+	zone := fs.String("zone", viper.GetString("parent.zone"), "parent zone (unless set in the update file)")
+	nozone := fs.Bool("nozone", false, "do not use the parent zone file to evaluate the update")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: receiver policy-check -signer name [-zone name] [-nozone] updatefile\n\n")
+		fmt.Fprintf(fs.Output(), "The update file uses nsupdate syntax: \"zone\", \"update add\" and \"update delete\".\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 || *signer == "" {
+		fs.Usage()
+		return 2
+	}
+
+	policy, err := LoadUpdatePolicy()
+	if err != nil {
+		log.Printf("Error loading update policy: %v", err)
+		return 2
+	}
+
+	filezone, actions, err := ReadUpdateFile(fs.Arg(0))
+	if err != nil {
+		log.Printf("Error reading update file %s: %v", fs.Arg(0), err)
+		return 2
+	}
+	if filezone != "" {
+		*zone = filezone
+	}
+	if *zone == "" {
+		log.Printf("Error: parent zone not specified")
+		return 2
+	}
+
+	var zd *ZoneData
+	if !*nozone {
+		zd = LoadParentZone()
+		if zd != nil && zd.ZoneName != dns.CanonicalName(*zone) {
+			zd = nil // the zone file is for another zone
+		}
+	}
+
+	pr := policy.Evaluate(*zone, *signer, actions, zd)
+
+	fmt.Printf("Update for zone %s signed by %s, %d RRs in the update section", dns.Fqdn(*zone),
+		dns.Fqdn(*signer), len(actions))
+	if zd == nil {
+		fmt.Printf(" (evaluated without zone data)")
+	}
+	fmt.Printf(":\n")
+	for _, d := range pr.Decisions {
+		verdict := "GRANT"
+		if !d.Granted {
+			verdict = "DENY "
+		}
+		rule := d.Rule
+		if rule == "" {
+			rule = "(no matching rule)"
+		}
+		fmt.Printf("%s %-20s %s\n", verdict, rule, d.RR.String())
+	}
+
+	if !pr.Granted {
+		fmt.Printf("Update would be REFUSED: %s\n", pr.Reason)
+		return 1
+	}
+	fmt.Printf("Update would be approved\n")
+	return 0
+}
+
+// ReadUpdateFile reads an update in (a subset of) nsupdate syntax:
+//
+//	zone parent.example.
+//	update add child.parent.example. 3600 IN NS ns1.child.parent.example.
+//	update delete child.parent.example. NS ns2.child.parent.example.
+//	update delete child.parent.example. NS
+//	update delete child.parent.example.
+//	send
+//
+// Returns the zone (if given) and the update section.
+func ReadUpdateFile(filename string) (string, []dns.RR, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	var zone string
+	var actions []dns.RR
+
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		cmd := strings.ToLower(fields[0])
+		if cmd == "update" && len(fields) > 1 {
+			fields = fields[1:]
+			cmd = strings.ToLower(fields[0])
+		}
+
+		switch cmd {
+		case "zone":
+			if len(fields) != 2 {
+				return "", nil, fmt.Errorf("line %d: zone requires exactly one name", lineno)
+			}
+			zone = dns.Fqdn(fields[1])
+
+		case "add":
+			rr, err := dns.NewRR(strings.Join(fields[1:], " "))
+			if err != nil || rr == nil {
+				return "", nil, fmt.Errorf("line %d: bad RR: %v", lineno, err)
+			}
+			actions = append(actions, rr)
+
+		case "del", "delete":
+			rr, err := deleteRR(fields[1:])
+			if err != nil {
+				return "", nil, fmt.Errorf("line %d: %v", lineno, err)
+			}
+			actions = append(actions, rr)
+
+		case "prereq", "send", "show", "answer":
+			// prerequisites are not part of the policy, the rest are nsupdate commands
+		default:
+			return "", nil, fmt.Errorf("line %d: unknown command \"%s\"", lineno, fields[0])
+		}
+	}
+	return zone, actions, scanner.Err()
+}
+
+// deleteRR builds the update section RR for "delete name [type [rdata]]".
+func deleteRR(fields []string) (dns.RR, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("delete requires a name")
+	}
+	name := dns.Fqdn(fields[0])
+	fields = fields[1:]
+	if len(fields) > 0 && strings.EqualFold(fields[0], "IN") {
+		fields = fields[1:]
+	}
+
+	if len(fields) == 0 {
+		// delete all RRsets at the name
+		return &dns.ANY{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeANY, Class: dns.ClassANY}}, nil
+	}
+	rrtype, ok := dns.StringToType[strings.ToUpper(fields[0])]
+	if !ok {
+		return nil, fmt.Errorf("unknown RR type: \"%s\"", fields[0])
+	}
+	if len(fields) == 1 {
+		// delete the RRset
+		return &dns.ANY{Hdr: dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassANY}}, nil
+	}
+
+	// delete a single RR
+	rr, err := dns.NewRR(fmt.Sprintf("%s 0 IN %s", name, strings.Join(fields, " ")))
+	if err != nil || rr == nil {
+		return nil, fmt.Errorf("bad RR: %v", err)
+	}
+	rr.Header().Class = dns.ClassNONE
+	return rr, nil
+}
@@ -0,0 +1,103 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/miekg/dns"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+// CheckPrerequisites evaluates the prerequisite section of an UPDATE against
+// the zone, according to RFC 2136 section 3.2. Returns NOERROR if all the
+// prerequisites are satisfied, otherwise the rcode to respond with.
+func (zd *ZoneData) CheckPrerequisites(prereqs []dns.RR) (int, error) {
+	// value-dependent "RRset exists" prerequisites are collected and compared
+	// as complete RRsets once all of them have been seen
+	type rrsetkey struct {
+		owner  string
+		rrtype uint16
+	}
+	valuedep := map[rrsetkey][]dns.RR{}
+	var order []rrsetkey
+
+	for _, rr := range prereqs {
+		h := rr.Header()
+		owner := dns.CanonicalName(h.Name)
+
+		if h.Ttl != 0 {
+			return dns.RcodeFormatError, fmt.Errorf("prerequisite with non-zero TTL: %s", rr.String())
+		}
+		if !dns.IsSubDomain(zd.ZoneName, owner) {
+			return dns.RcodeNotZone, fmt.Errorf("prerequisite %s is outside zone %s", owner, zd.ZoneName)
+		}
+
+		if (h.Class == dns.ClassANY || h.Class == dns.ClassNONE) && h.Rdlength != 0 {
+			return dns.RcodeFormatError, fmt.Errorf("prerequisite with class %s and rdata: %s",
+				dns.ClassToString[h.Class], rr.String())
+		}
+
+		switch h.Class {
+		case dns.ClassANY:
+			if h.Rrtype == dns.TypeANY {
+				// name is in use
+				if !zd.NameInUse(owner) {
+					return dns.RcodeNameError, fmt.Errorf("name %s is not in use", owner)
+				}
+			} else if len(zd.RRset(owner, h.Rrtype)) == 0 {
+				// RRset exists (value independent)
+				return dns.RcodeNXRrset, fmt.Errorf("RRset %s %s does not exist",
+					owner, dns.TypeToString[h.Rrtype])
+			}
+
+		case dns.ClassNONE:
+			if h.Rrtype == dns.TypeANY {
+				// name is not in use
+				if zd.NameInUse(owner) {
+					return dns.RcodeYXDomain, fmt.Errorf("name %s is in use", owner)
+				}
+			} else if len(zd.RRset(owner, h.Rrtype)) != 0 {
+				// RRset does not exist
+				return dns.RcodeYXRrset, fmt.Errorf("RRset %s %s exists",
+					owner, dns.TypeToString[h.Rrtype])
+			}
+
+		case dns.ClassINET:
+			// RRset exists (value dependent)
+			key := rrsetkey{owner: owner, rrtype: h.Rrtype}
+			if _, ok := valuedep[key]; !ok {
+				order = append(order, key)
+			}
+			valuedep[key] = append(valuedep[key], rr)
+
+		default:
+			return dns.RcodeFormatError, fmt.Errorf("prerequisite with unknown class: %s", rr.String())
+		}
+	}
+
+	for _, key := range order {
+		differ, _, _ := lib.RRsetDiffer(key.owner, valuedep[key], zd.RRset(key.owner, key.rrtype),
+			key.rrtype, log.Default())
+		if differ {
+			return dns.RcodeNXRrset, fmt.Errorf("RRset %s %s differs from the prerequisite",
+				key.owner, dns.TypeToString[key.rrtype])
+		}
+	}
+	return dns.RcodeSuccess, nil
+}
+
+// NameInUse returns true if there is at least one RRset at the name.
+func (zd *ZoneData) NameInUse(owner string) bool {
+	zd.mu.RLock()
+	defer zd.mu.RUnlock()
+	owner = dns.CanonicalName(owner)
+	if owner == zd.ZoneName {
+		return true // there is always an SOA at the apex
+	}
+	return len(zd.Owners[owner]) > 0
+}
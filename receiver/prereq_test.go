@@ -0,0 +1,109 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// wirePrereqs returns the prerequisite section of an update for parent.example.
+// as received from the wire.
+func wirePrereqs(t *testing.T, add func(m *dns.Msg)) []dns.RR {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetUpdate("parent.example.")
+	add(m)
+	buf, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	return m.Answer
+}
+
+func TestCheckPrerequisites(t *testing.T) {
+	child := "child.parent.example."
+	rrs := func(ss ...string) []dns.RR {
+		var res []dns.RR
+		for _, s := range ss {
+			res = append(res, mustRR(t, s))
+		}
+		return res
+	}
+	ns1 := "child.parent.example. 3600 IN NS ns1.example.net."
+	ns2 := "child.parent.example. 3600 IN NS ns2.example.net."
+	ns3 := "child.parent.example. 3600 IN NS ns3.example.net."
+	ds := "child.parent.example. 3600 IN DS 12345 13 2 0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF"
+	unused := "nothere.parent.example. 3600 IN A 192.0.2.1"
+
+	tests := []struct {
+		name  string
+		add   func(m *dns.Msg)
+		rcode int
+	}{
+		{"no prerequisites", func(m *dns.Msg) {}, dns.RcodeSuccess},
+
+		{"name is in use", func(m *dns.Msg) { m.NameUsed(rrs(ns1)) }, dns.RcodeSuccess},
+		{"apex name is in use", func(m *dns.Msg) { m.NameUsed(rrs("parent.example. 3600 IN A 192.0.2.1")) },
+			dns.RcodeSuccess},
+		{"name is not in use, but should be", func(m *dns.Msg) { m.NameUsed(rrs(unused)) }, dns.RcodeNameError},
+
+		{"RRset exists", func(m *dns.Msg) { m.RRsetUsed(rrs(ns1)) }, dns.RcodeSuccess},
+		{"RRset does not exist, but should", func(m *dns.Msg) { m.RRsetUsed(rrs(ds)) }, dns.RcodeNXRrset},
+
+		{"name is not in use", func(m *dns.Msg) { m.NameNotUsed(rrs(unused)) }, dns.RcodeSuccess},
+		{"name is in use, but should not be", func(m *dns.Msg) { m.NameNotUsed(rrs(ns1)) }, dns.RcodeYXDomain},
+
+		{"RRset does not exist", func(m *dns.Msg) { m.RRsetNotUsed(rrs(ds)) }, dns.RcodeSuccess},
+		{"RRset exists, but should not", func(m *dns.Msg) { m.RRsetNotUsed(rrs(ns1)) }, dns.RcodeYXRrset},
+
+		{"value dependent RRset", func(m *dns.Msg) { m.Used(rrs(ns1, ns2)) }, dns.RcodeSuccess},
+		{"value dependent RRset in another order", func(m *dns.Msg) { m.Used(rrs(ns2, ns1)) }, dns.RcodeSuccess},
+		{"value dependent RRset with one RR missing", func(m *dns.Msg) { m.Used(rrs(ns1)) }, dns.RcodeNXRrset},
+		{"value dependent RRset with an extra RR", func(m *dns.Msg) { m.Used(rrs(ns1, ns2, ns3)) }, dns.RcodeNXRrset},
+		{"value dependent RRset that does not exist", func(m *dns.Msg) { m.Used(rrs(ds)) }, dns.RcodeNXRrset},
+
+		{"outside the zone", func(m *dns.Msg) { m.RRsetUsed(rrs("child.other.example. 3600 IN NS ns1.example.net.")) },
+			dns.RcodeNotZone},
+		{"non-zero TTL", func(m *dns.Msg) {
+			m.Used(rrs(ns1, ns2))
+			m.Answer[0].Header().Ttl = 3600
+		}, dns.RcodeFormatError},
+		{"class ANY with rdata", func(m *dns.Msg) {
+			rr := mustRR(t, ns1)
+			rr.Header().Class, rr.Header().Ttl = dns.ClassANY, 0
+			m.Answer = append(m.Answer, rr)
+		}, dns.RcodeFormatError},
+		{"class NONE with rdata", func(m *dns.Msg) {
+			rr := mustRR(t, ds)
+			rr.Header().Class, rr.Header().Ttl = dns.ClassNONE, 0
+			m.Answer = append(m.Answer, rr)
+		}, dns.RcodeFormatError},
+		{"unknown class", func(m *dns.Msg) {
+			rr := mustRR(t, ns1)
+			rr.Header().Class, rr.Header().Ttl = dns.ClassCHAOS, 0
+			m.Answer = append(m.Answer, rr)
+		}, dns.RcodeFormatError},
+	}
+
+	zd := testZone(t)
+	for _, tt := range tests {
+		rcode, err := zd.CheckPrerequisites(wirePrereqs(t, tt.add))
+		if rcode != tt.rcode {
+			t.Errorf("%s: rcode %s (%v), want %s", tt.name, dns.RcodeToString[rcode], err,
+				dns.RcodeToString[tt.rcode])
+		}
+		if (err != nil) != (tt.rcode != dns.RcodeSuccess) {
+			t.Errorf("%s: rcode %s with error %v", tt.name, dns.RcodeToString[rcode], err)
+		}
+	}
+	if len(zd.Owners[child][dns.TypeNS]) != 2 {
+		t.Errorf("CheckPrerequisites modified the zone")
+	}
+}
@@ -5,29 +5,160 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"math/rand"
+	"net"
 	"sync"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/spf13/viper"
+
+	lib "github.com/johanix/gen-notify-test/lib"
 )
 
 type ScanRequest struct {
 	Cmd		string
 	ZoneName	string
 	RRtype		string
+	Authenticated	bool // from a NOTIFY signed by the child
+}
+
+type Scanner struct {
+	ParentZone	string
+	ParentPrimary	string	// address:port to look up the current delegation in
+	UpdateQ		chan UpdateRequest
+	KeyDB		*KeyDB
+	Verbose		bool
+	Debug		bool
+	CsyncSerials	map[string]uint32 // last processed CSYNC serial per child
+	mu		sync.Mutex
+}
+
+func NewScanner(updateq chan UpdateRequest, kdb *KeyDB) *Scanner {
+	scanner := Scanner{
+		ParentZone:	dns.Fqdn(viper.GetString("parent.zone")),
+		ParentPrimary:	viper.GetString("parent.primary"),
+		UpdateQ:	updateq,
+		KeyDB:		kdb,
+		CsyncSerials:	map[string]uint32{},
+		Verbose:	viper.GetBool("scanner.verbose"),
+		Debug:		viper.GetBool("scanner.debug"),
+	}
+	if scanner.ParentZone == "." {
+		log.Fatalf("Error: parent zone not specified in config.")
+	}
+	if scanner.ParentPrimary == "" {
+		log.Fatalf("Error: parent primary nameserver not specified in config.")
+	}
+	return &scanner
+}
+
+// ScanJob is one unit of work for the scanner workers.
+type ScanJob struct {
+	ZoneName string
+	RRtype   string
+	Notified bool // triggered by a NOTIFY, not by the periodic scan
+}
+
+// ScanQueue is the list of pending scan jobs. Periodic scans are added at the
+// end, while notifications move the job for that zone to the front. The same
+// zone and RRtype is never queued twice.
+type ScanQueue struct {
+	jobs    []ScanJob
+	pending map[string]bool
+	mu      sync.Mutex
+	cond    *sync.Cond
+}
+
+func NewScanQueue() *ScanQueue {
+	q := ScanQueue{pending: map[string]bool{}}
+	q.cond = sync.NewCond(&q.mu)
+	return &q
+}
+
+func (q *ScanQueue) Push(job ScanJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	key := job.ZoneName + "/" + job.RRtype
+	if q.pending[key] {
+		return
+	}
+	q.pending[key] = true
+	q.jobs = append(q.jobs, job)
+	q.cond.Signal()
+}
+
+func (q *ScanQueue) PushFront(job ScanJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	key := job.ZoneName + "/" + job.RRtype
+	if q.pending[key] {
+		for i, j := range q.jobs {
+			if j.ZoneName == job.ZoneName && j.RRtype == job.RRtype {
+				q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+				break
+			}
+		}
+	}
+	q.pending[key] = true
+	q.jobs = append([]ScanJob{job}, q.jobs...)
+	q.cond.Signal()
+}
+
+// PushLater pushes the job after a random delay of up to jitter, so that the
+// periodic scan does not hit all the child nameservers at once. The workers are
+// not held up by the delay.
+func (q *ScanQueue) PushLater(job ScanJob, jitter time.Duration) {
+	if jitter <= 0 {
+		q.Push(job)
+		return
+	}
+	time.AfterFunc(time.Duration(rand.Int63n(int64(jitter))), func() { q.Push(job) })
+}
+
+// Pop blocks until there is a job in the queue.
+func (q *ScanQueue) Pop() ScanJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.jobs) == 0 {
+		q.cond.Wait()
+	}
+	job := q.jobs[0]
+	q.jobs = q.jobs[1:]
+	delete(q.pending, job.ZoneName+"/"+job.RRtype)
+	return job
 }
 
-func ScannerEngine(scannerq chan ScanRequest, updateq chan UpdateRequest) error {
+func ScannerEngine(scannerq chan ScanRequest, updateq chan UpdateRequest, kdb *KeyDB) error {
 	interval := viper.GetInt("scanner.interval")
 	if interval < 10 {
 		interval = 10
 	}
 	ticker := time.NewTicker(time.Duration(interval) * time.Second)
 
+	workers := viper.GetInt("scanner.workers")
+	if workers < 1 {
+		workers = 1
+	}
+	jitter := time.Duration(viper.GetInt("scanner.jitter")) * time.Second
+
+	scanner := NewScanner(updateq, kdb)
+
+	inventory := NewInventory(scanner.ParentZone, kdb)
+	if err := inventory.Load(); err != nil {
+		log.Printf("Scanner: Error loading child zone inventory: %v", err)
+	}
+
+	queue := NewScanQueue()
+	for i := 0; i < workers; i++ {
+		go scanner.Worker(queue)
+	}
+
 	var sr ScanRequest
 
-	log.Printf("Scanner: starting")
+	log.Printf("Scanner: starting with %d workers", workers)
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
@@ -35,25 +166,45 @@ func ScannerEngine(scannerq chan ScanRequest, updateq chan UpdateRequest) error
 			select {
 			case <-ticker.C:
 				log.Printf("Time for periodic scan of all zones.")
-				// cds_scanner("")
-				// csync_scanner("")
+				if err := inventory.Load(); err != nil {
+					log.Printf("Scanner: Error reloading child zone inventory: %v. Using old inventory.", err)
+				}
+				for _, zone := range inventory.Children() {
+					queue.PushLater(ScanJob{ZoneName: zone, RRtype: "CDS"}, jitter)
+					queue.PushLater(ScanJob{ZoneName: zone, RRtype: "CSYNC"}, jitter)
+				}
+				pending, err := kdb.PendingChildren(scanner.ParentZone)
+				if err != nil {
+					log.Printf("Scanner: Error looking up children with pending keys: %v", err)
+				}
+				for _, zone := range pending {
+					queue.PushLater(ScanJob{ZoneName: zone, RRtype: "KEY"}, jitter)
+				}
 
 			case sr = <-scannerq:
 				switch sr.Cmd {
 				case "SCAN":
 					if sr.ZoneName == "" {
 						log.Printf("Scanner: Request for manual %s scan.", sr.RRtype)
-						// scanner.Run(sr.RRtype)
+						for _, zone := range inventory.Children() {
+							queue.Push(ScanJob{ZoneName: zone, RRtype: sr.RRtype})
+						}
 					} else {
-						log.Printf("Scanner: Request for immediate scan of zone %s for RRtype %s",
-							sr.ZoneName, sr.RRtype)
-						switch sr.RRtype {
-						case "CDS":
-							// go cds_scanner(sr.ZoneName)
-						case "CSYNC":
-							// go csync_scanner(sr.ZoneName)
-						case "DNSKEY":
-							// go dnskey_scanner(sr.ZoneName)
+						// Bootstrapping children may not be in the inventory yet.
+						if sr.RRtype != "KEY" && !inventory.Known(sr.ZoneName) {
+							log.Printf("Scanner: Zone %s is not a known child of %s. Ignoring.",
+								sr.ZoneName, scanner.ParentZone)
+							continue
+						}
+						job := ScanJob{ZoneName: sr.ZoneName, RRtype: sr.RRtype, Notified: true}
+						if sr.Authenticated {
+							log.Printf("Scanner: Request for immediate scan of zone %s for RRtype %s",
+								sr.ZoneName, sr.RRtype)
+							queue.PushFront(job)
+						} else {
+							log.Printf("Scanner: Request for unauthenticated scan of zone %s for RRtype %s",
+								sr.ZoneName, sr.RRtype)
+							queue.Push(job)
 						}
 					}
 				default:
@@ -68,3 +219,105 @@ func ScannerEngine(scannerq chan ScanRequest, updateq chan UpdateRequest) error
 	return nil
 }
 
+// Worker runs scan jobs from the queue, one at a time.
+func (scanner *Scanner) Worker(queue *ScanQueue) {
+	for {
+		job := queue.Pop()
+
+		switch job.RRtype {
+		case "CDS":
+			scanner.CdsScanner(job.ZoneName)
+		case "CSYNC":
+			scanner.CsyncScanner(job.ZoneName)
+		case "KEY":
+			scanner.KeyBootstrapScanner(job.ZoneName)
+		case "DNSKEY":
+			// dnskey_scanner(job.ZoneName)
+		default:
+			log.Printf("Scanner: no scanner for RRtype %s. Ignoring.", job.RRtype)
+		}
+	}
+}
+
+// ChildNameservers returns the addresses (as address:port) of all the nameservers
+// that the parent delegates the child zone to.
+func (scanner *Scanner) ChildNameservers(zone string) ([]string, error) {
+	var addrs []string
+
+	nsrrs, _, err := lib.AuthQueryNG(zone, scanner.ParentPrimary, dns.TypeNS)
+	if err != nil {
+		return addrs, err
+	}
+	if len(nsrrs) == 0 {
+		return addrs, fmt.Errorf("zone %s is not delegated from %s", zone, scanner.ParentZone)
+	}
+
+	for _, rr := range nsrrs {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		nsaddrs, err := net.LookupHost(ns.Ns)
+		if err != nil {
+			log.Printf("ChildNameservers: Error looking up addresses for %s: %v", ns.Ns, err)
+			continue
+		}
+		for _, a := range nsaddrs {
+			addrs = append(addrs, net.JoinHostPort(a, "53"))
+		}
+	}
+	if len(addrs) == 0 {
+		return addrs, fmt.Errorf("no addresses found for any nameserver for zone %s", zone)
+	}
+	return addrs, nil
+}
+
+// QueryAllNS sends the same query to all the nameservers and requires that they
+// all return the same RRset. The RRSIGs from the first nameserver are returned.
+func (scanner *Scanner) QueryAllNS(qname string, nameservers []string, rrtype uint16) ([]dns.RR, []*dns.RRSIG, error) {
+	var rrset []dns.RR
+	var sigs []*dns.RRSIG
+
+	for i, ns := range nameservers {
+		rrs, rrsigs, err := lib.AuthQueryNG(qname, ns, rrtype)
+		if err != nil {
+			return rrset, sigs, err
+		}
+		if i == 0 {
+			rrset, sigs = rrs, rrsigs
+			continue
+		}
+		if differ, _, _ := lib.RRsetDiffer(qname, rrs, rrset, rrtype, log.Default()); differ {
+			return rrset, sigs, fmt.Errorf("%s %s RRset from %s differs from the one from %s",
+				qname, dns.TypeToString[rrtype], ns, nameservers[0])
+		}
+	}
+	return rrset, sigs, nil
+}
+
+// QueueUpdate turns a set of adds and removes into an UPDATE for the parent zone
+// and hands it over to the UpdaterEngine.
+func (scanner *Scanner) QueueUpdate(adds, removes []dns.RR) {
+	scanner.UpdateQ <- scanner.updateRequest(adds, removes)
+}
+
+// SubmitUpdate is like QueueUpdate, but waits for the UpdaterEngine to apply
+// the update and returns the outcome.
+func (scanner *Scanner) SubmitUpdate(adds, removes []dns.RR) UpdateResult {
+	return scanner.updateRequest(adds, removes).Submit(scanner.UpdateQ)
+}
+
+func (scanner *Scanner) updateRequest(adds, removes []dns.RR) UpdateRequest {
+	m := new(dns.Msg)
+	m.SetUpdate(scanner.ParentZone)
+	m.Remove(removes)
+	m.Insert(adds)
+
+	return UpdateRequest{
+		Cmd:      "UPDATE",
+		ZoneName: scanner.ParentZone,
+		Adds:     adds,
+		Removes:  removes,
+		Actions:  m.Ns,
+	}
+}
@@ -0,0 +1,28 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScanQueuePushLater(t *testing.T) {
+	q := NewScanQueue()
+	q.PushLater(ScanJob{ZoneName: "a.parent.example.", RRtype: "CDS"}, 200*time.Millisecond)
+	q.PushFront(ScanJob{ZoneName: "b.parent.example.", RRtype: "CDS", Notified: true})
+
+	// the notified job is not held up by the jitter of the periodic one
+	start := time.Now()
+	if job := q.Pop(); job.ZoneName != "b.parent.example." {
+		t.Errorf("got job for %s, want b.parent.example.", job.ZoneName)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("notified job waited %v", d)
+	}
+	if job := q.Pop(); job.ZoneName != "a.parent.example." {
+		t.Errorf("got job for %s, want a.parent.example.", job.ZoneName)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+// TSIG is an alternative to SIG(0) for children (or their operators) that share
+// a secret with the parent. The TSIG key name is the signer name when the update
+// is checked against the policy, so a key named after the child zone gives the
+// same rights as a SIG(0) key for the child.
+
+type TsigKeyConf struct {
+	Name      string
+	Algorithm string
+	Secret    string
+}
+
+// LoadTsigKeys reads the keys in ddns.tsig.keys, indexed on (canonical) key name.
+func LoadTsigKeys() (map[string]*lib.TsigKey, error) {
+	var confkeys []TsigKeyConf
+	if err := viper.UnmarshalKey("ddns.tsig.keys", &confkeys); err != nil {
+		return nil, fmt.Errorf("error parsing ddns.tsig.keys: %v", err)
+	}
+
+	tsigkeys := map[string]*lib.TsigKey{}
+	for _, ck := range confkeys {
+		key, err := lib.NewTsigKey(ck.Name, ck.Algorithm, ck.Secret)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := tsigkeys[key.Name]; exists {
+			return nil, fmt.Errorf("TSIG key %s is configured twice", key.Name)
+		}
+		tsigkeys[key.Name] = key
+	}
+	return tsigkeys, nil
+}
+
+// TsigSecrets returns the keys in the form used for dns.Server.TsigSecret. The
+// map is never nil, as then the server would not verify TSIG signatures at all.
+func TsigSecrets(tsigkeys map[string]*lib.TsigKey) map[string]string {
+	secrets := map[string]string{}
+	for name, key := range tsigkeys {
+		secrets[name] = key.Secret
+	}
+	return secrets
+}
+
+// ValidateTsig checks the TSIG on the update. The MAC (and the time) has already
+// been verified by the dns.Server, status is the outcome (from w.TsigStatus()).
+func ValidateTsig(r *dns.Msg, status error, tsigkeys map[string]*lib.TsigKey) ValidationResult {
+	t := r.IsTsig()
+	if t == nil {
+		return ValidationResult{Rcode: dns.RcodeFormatError} // there is no TSIG on the update
+	}
+	keyname := dns.CanonicalName(t.Hdr.Name)
+	log.Printf("* Update is signed by TSIG key \"%s\" (algorithm %s).", keyname, t.Algorithm)
+
+	key, ok := tsigkeys[keyname]
+	if !ok || status == dns.ErrSecret {
+		log.Printf("= Error: TSIG key \"%s\" is unknown.", keyname)
+		return ValidationResult{Rcode: dns.RcodeBadKey, SignerName: keyname}
+	}
+	if dns.CanonicalName(t.Algorithm) != key.Algorithm {
+		log.Printf("= Error: TSIG key \"%s\" is used with algorithm %s, configured for %s.",
+			keyname, t.Algorithm, key.Algorithm)
+		return ValidationResult{Rcode: dns.RcodeBadKey, SignerName: keyname}
+	}
+
+	switch status {
+	case nil:
+		log.Printf("* Update TSIG verified correctly")
+		return ValidationResult{Validated: true, Rcode: dns.RcodeSuccess, SignerName: keyname}
+	case dns.ErrTime:
+		log.Printf("= Update TSIG is NOT within its validity period")
+		return ValidationResult{Rcode: dns.RcodeBadTime, SignerName: keyname, Error: status}
+	default:
+		log.Printf("= Error from TSIG verification: %v", status)
+		return ValidationResult{Rcode: dns.RcodeBadSig, SignerName: keyname, Error: status}
+	}
+}
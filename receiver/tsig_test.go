@@ -0,0 +1,126 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+const (
+	testSecret  = "c2VjcmV0IGZvciB0aGUgY2hpbGQgem9uZSB0c2lnIGtleQ=="
+	otherSecret = "YW5vdGhlciBzZWNyZXQgdGhhdCBkb2VzIG5vdCBtYXRjaA=="
+)
+
+type testServer struct {
+	Addr     string
+	KeyDB    *KeyDB
+	ScannerQ chan ScanRequest
+}
+
+// startTestServer runs the receiver's handler on a random UDP port. Updates
+// that reach the updateq are answered with NOERROR.
+func startTestServer(t *testing.T, tsigkeys map[string]*lib.TsigKey) *testServer {
+	t.Helper()
+
+	viper.Reset()
+	viper.Set("parent.zone", "parent.example.")
+	viper.Set("keydb.db", filepath.Join(t.TempDir(), "receiver.db"))
+	viper.Set("ddns.policy.type", "self")
+	viper.Set("ddns.policy.rrtypes", []string{"NS"})
+	t.Cleanup(viper.Reset)
+
+	kdb := NewKeyDB(false)
+	t.Cleanup(func() { kdb.Close() })
+
+	updateq := make(chan UpdateRequest, 5)
+	go func() {
+		for ur := range updateq {
+			ur.Result <- UpdateResult{Rcode: dns.RcodeSuccess, UpstreamRcode: -1}
+		}
+	}()
+	t.Cleanup(func() { close(updateq) })
+
+	scannerq := make(chan ScanRequest, 10)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		Handler:           dns.HandlerFunc(createHandler(scannerq, updateq, kdb, nil, tsigkeys, false, false)),
+		MsgAcceptFunc:     MsgAcceptFunc,
+		TsigSecret:        TsigSecrets(tsigkeys),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	return &testServer{Addr: pc.LocalAddr().String(), KeyDB: kdb, ScannerQ: scannerq}
+}
+
+func TestTsigUpdate(t *testing.T) {
+	childkey, err := lib.NewTsigKey("child.parent.example", "hmac-sha256", testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strongkey, err := lib.NewTsigKey("strong.parent.example", "hmac-sha512", testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := startTestServer(t, map[string]*lib.TsigKey{
+		childkey.Name:  childkey,
+		strongkey.Name: strongkey,
+	})
+
+	tests := []struct {
+		name   string
+		key    lib.TsigKey // as used by the client
+		owner  string
+		rcode  int
+		signed bool // the response must carry a TSIG
+	}{
+		{"own delegation", *childkey, "child.parent.example.", dns.RcodeSuccess, true},
+		{"hmac-sha512", lib.TsigKey{Name: strongkey.Name, Algorithm: dns.HmacSHA512, Secret: testSecret},
+			"strong.parent.example.", dns.RcodeSuccess, true},
+		{"other delegation", *childkey, "other.parent.example.", dns.RcodeRefused, true},
+		{"unknown key", lib.TsigKey{Name: "unknown.parent.example.", Algorithm: dns.HmacSHA256, Secret: testSecret},
+			"unknown.parent.example.", dns.RcodeNotAuth, false},
+		{"wrong secret", lib.TsigKey{Name: childkey.Name, Algorithm: dns.HmacSHA256, Secret: otherSecret},
+			"child.parent.example.", dns.RcodeNotAuth, false},
+		{"wrong algorithm", lib.TsigKey{Name: strongkey.Name, Algorithm: dns.HmacSHA256, Secret: testSecret},
+			"strong.parent.example.", dns.RcodeNotAuth, false},
+	}
+
+	for _, tc := range tests {
+		m := new(dns.Msg)
+		m.SetUpdate("parent.example.")
+		m.Insert([]dns.RR{mustRR(t, tc.owner+" 3600 IN NS ns1.example.net.")})
+		tc.key.Sign(m)
+
+		c := &dns.Client{TsigSecret: tc.key.Secrets()}
+		res, _, err := c.Exchange(m, ts.Addr)
+		if err != nil {
+			t.Errorf("%s: Exchange: %v", tc.name, err)
+			continue
+		}
+		if res.Rcode != tc.rcode {
+			t.Errorf("%s: got rcode %s, want %s", tc.name,
+				dns.RcodeToString[res.Rcode], dns.RcodeToString[tc.rcode])
+		}
+		if (res.IsTsig() != nil) != tc.signed {
+			t.Errorf("%s: response TSIG present: %v, want %v", tc.name, res.IsTsig() != nil, tc.signed)
+		}
+	}
+}
@@ -5,10 +5,13 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	// "github.com/spf13/viper"
 	"github.com/miekg/dns"
 )
 
@@ -17,13 +20,67 @@ type UpdateRequest struct {
 	ZoneName	string
 	Adds		[]dns.RR
 	Removes		[]dns.RR
+	Prereqs		[]dns.RR // The Prerequisite section from the dns.Msg
 	Actions		[]dns.RR // The Update section from the dns.Msg
+	Result		chan UpdateResult // if non-nil the outcome is sent back here
+	state		*int32 // if non-nil the requester is waiting for the outcome, see Submit()
 }
 
-func UpdaterEngine(updateq chan UpdateRequest) error {
+const (
+	updatePending int32 = iota
+	updateStarted
+	updateExpired
+)
+
+// Submit queues the update for the updater and waits for the outcome. If the
+// updater has not started on the update within updateTimeout, the update
+// expires: SERVFAIL is returned and the updater drops the update when it gets
+// to it. Once the updater has started on the update the outcome is waited for,
+// so an update is never both refused to the requester and applied.
+func (ur UpdateRequest) Submit(updateq chan UpdateRequest) UpdateResult {
+	ur.Result = make(chan UpdateResult, 1)
+	ur.state = new(int32)
+	timeout := time.After(updateTimeout)
+
+	select {
+	case updateq <- ur:
+		select {
+		case result := <-ur.Result:
+			return result
+		case <-timeout:
+		}
+	case <-timeout:
+	}
+
+	if !atomic.CompareAndSwapInt32(ur.state, updatePending, updateExpired) {
+		return <-ur.Result
+	}
+	return UpdateResult{
+		Rcode:         dns.RcodeServerFailure,
+		UpstreamRcode: -1,
+		Error:         fmt.Errorf("timeout waiting for the updater, update dropped"),
+	}
+}
+
+// Start is called by the updater before it starts on the update. If it returns
+// false the requester has given up waiting and the update must be dropped.
+func (ur UpdateRequest) Start() bool {
+	return ur.state == nil || atomic.CompareAndSwapInt32(ur.state, updatePending, updateStarted)
+}
+
+type UpdateResult struct {
+	Rcode		int
+	UpstreamRcode	int // -1 if the update was not forwarded
+	Error		error
+}
+
+func UpdaterEngine(updateq chan UpdateRequest, kdb *KeyDB, zd *ZoneData) error {
 	var ur UpdateRequest
 
-	kdb := NewKeyDB(false)
+	fwd := NewForwarder()
+	if zd == nil && fwd == nil {
+		log.Printf("Updater: no parent zone file or upstream primary configured, updates will only be logged")
+	}
 
 	log.Printf("Updater: starting")
 	var wg sync.WaitGroup
@@ -38,9 +95,13 @@ func UpdaterEngine(updateq chan UpdateRequest) error {
 						log.Printf("Updater: Request for update %d adds and %d removes.", len(ur.Adds), len(ur.Removes))
 					} else {
 						log.Printf("Updater: Request for update %d actions.", len(ur.Actions))
-						err := kdb.ApplyUpdate(ur)
-						if err != nil {
-						   log.Printf("Error from ApplyUpdate: %v", err)
+						if !ur.Start() {
+							log.Printf("Updater: update for zone %s expired before it was started. Dropped.", ur.ZoneName)
+							continue
+						}
+						result := kdb.ProcessUpdate(ur, zd, fwd)
+						if result.Error != nil {
+						   log.Printf("Error from ProcessUpdate: %v", result.Error)
 						}
 					}
 				default:
@@ -55,39 +116,148 @@ func UpdaterEngine(updateq chan UpdateRequest) error {
 	return nil
 }
 
+// ProcessUpdate forwards the update to the upstream primary (if configured) and,
+// unless the upstream refused it, applies it locally. The result is sent to the
+// requester on ur.Result (if set). A forwarded update is answered with the
+// upstream rcode as soon as it is known, without waiting for the local apply.
+func (kdb *KeyDB) ProcessUpdate(ur UpdateRequest, zd *ZoneData, fwd *Forwarder) UpdateResult {
+	result := UpdateResult{Rcode: dns.RcodeSuccess, UpstreamRcode: -1}
+
+	// reply sends the result to the requester, at most once
+	reply := func(result UpdateResult) UpdateResult {
+		if ur.Result != nil {
+			ur.Result <- result
+			ur.Result = nil
+		}
+		return result
+	}
+
+	if len(ur.Prereqs) > 0 {
+		switch {
+		case zd != nil:
+			rcode, err := zd.CheckPrerequisites(ur.Prereqs)
+			if rcode != dns.RcodeSuccess {
+				result.Rcode = rcode
+				result.Error = fmt.Errorf("prerequisite not satisfied: %v", err)
+				return reply(result)
+			}
+		case fwd == nil:
+			result.Rcode = dns.RcodeNotImplemented
+			result.Error = fmt.Errorf("no parent zone to evaluate prerequisites against")
+			return reply(result)
+		}
+		// with only an upstream primary the prerequisites are evaluated there
+	}
+
+	if fwd != nil {
+		rcode, err := fwd.Forward(ur)
+		if err != nil {
+			result.Rcode = dns.RcodeServerFailure
+			result.Error = err
+			return reply(result)
+		}
+		result.UpstreamRcode = rcode
+		if rcode != dns.RcodeSuccess {
+			result.Rcode = rcode
+			result.Error = fmt.Errorf("upstream primary %s returned rcode %s",
+				fwd.Upstream, dns.RcodeToString[rcode])
+			return reply(result)
+		}
+		reply(result)
+	}
+
+	if err := kdb.ApplyUpdate(ur, zd); err != nil {
+		if result.UpstreamRcode >= 0 {
+			// the upstream primary has the update, so the requester got its rcode
+			log.Printf("ProcessUpdate: update for zone %s accepted by upstream primary %s, but not applied locally: %v",
+				ur.ZoneName, fwd.Upstream, err)
+			return result
+		}
+		result.Rcode = dns.RcodeServerFailure
+		result.Error = err
+	}
+	return reply(result)
+}
+
+// ApplyUpdate applies the actions in the update to the parent zone (if one is
+// configured), bumps the SOA serial and writes the zone back to disk.
 // 1. Sort actions so that all removes come first.
-func (kdb *KeyDB) ApplyUpdate(ur UpdateRequest) error {
-     for _, req := range ur.Actions {
-     	 class := req.Header().Class
-	 switch class {
-     	 case dns.ClassNONE:
-	      // log.Printf("ApplyUpdate: Remove RR: %s", req.String())
-	 case dns.ClassANY:
-	      //log.Printf("ApplyUpdate: Remove RRset: %s", req.String())
-	 case dns.ClassINET:
-	      // log.Printf("ApplyUpdate: Add RR: %s", req.String())
-	 default:
-	      log.Printf("ApplyUpdate: Error: unknown class: %s", req.String())
-	 }
-
-	 rrtype := req.Header().Rrtype
-
-	 switch rrtype {
-	 case dns.TypeKEY:
-	      keyid := req.(*dns.KEY).KeyTag()
-	       switch class {
-     	       case dns.ClassNONE:
-	       	    log.Printf("ApplyUpdate: Remove KEY with keyid=%d", keyid)
-	       case dns.ClassANY:
-	       	    log.Printf("ApplyUpdate: Remove RRset: %s", req.String())
-	       case dns.ClassINET:
-		    log.Printf("ApplyUpdate: Add KEY with keyid=%d", keyid)
-	       default:
-		    log.Printf("ApplyUpdate: Error: unknown class: %s", req.String())
-	       }
-	 default:
-	 }
-	 
-     }
-     return nil     
-}
\ No newline at end of file
+// 2. Apply the actions to the zone.
+// 3. Only when the zone has been updated are the KEY changes made in the KeyDB.
+func (kdb *KeyDB) ApplyUpdate(ur UpdateRequest, zd *ZoneData) error {
+	actions := make([]dns.RR, len(ur.Actions))
+	copy(actions, ur.Actions)
+	sort.SliceStable(actions, func(i, j int) bool {
+		return actions[i].Header().Class != dns.ClassINET && actions[j].Header().Class == dns.ClassINET
+	})
+
+	for _, req := range actions {
+		switch req.Header().Class {
+		case dns.ClassNONE:
+			log.Printf("ApplyUpdate: Remove RR: %s", req.String())
+		case dns.ClassANY:
+			log.Printf("ApplyUpdate: Remove RRset: %s", req.String())
+		case dns.ClassINET:
+			log.Printf("ApplyUpdate: Add RR: %s", req.String())
+		default:
+			log.Printf("ApplyUpdate: Error: unknown class: %s", req.String())
+		}
+	}
+
+	if zd != nil {
+		if err := zd.applyAndWrite(ur.ZoneName, actions); err != nil {
+			return err
+		}
+	}
+
+	for _, req := range actions {
+		if req.Header().Rrtype != dns.TypeKEY {
+			continue
+		}
+		child := req.Header().Name
+		switch req.Header().Class {
+		case dns.ClassNONE:
+			keyid := req.(*dns.KEY).KeyTag()
+			log.Printf("ApplyUpdate: Remove KEY with keyid=%d", keyid)
+			if err := kdb.RemoveKey(ur.ZoneName, child, keyid); err != nil {
+				return err
+			}
+		case dns.ClassANY:
+			log.Printf("ApplyUpdate: Remove KEY RRset for %s", child)
+			if err := kdb.RemoveKeys(ur.ZoneName, child); err != nil {
+				return err
+			}
+		case dns.ClassINET:
+			key := req.(*dns.KEY)
+			log.Printf("ApplyUpdate: Add KEY with keyid=%d", key.KeyTag())
+			if err := kdb.AddKey(ur.ZoneName, key, KeyStateTrusted, "added by update"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyAndWrite applies the actions to the zone and, if it changed, bumps the
+// serial and writes the zone to disk.
+func (zd *ZoneData) applyAndWrite(zonename string, actions []dns.RR) error {
+	if dns.CanonicalName(zonename) != zd.ZoneName {
+		return fmt.Errorf("update for zone %s, but the parent zone is %s", zonename, zd.ZoneName)
+	}
+
+	changed, err := zd.ApplyActions(actions)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		log.Printf("ApplyUpdate: zone %s not changed by update", zd.ZoneName)
+		return nil
+	}
+
+	serial := zd.BumpSerial()
+	if err := zd.WriteFile(); err != nil {
+		return fmt.Errorf("error writing zone %s to %s: %v", zd.ZoneName, zd.FileName, err)
+	}
+	log.Printf("ApplyUpdate: zone %s updated to serial %d and written to %s", zd.ZoneName, serial, zd.FileName)
+	return nil
+}
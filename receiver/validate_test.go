@@ -0,0 +1,101 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	lib "github.com/johanix/gen-notify-test/lib"
+)
+
+// twinKey returns a copy of the key with the same keytag, but with the algorithm
+// changed to alg (if non-zero) or a different public key. The keytag is a sum of
+// the rdata bytes at even and odd offsets, so moving a value between two offsets
+// of the same parity keeps it.
+func twinKey(t *testing.T, key *dns.KEY, alg uint8) dns.KEY {
+	t.Helper()
+	twin := *key
+	pub, err := base64.StdEncoding.DecodeString(key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the algorithm is at rdata offset 3 and the public key starts at offset 4,
+	// so odd bytes of the public key are at odd offsets too
+	if alg != 0 {
+		diff := int(key.Algorithm) - int(alg)
+		for i := 1; i < len(pub); i += 2 {
+			if v := int(pub[i]) + diff; v >= 0 && v <= 255 {
+				pub[i] = byte(v)
+				break
+			}
+		}
+		twin.Algorithm = alg
+	} else {
+		for i := 2; i < len(pub); i += 2 {
+			if pub[i] != pub[0] {
+				pub[0], pub[i] = pub[i], pub[0]
+				break
+			}
+		}
+	}
+	twin.PublicKey = base64.StdEncoding.EncodeToString(pub)
+	if twin.KeyTag() != key.KeyTag() {
+		t.Fatalf("twin key has keytag %d, want %d", twin.KeyTag(), key.KeyTag())
+	}
+	return twin
+}
+
+func TestValidateUpdate(t *testing.T) {
+	const child = "child.parent.example."
+	key, cs := testKey(t, child)
+	otheralg := twinKey(t, key, dns.ECDSAP256SHA256)
+	collision := twinKey(t, key, 0)
+
+	m := new(dns.Msg)
+	m.SetUpdate("parent.example.")
+	m.Insert([]dns.RR{mustRR(t, child+" 3600 IN NS ns1.example.net.")})
+	signed, err := lib.SignMsgNG(*m, child, cs, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := signed.Copy()
+	tampered.Ns[0].(*dns.NS).Ns = "ns2.example.net."
+
+	tests := []struct {
+		name   string
+		msg    *dns.Msg
+		keys   []dns.KEY
+		rcode  uint8
+		signer string
+	}{
+		{"right key", &signed, []dns.KEY{*key}, dns.RcodeSuccess, child},
+		{"keytag shared with other algorithm", &signed, []dns.KEY{otheralg, *key}, dns.RcodeSuccess, child},
+		{"keytag collision tried first", &signed, []dns.KEY{collision, *key}, dns.RcodeSuccess, child},
+		{"only other algorithm", &signed, []dns.KEY{otheralg}, dns.RcodeBadKey, child},
+		{"only keytag collision", &signed, []dns.KEY{collision}, dns.RcodeBadSig, child},
+		{"no keys", &signed, nil, dns.RcodeBadKey, child},
+		{"tampered update", tampered, []dns.KEY{otheralg, *key}, dns.RcodeBadSig, child},
+		{"unsigned update", m, []dns.KEY{*key}, dns.RcodeFormatError, ""},
+	}
+
+	for _, tc := range tests {
+		keymap := map[string][]dns.KEY{child: tc.keys}
+		vr := ValidateUpdate(tc.msg, keymap)
+		if vr.Rcode != tc.rcode {
+			t.Errorf("%s: got rcode %s, want %s", tc.name,
+				dns.RcodeToString[int(vr.Rcode)], dns.RcodeToString[int(tc.rcode)])
+		}
+		if vr.Validated != (tc.rcode == dns.RcodeSuccess) {
+			t.Errorf("%s: Validated is %v", tc.name, vr.Validated)
+		}
+		if vr.SignerName != tc.signer {
+			t.Errorf("%s: got signer %q, want %q", tc.name, vr.SignerName, tc.signer)
+		}
+	}
+}
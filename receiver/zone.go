@@ -0,0 +1,250 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// ZoneData is an in-memory copy of the parent zone, loaded from and written
+// back to a master file.
+type ZoneData struct {
+	ZoneName string
+	FileName string
+	SOA      *dns.SOA
+	Owners   map[string]map[uint16][]dns.RR // owner -> rrtype -> RRset
+	mu       sync.RWMutex
+}
+
+// LoadParentZone loads the parent zone from parent.zonefile. Returns nil if no
+// zone file is configured.
+func LoadParentZone() *ZoneData {
+	zonefile := viper.GetString("parent.zonefile")
+	if zonefile == "" {
+		return nil
+	}
+	zd, err := LoadZone(viper.GetString("parent.zone"), zonefile)
+	if err != nil {
+		log.Fatalf("Error loading parent zone from %s: %v", zonefile, err)
+	}
+	return zd
+}
+
+func LoadZone(zonename, filename string) (*ZoneData, error) {
+	zd := ZoneData{
+		ZoneName: dns.CanonicalName(zonename),
+		FileName: filename,
+		Owners:   map[string]map[uint16][]dns.RR{},
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zp := dns.NewZoneParser(f, zd.ZoneName, filename)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if soa, ok := rr.(*dns.SOA); ok && dns.CanonicalName(soa.Hdr.Name) == zd.ZoneName {
+			zd.SOA = soa
+			continue
+		}
+		zd.addRR(rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("error parsing zone file %s: %v", filename, err)
+	}
+	if zd.SOA == nil {
+		return nil, fmt.Errorf("zone file %s has no SOA for %s", filename, zd.ZoneName)
+	}
+	log.Printf("LoadZone: loaded zone %s (serial %d) from %s", zd.ZoneName, zd.SOA.Serial, filename)
+	return &zd, nil
+}
+
+func (zd *ZoneData) RRset(owner string, rrtype uint16) []dns.RR {
+	zd.mu.RLock()
+	defer zd.mu.RUnlock()
+	if rrtype == dns.TypeSOA && dns.CanonicalName(owner) == zd.ZoneName {
+		return []dns.RR{zd.SOA}
+	}
+	return zd.Owners[dns.CanonicalName(owner)][rrtype]
+}
+
+// ApplyActions applies the update section of a DNS UPDATE according to RFC 2136
+// section 3.4.2. Returns true if the zone was modified. All actions are checked
+// before the zone is touched, so an update is either applied in full or not at all.
+func (zd *ZoneData) ApplyActions(actions []dns.RR) (bool, error) {
+	zd.mu.Lock()
+	defer zd.mu.Unlock()
+
+	for _, rr := range actions {
+		owner := dns.CanonicalName(rr.Header().Name)
+		if !dns.IsSubDomain(zd.ZoneName, owner) {
+			return false, fmt.Errorf("owner %s is outside zone %s", owner, zd.ZoneName)
+		}
+		switch rr.Header().Class {
+		case dns.ClassNONE, dns.ClassANY, dns.ClassINET:
+		default:
+			return false, fmt.Errorf("unknown class in update: %s", rr.String())
+		}
+	}
+
+	changed := false
+	for _, rr := range actions {
+		owner := dns.CanonicalName(rr.Header().Name)
+		rrtype := rr.Header().Rrtype
+
+		switch rr.Header().Class {
+		case dns.ClassNONE:
+			// Remove an RR from an RRset. Never remove the SOA or the last apex NS.
+			if rrtype == dns.TypeSOA {
+				continue
+			}
+			rrset := zd.Owners[owner][rrtype]
+			if owner == zd.ZoneName && rrtype == dns.TypeNS && len(rrset) <= 1 {
+				continue
+			}
+			cp := dns.Copy(rr)
+			cp.Header().Class = dns.ClassINET
+			for i, orr := range rrset {
+				if dns.IsDuplicate(orr, cp) {
+					zd.Owners[owner][rrtype] = append(rrset[:i], rrset[i+1:]...)
+					changed = true
+					break
+				}
+			}
+
+		case dns.ClassANY:
+			// Remove an RRset, or all RRsets if the type is ANY. Never remove
+			// the apex SOA or NS RRsets.
+			rrsets, ok := zd.Owners[owner]
+			if !ok {
+				continue
+			}
+			for t := range rrsets {
+				if rrtype != dns.TypeANY && t != rrtype {
+					continue
+				}
+				if owner == zd.ZoneName && (t == dns.TypeSOA || t == dns.TypeNS) {
+					continue
+				}
+				delete(rrsets, t)
+				changed = true
+			}
+
+		case dns.ClassINET:
+			if rrtype == dns.TypeSOA {
+				continue // the serial is managed by the receiver
+			}
+			if zd.addRR(rr) {
+				changed = true
+			}
+		}
+
+		if rrsets, ok := zd.Owners[owner]; ok {
+			if len(rrsets[rrtype]) == 0 {
+				delete(rrsets, rrtype)
+			}
+			if len(rrsets) == 0 {
+				delete(zd.Owners, owner)
+			}
+		}
+	}
+	return changed, nil
+}
+
+// addRR adds the RR unless it is already present. Must be called with the lock held.
+func (zd *ZoneData) addRR(rr dns.RR) bool {
+	owner := dns.CanonicalName(rr.Header().Name)
+	rrtype := rr.Header().Rrtype
+	if _, ok := zd.Owners[owner]; !ok {
+		zd.Owners[owner] = map[uint16][]dns.RR{}
+	}
+	for _, orr := range zd.Owners[owner][rrtype] {
+		if dns.IsDuplicate(orr, rr) {
+			return false
+		}
+	}
+	zd.Owners[owner][rrtype] = append(zd.Owners[owner][rrtype], rr)
+	return true
+}
+
+// BumpSerial increments the SOA serial, using RFC 1982 arithmetic.
+func (zd *ZoneData) BumpSerial() uint32 {
+	zd.mu.Lock()
+	defer zd.mu.Unlock()
+	zd.SOA.Serial++
+	if zd.SOA.Serial == 0 {
+		zd.SOA.Serial++
+	}
+	return zd.SOA.Serial
+}
+
+// WriteFile writes the zone to a temporary file in the same directory and then
+// renames it on top of the master file, so that the file is never half-written.
+func (zd *ZoneData) WriteFile() error {
+	zd.mu.RLock()
+	defer zd.mu.RUnlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(zd.FileName), filepath.Base(zd.FileName)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+
+	w := bufio.NewWriter(tmp)
+	fmt.Fprintf(w, "$ORIGIN %s\n", zd.ZoneName)
+	fmt.Fprintf(w, "%s\n", zd.SOA.String())
+
+	owners := make([]string, 0, len(zd.Owners))
+	for owner := range zd.Owners {
+		owners = append(owners, owner)
+	}
+	// apex first, then the rest sorted
+	sort.Slice(owners, func(i, j int) bool {
+		if owners[i] == zd.ZoneName || owners[j] == zd.ZoneName {
+			return owners[i] == zd.ZoneName && owners[j] != zd.ZoneName
+		}
+		return owners[i] < owners[j]
+	})
+	for _, owner := range owners {
+		rrsets := zd.Owners[owner]
+		types := make([]int, 0, len(rrsets))
+		for t := range rrsets {
+			types = append(types, int(t))
+		}
+		sort.Ints(types)
+		for _, t := range types {
+			for _, rr := range rrsets[uint16(t)] {
+				fmt.Fprintf(w, "%s\n", rr.String())
+			}
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(zd.FileName); err == nil {
+		os.Chmod(tmp.Name(), fi.Mode())
+	}
+	return os.Rename(tmp.Name(), zd.FileName)
+}
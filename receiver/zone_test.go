@@ -0,0 +1,213 @@
+/*
+ * Johan Stenstam, johani@johani.org
+ */
+
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// testZone returns a parent zone with a delegation to child.parent.example.
+func testZone(t *testing.T) *ZoneData {
+	t.Helper()
+	zd := &ZoneData{
+		ZoneName: "parent.example.",
+		FileName: filepath.Join(t.TempDir(), "parent.example.zone"),
+		SOA:      mustRR(t, "parent.example. 3600 IN SOA ns1.parent.example. hostmaster.parent.example. 1 3600 600 86400 300").(*dns.SOA),
+		Owners:   map[string]map[uint16][]dns.RR{},
+	}
+	for _, s := range []string{
+		"parent.example. 3600 IN NS ns1.parent.example.",
+		"child.parent.example. 3600 IN NS ns1.example.net.",
+		"child.parent.example. 3600 IN NS ns2.example.net.",
+	} {
+		zd.addRR(mustRR(t, s))
+	}
+	return zd
+}
+
+func removeRR(t *testing.T, s string) dns.RR {
+	rr := mustRR(t, s)
+	rr.Header().Class = dns.ClassNONE
+	rr.Header().Ttl = 0
+	return rr
+}
+
+func TestApplyActionsAtomic(t *testing.T) {
+	outside := mustRR(t, "child.other.example. 3600 IN NS ns1.example.net.")
+	badclass := mustRR(t, "child.parent.example. 3600 IN NS ns3.example.net.")
+	badclass.Header().Class = dns.ClassCHAOS
+
+	for _, bad := range []dns.RR{outside, badclass} {
+		zd := testZone(t)
+		actions := []dns.RR{
+			removeRR(t, "child.parent.example. 3600 IN NS ns1.example.net."),
+			mustRR(t, "child.parent.example. 3600 IN NS ns3.example.net."),
+			bad,
+		}
+		changed, err := zd.ApplyActions(actions)
+		if err == nil {
+			t.Errorf("ApplyActions with %s did not fail", bad.String())
+		}
+		if changed {
+			t.Errorf("ApplyActions with %s reported the zone as changed", bad.String())
+		}
+		ns := zd.Owners["child.parent.example."][dns.TypeNS]
+		if len(ns) != 2 || ns[0].(*dns.NS).Ns != "ns1.example.net." || ns[1].(*dns.NS).Ns != "ns2.example.net." {
+			t.Errorf("ApplyActions with %s modified the zone: %v", bad.String(), ns)
+		}
+	}
+}
+
+func TestApplyUpdateKeyDB(t *testing.T) {
+	viper.Reset()
+	viper.Set("keydb.db", filepath.Join(t.TempDir(), "receiver.db"))
+	t.Cleanup(viper.Reset)
+	kdb := NewKeyDB(false)
+	t.Cleanup(func() { kdb.Close() })
+
+	key := mustRR(t, "child.parent.example. 3600 IN KEY 512 3 15 l02Woi0iS8Aa25FQkUd9RMzZHJpBoRQwAQEX1SxZJA4=")
+	keymap := func() int {
+		km, err := kdb.KeyMap("parent.example.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(km["child.parent.example."])
+	}
+
+	// a failing zone update must not leave the key behind in the KeyDB
+	zd := testZone(t)
+	ur := UpdateRequest{ZoneName: "parent.example.", Actions: []dns.RR{
+		key, mustRR(t, "child.other.example. 3600 IN NS ns1.example.net."),
+	}}
+	if err := kdb.ApplyUpdate(ur, zd); err == nil {
+		t.Fatalf("ApplyUpdate with an action outside the zone did not fail")
+	}
+	if n := keymap(); n != 0 {
+		t.Errorf("failed update left %d keys in the KeyDB", n)
+	}
+	if _, ok := zd.Owners["child.parent.example."][dns.TypeKEY]; ok {
+		t.Errorf("failed update added the KEY to the zone")
+	}
+	if zd.SOA.Serial != 1 {
+		t.Errorf("failed update bumped the serial to %d", zd.SOA.Serial)
+	}
+
+	ur.Actions = []dns.RR{key}
+	if err := kdb.ApplyUpdate(ur, zd); err != nil {
+		t.Fatalf("ApplyUpdate: %v", err)
+	}
+	if n := keymap(); n != 1 {
+		t.Errorf("KeyDB has %d keys for the child after the update, want 1", n)
+	}
+	if zd.SOA.Serial != 2 {
+		t.Errorf("serial is %d after the update, want 2", zd.SOA.Serial)
+	}
+}
+
+// startUpstream runs a fake upstream primary that answers every update with rcode.
+func startUpstream(t *testing.T, rcode int) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetRcode(r, rcode)
+			w.WriteMsg(m)
+		}),
+		MsgAcceptFunc:     func(dh dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestProcessUpdateForwarded(t *testing.T) {
+	viper.Reset()
+	viper.Set("keydb.db", filepath.Join(t.TempDir(), "receiver.db"))
+	t.Cleanup(viper.Reset)
+	kdb := NewKeyDB(false)
+	t.Cleanup(func() { kdb.Close() })
+
+	// the local zone is for another parent, so the local apply fails
+	zd := testZone(t)
+	zd.ZoneName = "other.example."
+
+	for _, upstream := range []int{dns.RcodeSuccess, dns.RcodeRefused} {
+		fwd := &Forwarder{Upstream: startUpstream(t, upstream)}
+		resultch := make(chan UpdateResult, 1)
+		ur := UpdateRequest{Cmd: "UPDATE", ZoneName: "parent.example.", Result: resultch,
+			Actions: []dns.RR{mustRR(t, "child.parent.example. 3600 IN NS ns3.example.net.")}}
+
+		kdb.ProcessUpdate(ur, zd, fwd)
+		select {
+		case result := <-resultch:
+			if result.Rcode != upstream || result.UpstreamRcode != upstream {
+				t.Errorf("upstream %s: got rcode %s (upstream %s)", dns.RcodeToString[upstream],
+					dns.RcodeToString[result.Rcode], dns.RcodeToString[result.UpstreamRcode])
+			}
+		default:
+			t.Fatalf("upstream %s: no result sent to the requester", dns.RcodeToString[upstream])
+		}
+		if len(resultch) != 0 {
+			t.Errorf("upstream %s: more than one result sent to the requester", dns.RcodeToString[upstream])
+		}
+	}
+}
+
+func TestSubmitUpdateTimeout(t *testing.T) {
+	viper.Reset()
+	viper.Set("keydb.db", filepath.Join(t.TempDir(), "receiver.db"))
+	t.Cleanup(viper.Reset)
+	kdb := NewKeyDB(false)
+	t.Cleanup(func() { kdb.Close() })
+
+	saved := updateTimeout
+	updateTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { updateTimeout = saved })
+
+	zd := testZone(t)
+	approved := ApprovalResult{Approved: true}
+	update := func(ns string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetUpdate("parent.example.")
+		m.Insert([]dns.RR{mustRR(t, "child.parent.example. 3600 IN NS "+ns)})
+		return m
+	}
+
+	// the updater is busy, so the client gets SERVFAIL
+	updateq := make(chan UpdateRequest, 10)
+	result := SubmitUpdate("parent.example.", update("ns3.example.net."), approved, updateq)
+	if result.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("timed out update got rcode %s, want SERVFAIL", dns.RcodeToString[result.Rcode])
+	}
+
+	// and the update is dropped when the updater gets to it
+	go UpdaterEngine(updateq, kdb, zd)
+	updateTimeout = 5 * time.Second
+	result = SubmitUpdate("parent.example.", update("ns4.example.net."), approved, updateq)
+	if result.Rcode != dns.RcodeSuccess {
+		t.Fatalf("update got rcode %s: %v", dns.RcodeToString[result.Rcode], result.Error)
+	}
+	var got []string
+	for _, rr := range zd.Owners["child.parent.example."][dns.TypeNS] {
+		got = append(got, rr.(*dns.NS).Ns)
+	}
+	if len(got) != 3 || got[2] != "ns4.example.net." {
+		t.Errorf("child NS RRset is %v, want ns1, ns2 and ns4 (the timed out update dropped)", got)
+	}
+}